@@ -0,0 +1,146 @@
+/*
+Package archive stores sweeps on disk, one per file, and reads them
+back as buffer.Sweep values.
+
+# File format
+
+All values are little-endian.  A sweep file has three parts: a
+header, the scanline records, and an index of the records.
+
+The header begins with 104 bytes at fixed offsets:
+
+	offset  size  contents
+	     0     8  magic number: "OGDARSWP"
+	     8     2  format version: FORMAT_VERSION
+	    10     2  scanline header version: buffer.SCANLINE_HDR_VERSION
+	    12     4  length of the whole header, in bytes; the first record starts here
+	    16     4  number of scanline records
+	    20     4  ARP count at the start of the sweep
+	    24     8  time of first scanline, in nanoseconds since 1970-01-01 UTC
+	    32     8  time of last scanline, in nanoseconds since 1970-01-01 UTC
+	    40     4  ADC clock rate, in Hz
+	    44     4  TrigDelay register, in ADC clocks
+	    48     8  range delay, in ADC clocks (IEEE 754 double)
+	    56     8  file offset of the index
+	    64     4  flags: bit 0 set if every scanline has the same decimation and first sample range
+	    68     4  reserved (0)
+	    72     2  nominal PRF, in Hz
+	    74     2  nominal ACPs per rotation
+	    76     2  transmitted power, in watts
+	    78     2  reserved (0)
+	    80     8  heading offset, in degrees (double)
+	    88     8  horizontal beamwidth, in degrees (double)
+	    96     8  nominal rotation rate, in RPM (double)
+
+followed by three strings, each a 2-byte length and that many bytes
+of UTF-8: the radar model, pulse length, and operating profile.
+Readers must use the header length to find the first record, since
+later versions may add fields to the end of the header.
+
+Each scanline record is the 40-byte scanline header (see
+buffer.ScanlineHdr, whose blank fields are written as zero), a 4-byte
+count n of samples, 4 reserved bytes, then n 2-byte samples.
+
+The index is one 8-byte file offset for each scanline record, in
+order.
+
+Scanlines whose samples were overwritten in the ring buffer before
+they could be written are left out, so the trigger counts of
+consecutive records can differ by more than the number of
+untriggered pulses.
+*/
+package archive
+
+import (
+	"github.com/jbrzusto/ogdar/buffer"
+	"time"
+)
+
+const (
+	MAGIC          = "OGDARSWP" // first 8 bytes of every sweep file
+	FORMAT_VERSION = 1          // version of the file format written by this package
+	FIXED_HDR_SIZE = 104        // bytes in the fixed part of the header
+	LINE_HDR_SIZE  = 48         // bytes in a scanline record before its samples
+	FILE_SUFFIX    = ".sweep"   // suffix of sweep file names
+)
+
+// FLAG_UNIFORM is set in the header flags if every scanline has the
+// same decimation and first sample range.
+const FLAG_UNIFORM = 1
+
+// Params describes the radar a sweep was recorded from.
+type Params struct {
+	Model           string  // radar make and model
+	Pulse           string  // pulse length; "" if unknown
+	Profile         string  // ogdar operating profile; "" if none
+	PRF             uint16  // nominal PRF, in Hz
+	ACPsPerRotation uint16  // nominal ACPs per rotation
+	Power           uint16  // transmitted power, in watts
+	HeadingOffset   float64 // azimuth of the antenna at the ARP, in degrees clockwise from the heading reference
+	Beamwidth       float64 // horizontal beamwidth, in degrees
+	RPM             float64 // nominal rotation rate
+}
+
+// Header is the header of a sweep file.
+type Header struct {
+	Version    uint16             // format version
+	HdrVersion uint16             // scanline header version
+	NumLines   int                // number of scanline records
+	ARP        uint32             // ARP count at start of sweep
+	First      time.Time          // time of first scanline
+	Last       time.Time          // time of last scanline
+	ClockRate  uint32             // ADC clock rate, in Hz
+	Ranging    buffer.RangeParams // digitizer settings for computing range
+	Uniform    bool               // every scanline has the same decimation and first sample range
+	Params                        // radar
+}
+
+// fixedHeader is the fixed part of a sweep file header, as stored.
+type fixedHeader struct {
+	Magic           [8]byte
+	Version         uint16
+	HdrVersion      uint16
+	HeaderLen       uint32
+	NumLines        uint32
+	ARP             uint32
+	FirstTime       int64
+	LastTime        int64
+	ClockRate       uint32
+	TrigDelay       uint32
+	RangeDelay      float64
+	IndexOffset     uint64
+	Flags           uint32
+	_               uint32
+	PRF             uint16
+	ACPsPerRotation uint16
+	Power           uint16
+	_               uint16
+	HeadingOffset   float64
+	Beamwidth       float64
+	RPM             float64
+}
+
+// Config holds parameters for a Writer.  It is read from the [archive]
+// section of ogdar.toml.
+type Config struct {
+	Dir      string // directory in which to write sweep files; "" means don't
+	DB       string // SQLite capture database to record sweeps in; "" means don't
+	DBLayout string // layout of DB if it is created: "ogdar", or "digdar" as for digdar's capture databases
+	Every    int    // archive one sweep in this many
+}
+
+// DefaultConfig is used for any values not given in ogdar.toml.
+var DefaultConfig = Config{
+	Dir:      "",
+	DB:       "",
+	DBLayout: "ogdar",
+	Every:    1,
+}
+
+// Store is somewhere other than a sweep file that a Writer can archive
+// sweeps, such as a capture database.  WriteSweep records sw with p as
+// the radar's parameters, leaving out scanlines whose samples have been
+// overwritten in the ring buffer; lost is their number.
+type Store interface {
+	WriteSweep(sw *buffer.Sweep, p Params) (lost int, err error)
+}
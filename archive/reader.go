@@ -0,0 +1,203 @@
+package archive
+
+// Reading sweep files.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/fpga"
+	"io"
+	"os"
+	"time"
+)
+
+// Reader reads scanlines from a sweep file.
+type Reader struct {
+	f     *os.File
+	path  string
+	hdr   Header
+	index []uint64 // file offset of each scanline record
+}
+
+// Open opens the sweep file at path and reads its header and index.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{f: f, path: path}
+	if err = r.readHeader(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+// readHeader reads the file's header and index.
+func (r *Reader) readHeader() error {
+	var h fixedHeader
+	br := bufio.NewReader(r.f)
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+	switch {
+	case string(h.Magic[:]) != MAGIC:
+		return fmt.Errorf("not a sweep file")
+	case h.Version > FORMAT_VERSION:
+		return fmt.Errorf("format version %d is newer than this reader's (%d)", h.Version, FORMAT_VERSION)
+	case h.HdrVersion != buffer.SCANLINE_HDR_VERSION:
+		return fmt.Errorf("scanline header version %d is not supported (only %d)", h.HdrVersion, buffer.SCANLINE_HDR_VERSION)
+	case h.HeaderLen < FIXED_HDR_SIZE:
+		return fmt.Errorf("header length %d is too short", h.HeaderLen)
+	}
+	var strs [3]string
+	for i := range strs {
+		var n uint16
+		if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+			return fmt.Errorf("reading header: %v", err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return fmt.Errorf("reading header: %v", err)
+		}
+		strs[i] = string(b)
+	}
+	r.hdr = Header{
+		Version:    h.Version,
+		HdrVersion: h.HdrVersion,
+		NumLines:   int(h.NumLines),
+		ARP:        h.ARP,
+		First:      time.Unix(0, h.FirstTime),
+		Last:       time.Unix(0, h.LastTime),
+		ClockRate:  h.ClockRate,
+		Ranging:    buffer.RangeParams{TrigDelay: h.TrigDelay, RangeDelay: h.RangeDelay},
+		Uniform:    h.Flags&FLAG_UNIFORM != 0,
+		Params: Params{
+			Model:           strs[0],
+			Pulse:           strs[1],
+			Profile:         strs[2],
+			PRF:             h.PRF,
+			ACPsPerRotation: h.ACPsPerRotation,
+			Power:           h.Power,
+			HeadingOffset:   h.HeadingOffset,
+			Beamwidth:       h.Beamwidth,
+			RPM:             h.RPM,
+		},
+	}
+	// check the index fits in the file before allocating it, since a
+	// corrupt NumLines could ask for gigabytes
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	if size := uint64(fi.Size()); h.IndexOffset > size || uint64(h.NumLines) > (size-h.IndexOffset)/8 {
+		return fmt.Errorf("index of %d scanlines at offset %d runs past the end of the file (%d bytes)", h.NumLines, h.IndexOffset, fi.Size())
+	}
+	if _, err := r.f.Seek(int64(h.IndexOffset), io.SeekStart); err != nil {
+		return err
+	}
+	r.index = make([]uint64, h.NumLines)
+	if err := binary.Read(bufio.NewReader(r.f), binary.LittleEndian, r.index); err != nil {
+		return fmt.Errorf("reading index: %v", err)
+	}
+	return nil
+}
+
+// Header returns the file's header.
+func (r *Reader) Header() *Header {
+	return &r.hdr
+}
+
+// NumLines returns the number of scanlines in the file.
+func (r *Reader) NumLines() int {
+	return len(r.index)
+}
+
+// Line returns the i'th scanline in the file.  As in the ring buffer,
+// its Samples begin with the two-slot fingerprint, so Valid and Data
+// work as usual.
+func (r *Reader) Line(i int) (l buffer.Scanline, err error) {
+	if i < 0 || i >= len(r.index) {
+		return l, fmt.Errorf("%s: no scanline %d; file has %d", r.path, i, len(r.index))
+	}
+	if _, err = r.f.Seek(int64(r.index[i]), io.SeekStart); err != nil {
+		return
+	}
+	err = ReadRecord(bufio.NewReader(r.f), &l)
+	if err != nil {
+		err = fmt.Errorf("%s: scanline %d: %v", r.path, i, err)
+	}
+	return
+}
+
+// Sweep returns all the file's scanlines as a sweep.
+func (r *Reader) Sweep() (*buffer.Sweep, error) {
+	lines := make([]buffer.Scanline, len(r.index))
+	if len(r.index) > 0 {
+		if _, err := r.f.Seek(int64(r.index[0]), io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	br := bufio.NewReaderSize(r.f, 1<<16)
+	for i := range lines {
+		if err := ReadRecord(br, &lines[i]); err != nil {
+			return nil, fmt.Errorf("%s: scanline %d: %v", r.path, i, err)
+		}
+	}
+	return buffer.NewSweep(r.hdr.ARP, r.hdr.Ranging, lines, r.hdr.First, r.hdr.Last), nil
+}
+
+// Close closes the file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+// ReadFile reads the sweep file at path.
+func ReadFile(path string) (*Header, *buffer.Sweep, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	sw, err := r.Sweep()
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Header(), sw, nil
+}
+
+// ReadRecord reads a scanline record from br into l.
+func ReadRecord(br io.Reader, l *buffer.Scanline) error {
+	var hdr [LINE_HDR_SIZE]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	l.ScanlineHdr = buffer.ScanlineHdr{
+		Version:       le.Uint16(hdr[0:]),
+		DecimRateM1:   buffer.DecimRateM1(le.Uint16(hdr[2:])),
+		Extra:         le.Uint16(hdr[4:]),
+		TrigCount:     le.Uint64(hdr[8:]),
+		TrigClock:     le.Uint64(hdr[16:]),
+		ARPCount:      le.Uint32(hdr[24:]),
+		ACPCount:      le.Uint32(hdr[28:]),
+		ClockSinceACP: le.Uint32(hdr[32:]),
+	}
+	n := le.Uint32(hdr[40:])
+	if n > fpga.SAMPLES_PER_BUFF {
+		return fmt.Errorf("bad sample count %d", n)
+	}
+	b := make([]byte, 2*n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return err
+	}
+	l.Samples = make([]buffer.Sample, n+2)
+	l.Samples[0] = buffer.NOT_A_SAMPLE
+	l.Samples[1] = buffer.Sample(l.TrigCount)
+	for i := 0; i < int(n); i++ {
+		l.Samples[i+2] = buffer.Sample(le.Uint16(b[2*i:]))
+	}
+	return nil
+}
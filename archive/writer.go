@@ -0,0 +1,304 @@
+package archive
+
+// Writing sweep files.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/jbrzusto/ogdar/buffer"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// QUEUE_LEN is the number of completed sweeps which can wait to be
+// written; further sweeps are dropped until there is room.
+const QUEUE_LEN = 2
+
+// Writer archives sweeps to files in a directory, and to a Store if it
+// has one.  It is safe for concurrent use.
+type Writer struct {
+	written uint64 // sweeps written; first for 64-bit alignment of atomic access on ARM
+	dropped uint64 // sweeps not written because the queue was full, or because of an error
+	lost    uint64 // scanlines left out because they were overwritten before being written
+	mu      sync.Mutex
+	cfg     Config
+	params  Params
+	store   Store
+	seen    int // sweeps seen since last archived
+	queue   chan job
+}
+
+// job is a sweep waiting to be written, with the parameters in effect
+// when it was completed.
+type job struct {
+	sw     *buffer.Sweep
+	dir    string
+	store  Store
+	params Params
+}
+
+// NewWriter returns a Writer which records sweeps from the radar
+// described by p.  Call Run to start it.
+func NewWriter(cfg Config, p Params) *Writer {
+	return &Writer{cfg: cfg, params: p, queue: make(chan job, QUEUE_LEN)}
+}
+
+// SetConfig changes the writer's configuration.
+func (w *Writer) SetConfig(cfg Config) {
+	w.mu.Lock()
+	w.cfg = cfg
+	w.mu.Unlock()
+}
+
+// SetStore sets the Store which sweeps are also archived to; nil means
+// none.  Sweeps already queued are still written to the old one.
+func (w *Writer) SetStore(s Store) {
+	w.mu.Lock()
+	w.store = s
+	w.mu.Unlock()
+}
+
+// SetParams changes the radar parameters recorded with sweeps
+// completed from now on.
+func (w *Writer) SetParams(p Params) {
+	w.mu.Lock()
+	w.params = p
+	w.mu.Unlock()
+}
+
+// Stats returns the number of sweeps written and dropped, and the
+// number of scanlines lost from written sweeps.
+func (w *Writer) Stats() (written, dropped, lost uint64) {
+	return atomic.LoadUint64(&w.written), atomic.LoadUint64(&w.dropped), atomic.LoadUint64(&w.lost)
+}
+
+// Add queues the completed sweep sw to be written, if it is due to be
+// archived.  It does not block, so it can be a SweepAssembler handler.
+func (w *Writer) Add(sw *buffer.Sweep) {
+	w.mu.Lock()
+	cfg, p, st := w.cfg, w.params, w.store
+	due := false
+	if cfg.Dir != "" || st != nil {
+		if w.seen++; w.seen >= cfg.Every {
+			w.seen = 0
+			due = true
+		}
+	}
+	w.mu.Unlock()
+	if !due {
+		return
+	}
+	select {
+	case w.queue <- job{sw, cfg.Dir, st, p}:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Run writes queued sweeps until stop is closed.  Errors are printed,
+// and the sweep counted as dropped.
+func (w *Writer) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case j := <-w.queue:
+			if w.write(j) {
+				atomic.AddUint64(&w.written, 1)
+			} else {
+				atomic.AddUint64(&w.dropped, 1)
+			}
+		}
+	}
+}
+
+// write writes j's sweep to a file and to its store, as configured,
+// and reports whether both succeeded.  Lost scanlines are counted once,
+// from whichever noticed more.
+func (w *Writer) write(j job) bool {
+	ok, maxLost := true, 0
+	record := func(lost int, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to archive sweep: %v\n", err)
+			ok = false
+		}
+		if lost > maxLost {
+			maxLost = lost
+		}
+	}
+	if j.dir != "" {
+		record(WriteSweep(filepath.Join(j.dir, FileName(j.sw)), j.sw, j.params))
+	}
+	if j.store != nil {
+		record(j.store.WriteSweep(j.sw, j.params))
+	}
+	atomic.AddUint64(&w.lost, uint64(maxLost))
+	return ok
+}
+
+// FileName returns the name of the file for sw: its start time in
+// UTC, and ARP count.
+func FileName(sw *buffer.Sweep) string {
+	first, _ := sw.Times()
+	return fmt.Sprintf("ogdar-%s-arp%010d%s", first.UTC().Format("20060102T150405.000Z"), sw.ARP, FILE_SUFFIX)
+}
+
+// WriteSweep writes sw to a sweep file at path, recording p as the
+// radar's parameters.  Scanlines whose samples have been overwritten in
+// the ring buffer are left out; lost is their number.  The file is
+// written under a temporary name, and only renamed to path once
+// complete.
+func WriteSweep(path string, sw *buffer.Sweep, p Params) (lost int, err error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	if lost, err = writeSweep(f, sw, p); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return lost, os.Rename(tmp, path)
+}
+
+// EncodeSweep returns sw encoded as a sweep file, e.g. for sending
+// over a network; see WriteSweep.
+func EncodeSweep(sw *buffer.Sweep, p Params) (b []byte, lost int, err error) {
+	var m memFile
+	lost, err = writeSweep(&m, sw, p)
+	return m.b, lost, err
+}
+
+// memFile is an in-memory io.WriteSeeker.
+type memFile struct {
+	b   []byte
+	off int
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	if n := m.off + len(p); n > len(m.b) {
+		m.b = append(m.b, make([]byte, n-len(m.b))...)
+	}
+	copy(m.b[m.off:], p)
+	m.off += len(p)
+	return len(p), nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(m.off)
+	case io.SeekEnd:
+		offset += int64(len(m.b))
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	m.off = int(offset)
+	return offset, nil
+}
+
+// writeSweep writes sw to f; see WriteSweep.
+func writeSweep(f io.WriteSeeker, sw *buffer.Sweep, p Params) (lost int, err error) {
+	first, last := sw.Times()
+	h := fixedHeader{
+		Version:         FORMAT_VERSION,
+		HdrVersion:      buffer.SCANLINE_HDR_VERSION,
+		ARP:             sw.ARP,
+		FirstTime:       first.UnixNano(),
+		LastTime:        last.UnixNano(),
+		ClockRate:       sw.ClockRate(),
+		TrigDelay:       sw.Ranging.TrigDelay,
+		RangeDelay:      sw.Ranging.RangeDelay,
+		PRF:             p.PRF,
+		ACPsPerRotation: p.ACPsPerRotation,
+		Power:           p.Power,
+		HeadingOffset:   p.HeadingOffset,
+		Beamwidth:       p.Beamwidth,
+		RPM:             p.RPM,
+	}
+	copy(h.Magic[:], MAGIC)
+	if sw.Uniform() {
+		h.Flags |= FLAG_UNIFORM
+	}
+	strs := []string{p.Model, p.Pulse, p.Profile}
+	h.HeaderLen = FIXED_HDR_SIZE
+	for _, s := range strs {
+		if len(s) > math.MaxUint16 {
+			return 0, fmt.Errorf("string too long for sweep file header: %.40q...", s)
+		}
+		h.HeaderLen += 2 + uint32(len(s))
+	}
+	bw := bufio.NewWriterSize(f, 1<<16)
+	binary.Write(bw, binary.LittleEndian, &h)
+	for _, s := range strs {
+		binary.Write(bw, binary.LittleEndian, uint16(len(s)))
+		bw.WriteString(s)
+	}
+	offset := uint64(h.HeaderLen)
+	index := make([]uint64, 0, sw.NumLines())
+	var rec []byte
+	for i := 0; i < sw.NumLines(); i++ {
+		l := sw.Line(i)
+		// copy the samples before checking they are still valid, in
+		// case they are overwritten while being copied
+		rec = AppendRecord(rec[:0], l)
+		if !l.Valid() {
+			lost++
+			continue
+		}
+		if _, err = bw.Write(rec); err != nil {
+			return
+		}
+		index = append(index, offset)
+		offset += uint64(len(rec))
+	}
+	h.NumLines = uint32(len(index))
+	h.IndexOffset = offset
+	binary.Write(bw, binary.LittleEndian, index)
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	// fill in the number of scanlines and the index offset
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	err = binary.Write(f, binary.LittleEndian, &h)
+	return
+}
+
+// AppendRecord appends the scanline record for l to b, as stored in
+// sweep files.  It does not check that l is still valid.
+func AppendRecord(b []byte, l *buffer.Scanline) []byte {
+	d := l.Data()
+	var hdr [LINE_HDR_SIZE]byte
+	h := &l.ScanlineHdr
+	le := binary.LittleEndian
+	le.PutUint16(hdr[0:], h.Version)
+	le.PutUint16(hdr[2:], uint16(h.DecimRateM1))
+	le.PutUint16(hdr[4:], h.Extra)
+	le.PutUint64(hdr[8:], h.TrigCount)
+	le.PutUint64(hdr[16:], h.TrigClock)
+	le.PutUint32(hdr[24:], h.ARPCount)
+	le.PutUint32(hdr[28:], h.ACPCount)
+	le.PutUint32(hdr[32:], h.ClockSinceACP)
+	le.PutUint32(hdr[40:], uint32(len(d)))
+	b = append(b, hdr[:]...)
+	for _, s := range d {
+		b = append(b, byte(s), byte(s>>8))
+	}
+	return b
+}
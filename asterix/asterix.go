@@ -0,0 +1,290 @@
+/*
+Package asterix sends scanlines as EUROCONTROL ASTERIX Category 240
+(radar video) messages over UDP, to a unicast or multicast address.
+
+Each scanline becomes one data block, in its own datagram, holding a
+single video message record with these items (all big-endian, as
+ASTERIX requires):
+
+	I240/010  data source identifier: SAC, SIC
+	I240/000  message type: 002 (video message)
+	I240/020  video record header: message index, counting up from 1
+	I240/040  video header nano: start and end azimuth, start range
+	          in cells, and cell duration in ns; or, if the cell
+	I240/041  duration is not a whole number of ns, video header femto
+	I240/048  video cell resolution: 8 or 16 bits, uncompressed
+	I240/049  video octets and cells counters
+	I240/05x  video block: low (050), medium (051) or high (052) data
+	          volume, whichever is the smallest that holds the cells
+	I240/140  time of day, in 1/128 s since midnight UTC
+
+Azimuths are in units of 360/65536 degrees.  The start azimuth is
+that of the scanline; the end azimuth is the start plus the change
+since the previous scanline, which is the width of the sector the
+scanline stands for.  Samples from before the pulse left the antenna
+are left out, so that the start range is never negative.  Samples are
+scaled to the cell resolution by dropping their low-order bits: 14-bit
+samples (or wider, when the FPGA sums them) lose 6 or more bits at
+8-bit resolution, and none at 16 bits.
+*/
+package asterix
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jbrzusto/ogdar/buffer"
+	"math"
+	"time"
+)
+
+const (
+	CATEGORY            = 240 // ASTERIX category of radar video
+	MSG_VIDEO           = 2   // I240/000 message type of a video message
+	RES_8_BITS          = 4   // I240/048 resolution code for 8-bit cells ("high")
+	RES_16_BITS         = 5   // I240/048 resolution code for 16-bit cells ("very high")
+	MAX_BLOCKS          = 255 // most video blocks in a message
+	AZIMUTHS_PER_CIRCLE = 1 << 16
+)
+
+// video block item numbers (I240/050, 051 and 052) and their sizes, in
+// increasing order of size
+var blockSizes = []struct {
+	item  int
+	bytes int
+	fspec byte // bit in the second FSPEC octet
+}{{50, 4, 0x40}, {51, 64, 0x20}, {52, 256, 0x10}}
+
+// Config holds parameters for a Sender.  It is read from the
+// [asterix] section of ogdar.toml.
+type Config struct {
+	Addr      string // UDP destination host:port, unicast or multicast; "" means don't send
+	Interface string // network interface for multicast; "" means the system's choice
+	TTL       int    // time-to-live of multicast datagrams, in hops
+	SAC       int    // system area code, for the data source identifier
+	SIC       int    // system identification code, for the data source identifier
+	Bits      int    // bits per video cell: 8 or 16
+}
+
+// DefaultConfig is used for any values not given in ogdar.toml.
+var DefaultConfig = Config{
+	Addr:      "",
+	Interface: "",
+	TTL:       1,
+	SAC:       0,
+	SIC:       1,
+	Bits:      8,
+}
+
+// Video is a decoded video message.
+type Video struct {
+	SAC, SIC   uint8
+	Index      uint32        // message index
+	StartAz    uint16        // start azimuth, in units of 360/65536 degrees
+	EndAz      uint16        // end azimuth
+	StartRange uint32        // range of the first cell, in cells
+	CellDur    float64       // duration of each cell, in seconds
+	Bits       int           // bits per cell
+	Cells      []uint16      // video cells
+	TimeOfDay  time.Duration // since midnight UTC
+}
+
+// message holds the values for encoding a video message.
+type message struct {
+	sac, sic       uint8
+	index          uint32
+	startAz, endAz uint16
+	startRange     uint32
+	cellDur        float64 // seconds
+	bits           int
+	cells          []buffer.Sample
+	shift          uint // right shift applied to samples
+	tod            time.Duration
+}
+
+// encode appends m, as an ASTERIX data block, to b.
+func (m *message) encode(b []byte) ([]byte, error) {
+	cellBytes := m.bits / 8
+	n := len(m.cells) * cellBytes
+	blk := blockSizes[len(blockSizes)-1]
+	for _, bs := range blockSizes {
+		if (n+bs.bytes-1)/bs.bytes <= MAX_BLOCKS {
+			blk = bs
+			break
+		}
+	}
+	reps := (n + blk.bytes - 1) / blk.bytes
+	if reps > MAX_BLOCKS {
+		return b, fmt.Errorf("%d cells of %d bits are too many for one message", len(m.cells), m.bits)
+	}
+	nano := m.cellDur*1e9 == math.Trunc(m.cellDur*1e9)
+	start := len(b)
+	b = append(b, CATEGORY, 0, 0)
+	// FSPEC: I240/010, 000, 020, 040 or 041, 048, FX; then 049, the video block, 140
+	f1 := byte(0x80 | 0x40 | 0x20 | 0x02 | 0x01)
+	if nano {
+		f1 |= 0x08
+	} else {
+		f1 |= 0x04
+	}
+	b = append(b, f1, 0x80|blk.fspec|0x08)
+	b = append(b, m.sac, m.sic, MSG_VIDEO)
+	b = appendUint(b, uint64(m.index), 4)
+	b = appendUint(b, uint64(m.startAz), 2)
+	b = appendUint(b, uint64(m.endAz), 2)
+	b = appendUint(b, uint64(m.startRange), 4)
+	if nano {
+		b = appendUint(b, uint64(m.cellDur*1e9), 4)
+	} else {
+		b = appendUint(b, uint64(math.Round(m.cellDur*1e15)), 4)
+	}
+	res := RES_8_BITS
+	if m.bits == 16 {
+		res = RES_16_BITS
+	}
+	b = append(b, 0, byte(res))
+	b = appendUint(b, uint64(n), 2)
+	b = appendUint(b, uint64(len(m.cells)), 3)
+	b = append(b, byte(reps))
+	for _, s := range m.cells {
+		v := uint16(s) >> m.shift
+		if m.bits == 8 {
+			if v > 0xff {
+				v = 0xff
+			}
+			b = append(b, byte(v))
+		} else {
+			b = append(b, byte(v>>8), byte(v))
+		}
+	}
+	// pad the last block with zero cells
+	for i := n; i < reps*blk.bytes; i++ {
+		b = append(b, 0)
+	}
+	b = appendUint(b, uint64(m.tod*128/time.Second)&0xffffff, 3)
+	binary.BigEndian.PutUint16(b[start+1:], uint16(len(b)-start))
+	return b, nil
+}
+
+// appendUint appends the low n bytes of v to b, big-endian.
+func appendUint(b []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+// timeOfDay returns the time since midnight UTC of t.
+func timeOfDay(t time.Time) time.Duration {
+	t = t.UTC()
+	return t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+}
+
+// Decode decodes the first record of the ASTERIX data block in b,
+// which must be a category 240 video message as sent by this package.
+func Decode(b []byte) (v *Video, err error) {
+	if len(b) < 3 || b[0] != CATEGORY {
+		return nil, errors.New("not an ASTERIX category 240 data block")
+	}
+	n := int(binary.BigEndian.Uint16(b[1:]))
+	if n > len(b) || n < 3 {
+		return nil, fmt.Errorf("data block length %d is wrong for %d bytes", n, len(b))
+	}
+	b = b[3:n]
+	var fspec []byte
+	for {
+		if len(b) == 0 {
+			return nil, errors.New("truncated FSPEC")
+		}
+		fspec, b = append(fspec, b[0]), b[1:]
+		if fspec[len(fspec)-1]&1 == 0 {
+			break
+		}
+	}
+	has := func(frn int) bool {
+		i := (frn - 1) / 7
+		return i < len(fspec) && fspec[i]&(0x80>>uint((frn-1)%7)) != 0
+	}
+	take := func(n int) []byte {
+		if err != nil || len(b) < n {
+			if err == nil {
+				err = errors.New("truncated record")
+			}
+			return make([]byte, n)
+		}
+		p := b[:n]
+		b = b[n:]
+		return p
+	}
+	num := func(p []byte) (v uint64) {
+		for _, c := range p {
+			v = v<<8 | uint64(c)
+		}
+		return
+	}
+	v = &Video{}
+	if has(1) {
+		p := take(2)
+		v.SAC, v.SIC = p[0], p[1]
+	}
+	if has(2) {
+		if t := take(1)[0]; t != MSG_VIDEO && err == nil {
+			return nil, fmt.Errorf("message type %d is not a video message", t)
+		}
+	}
+	if has(3) {
+		v.Index = uint32(num(take(4)))
+	}
+	if has(4) {
+		// video summary: a repetition count of characters
+		take(int(take(1)[0]))
+	}
+	if has(5) || has(6) {
+		v.StartAz = uint16(num(take(2)))
+		v.EndAz = uint16(num(take(2)))
+		v.StartRange = uint32(num(take(4)))
+		d := float64(num(take(4)))
+		if has(5) {
+			v.CellDur = d * 1e-9
+		} else {
+			v.CellDur = d * 1e-15
+		}
+	}
+	if has(7) {
+		switch res := take(2)[1]; res {
+		case RES_8_BITS:
+			v.Bits = 8
+		case RES_16_BITS:
+			v.Bits = 16
+		default:
+			return nil, fmt.Errorf("unsupported video resolution code %d", res)
+		}
+	}
+	var nCells int
+	if has(8) {
+		take(2)
+		nCells = int(num(take(3)))
+	}
+	for i, bs := range blockSizes {
+		if !has(9 + i) {
+			continue
+		}
+		data := take(int(take(1)[0]) * bs.bytes)
+		cellBytes := v.Bits / 8
+		if cellBytes == 0 || nCells*cellBytes > len(data) {
+			return nil, errors.New("video block is too short for its cells")
+		}
+		v.Cells = make([]uint16, nCells)
+		for j := range v.Cells {
+			if cellBytes == 1 {
+				v.Cells[j] = uint16(data[j])
+			} else {
+				v.Cells[j] = binary.BigEndian.Uint16(data[2*j:])
+			}
+		}
+	}
+	if has(12) {
+		v.TimeOfDay = time.Duration(num(take(3))) * time.Second / 128
+	}
+	return v, err
+}
@@ -0,0 +1,164 @@
+package asterix
+
+// Sending video messages over UDP.
+
+import (
+	"github.com/jbrzusto/ogdar/azimuth"
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/multicast"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QUEUE_LEN is the number of encoded messages which can wait to be
+// sent; further messages are dropped until there is room.
+const QUEUE_LEN = 1024
+
+// MAX_SECTOR is the widest sector, in units of 360/65536 degrees, that
+// a scanline is taken to stand for.  A larger change in azimuth since
+// the previous scanline means some were not sent, so the end azimuth
+// is set equal to the start.
+const MAX_SECTOR = AZIMUTHS_PER_CIRCLE / 64
+
+// Sender sends scanlines as CAT240 video messages.  It is safe for
+// concurrent use.
+type Sender struct {
+	sent      uint64 // messages sent; first for 64-bit alignment of atomic access on ARM
+	dropped   uint64 // messages not sent because the queue was full, or because of an error
+	mu        sync.Mutex
+	cfg       Config
+	clockRate uint32
+	ranging   buffer.RangeParams
+	azi       *azimuth.Model
+	timeOf    func(*buffer.Scanline) time.Time
+	index     uint32 // message index of the previous message
+	prevAz    uint16 // start azimuth of the previous message
+	queue     chan []byte
+}
+
+// NewSender returns a Sender which takes the azimuth of each scanline
+// from azi, and its time from timeOf.  Call Run to start it.
+func NewSender(cfg Config, azi *azimuth.Model, timeOf func(*buffer.Scanline) time.Time) *Sender {
+	return &Sender{cfg: cfg, azi: azi, timeOf: timeOf, queue: make(chan []byte, QUEUE_LEN)}
+}
+
+// SetConfig changes the sender's configuration.  Changes to Addr,
+// Interface and TTL take effect when Run is next called.
+func (s *Sender) SetConfig(cfg Config) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+}
+
+// SetRanging sets the ADC clock rate, in Hz, and the digitizer
+// settings used to compute cell durations and start ranges.
+func (s *Sender) SetRanging(clockRate uint32, r buffer.RangeParams) {
+	s.mu.Lock()
+	s.clockRate, s.ranging = clockRate, r
+	s.mu.Unlock()
+}
+
+// Stats returns the number of messages sent and dropped.
+func (s *Sender) Stats() (sent, dropped uint64) {
+	return atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.dropped)
+}
+
+// AddScanline queues l to be sent, if its azimuth is known.  It does
+// not block, so it can be an Acquirer hook.
+func (s *Sender) AddScanline(l *buffer.Scanline) {
+	if !s.azi.Valid() {
+		return
+	}
+	az := uint16(math.Round(s.azi.Azimuth(&l.ScanlineHdr) * AZIMUTHS_PER_CIRCLE / 360))
+	s.mu.Lock()
+	cfg, r, rate := s.cfg, s.ranging, s.clockRate
+	if rate == 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.index++
+	m := message{sac: uint8(cfg.SAC), sic: uint8(cfg.SIC), index: s.index, startAz: az, endAz: az, bits: cfg.Bits}
+	if d := az - s.prevAz; d > 0 && d <= MAX_SECTOR {
+		m.endAz = az + d
+	}
+	s.prevAz = az
+	s.mu.Unlock()
+	m.cellDur = float64(l.DecimRate()) / float64(rate)
+	m.tod = timeOfDay(s.timeOf(l))
+	d := l.Data()
+	first, res := l.FirstRange(r), l.RangeResolution()
+	if first < 0 {
+		skip := int(math.Ceil(-first / res))
+		if skip > len(d) {
+			skip = len(d)
+		}
+		d = d[skip:]
+		first += float64(skip) * res
+	}
+	m.startRange = uint32(math.Round(first / res))
+	m.cells = d
+	if shift := l.SampleBits() - m.bits; shift > 0 {
+		m.shift = uint(shift)
+	}
+	// encoding copies the samples; check that they weren't overwritten
+	// while it did
+	b, err := m.encode(nil)
+	if err != nil || !l.Valid() {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	select {
+	case s.queue <- b:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Run sends queued messages to the configured address until stop is
+// closed.  It returns an error if it can't set up the socket.
+func (s *Sender) Run(stop <-chan struct{}) error {
+	s.mu.Lock()
+	cfg := s.cfg
+	s.mu.Unlock()
+	conn, err := dial(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case b := <-s.queue:
+			if _, err := conn.Write(b); err != nil {
+				atomic.AddUint64(&s.dropped, 1)
+				continue
+			}
+			atomic.AddUint64(&s.sent, 1)
+		}
+	}
+}
+
+// dial returns a UDP socket sending to cfg.Addr, with the multicast
+// interface and TTL set if that is a multicast address.
+func dial(cfg Config) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return conn, nil
+	}
+	if err := multicast.SetOptions(conn, cfg.Interface, cfg.TTL); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,298 @@
+package azimuth
+
+// Statistical estimation of the ARP's position in the ACP sequence.
+//
+// The antenna passes true north (or the bow) at the same point in
+// the ACP sequence on every rotation, but the ARP detector fires a
+// little early or late depending on the antenna's rotation rate,
+// which varies with wind load.  Occasionally an ARP is missed
+// altogether, or noise is detected as an extra ARP.
+//
+// The ACP count at each ARP, plus the fraction of an ACP interval
+// since the preceding ACP, gives the ARP's position in the ACP
+// sequence; modulo the number of ACPs per rotation, this is the ARP's
+// phase.  The 32-bit ACP count wraps, and the number of ACPs per
+// rotation needn't divide 2^32, so phases are reckoned from the
+// previous ARP's, by the 32-bit difference of ACP counts, rather than
+// from the count itself.  We keep the phases of recent ARPs, and
+// estimate the true phase as their circular median.  ARPs too soon
+// after the previous one are spurious and ignored.  ARPs whose phase
+// is too far from the estimate are outliers and ignored, unless there
+// are so many in a row that the estimate must be wrong (e.g. because
+// the FPGA has been reset, restarting its ACP count), in which case
+// estimation starts over.
+//
+// The estimator's state can be saved to a file and reloaded, so that
+// the estimate survives restarts of ogdar.  It is only reloaded if the
+// FPGA's counters show it has not been reset since the save.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// EstimatorConfig holds parameters for an ARPEstimator.  It is read from
+// the [arp] section of ogdar.toml.
+type EstimatorConfig struct {
+	Window    int     // number of recent ARPs used in the estimate
+	MinARPs   int     // minimum number of ARPs before the estimate is used
+	Tolerance float64 // ARPs whose phase differs from the estimate by more than this many ACPs are outliers
+	StateFile string  // file in which to save estimator state; "" means don't save
+	SaveEvery int     // save state after this many accepted ARPs
+}
+
+// DefaultEstimatorConfig is used for any values not given in ogdar.toml.
+var DefaultEstimatorConfig = EstimatorConfig{
+	Window:    60,
+	MinARPs:   5,
+	Tolerance: 3,
+	StateFile: "/opt/ogdar_arp.json",
+	SaveEvery: 20,
+}
+
+// ARPEstimator estimates the ARP's phase in the ACP sequence.  It is
+// safe for concurrent use.
+type ARPEstimator struct {
+	mu  sync.Mutex
+	cfg EstimatorConfig
+	estimatorState
+	unsaved int // accepted ARPs since last save
+}
+
+// estimatorState is the part of an ARPEstimator saved to disk.
+type estimatorState struct {
+	ACPsPerRotation uint32    // nominal ACPs per rotation
+	Phases          []float64 // phases of recently accepted ARPs, oldest first
+	Phase           float64   // current estimate of ARP phase, in ACPs, in [0, ACPsPerRotation)
+	Valid           bool      // true if Phase is a usable estimate
+	Outliers        int       // consecutive ARPs rejected as outliers
+	Spurious        int       // total ARPs rejected as spurious
+	Rejected        int       // total ARPs rejected as outliers
+	LastARP         uint32    // ARP count at most recent observation
+	HasLast         bool      // true if LastACP, LastFrac and LastPhase are set
+	LastACP         uint32    // ACP count at most recent observation
+	LastFrac        float64   // fraction of an ACP interval after LastACP at most recent observation
+	LastPhase       float64   // phase of most recent observation, in ACPs, in [0, ACPsPerRotation)
+}
+
+// NewARPEstimator returns an estimator for a radar with
+// acpsPerRotation ACPs per rotation.
+func NewARPEstimator(acpsPerRotation uint32, cfg EstimatorConfig) *ARPEstimator {
+	return &ARPEstimator{cfg: cfg, estimatorState: estimatorState{ACPsPerRotation: acpsPerRotation}}
+}
+
+// SetACPsPerRotation changes the nominal number of ACPs per rotation.
+// Phases measured with a different number are meaningless, so if it
+// changes, estimation starts over.
+func (e *ARPEstimator) SetACPsPerRotation(acpsPerRotation uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if acpsPerRotation == e.ACPsPerRotation {
+		return
+	}
+	e.estimatorState = estimatorState{ACPsPerRotation: acpsPerRotation, LastARP: e.LastARP}
+}
+
+// circDiff returns a - b, reduced to the range [-n/2, n/2).
+func circDiff(a, b, n float64) float64 {
+	d := math.Mod(a-b+n/2, n)
+	if d < 0 {
+		d += n
+	}
+	return d - n/2
+}
+
+// sinceLast returns the number of ACPs between the most recent
+// observation and the ACP position of a.  It is negative if a precedes
+// it.  e.mu must be held.
+func (e *ARPEstimator) sinceLast(a Anchor) float64 {
+	return float64(int32(a.ACP-e.LastACP)) + a.Frac - e.LastFrac
+}
+
+// phaseOf returns the phase of the ACP position of a, in ACPs, in
+// [0, ACPsPerRotation).  e.mu must be held.
+func (e *ARPEstimator) phaseOf(a Anchor) float64 {
+	n := float64(e.ACPsPerRotation)
+	p := float64(a.ACP) + a.Frac
+	if e.HasLast {
+		p = e.LastPhase + e.sinceLast(a)
+	}
+	p = math.Mod(p, n)
+	if p < 0 {
+		p += n
+	}
+	return p
+}
+
+// Observe records an ARP, as an Anchor holding the ARP count and the
+// ACP position at the ARP.  It returns true if the ARP was accepted
+// into the estimate.  Repeated observations of the same ARP are
+// ignored.  An ARP rejected as spurious still becomes the previous
+// ARP for the next one, so a genuine ARP following a spurious one
+// by less than half a rotation is also rejected.
+func (e *ARPEstimator) Observe(a Anchor) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if a.ARPCount == e.LastARP || e.ACPsPerRotation == 0 {
+		return false
+	}
+	n := float64(e.ACPsPerRotation)
+	phase := e.phaseOf(a)
+	d := e.sinceLast(a)
+	spurious := e.HasLast && a.ARPCount == e.LastARP+1 && d >= 0 && d < n/2
+	e.LastARP, e.HasLast, e.LastACP, e.LastFrac, e.LastPhase = a.ARPCount, true, a.ACP, a.Frac, phase
+	if spurious {
+		// too soon after the previous ARP to be real
+		e.Spurious++
+		return false
+	}
+	if e.Valid && math.Abs(circDiff(phase, e.Phase, n)) > e.cfg.Tolerance {
+		e.Rejected++
+		e.Outliers++
+		if e.Outliers <= e.cfg.Window/2 {
+			return false
+		}
+		// the estimate no longer describes the radar; start over
+		e.Phases = e.Phases[:0]
+		e.Valid = false
+	}
+	e.Outliers = 0
+	e.Phases = append(e.Phases, phase)
+	if len(e.Phases) > e.cfg.Window {
+		e.Phases = e.Phases[len(e.Phases)-e.cfg.Window:]
+	}
+	e.estimate()
+	if e.unsaved++; e.cfg.StateFile != "" && e.unsaved >= e.cfg.SaveEvery {
+		if err := e.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to save ARP estimator state: %v\n", err)
+		}
+	}
+	return true
+}
+
+// estimate sets Phase to the circular median of Phases.
+func (e *ARPEstimator) estimate() {
+	n := float64(e.ACPsPerRotation)
+	ref := e.Phases[len(e.Phases)-1]
+	u := make([]float64, len(e.Phases))
+	for i, p := range e.Phases {
+		u[i] = circDiff(p, ref, n)
+	}
+	sort.Float64s(u)
+	m := u[len(u)/2]
+	if len(u)%2 == 0 {
+		m = (u[len(u)/2-1] + m) / 2
+	}
+	e.Phase = math.Mod(ref+m+n, n)
+	e.Valid = len(e.Phases) >= e.cfg.MinARPs
+}
+
+// Estimate returns the estimated ARP phase, in ACPs, and whether it is valid.
+func (e *ARPEstimator) Estimate() (phase float64, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.Phase, e.Valid
+}
+
+// Spread returns the median absolute deviation of recent ARP phases
+// from the estimate, in ACPs; this shows how much ARP detection
+// jitters.
+func (e *ARPEstimator) Spread() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.Phases) == 0 {
+		return 0
+	}
+	d := make([]float64, len(e.Phases))
+	for i, p := range e.Phases {
+		d[i] = math.Abs(circDiff(p, e.Phase, float64(e.ACPsPerRotation)))
+	}
+	sort.Float64s(d)
+	return d[len(d)/2]
+}
+
+// Anchor returns an anchor at the estimated ARP phase, at the most
+// recent such point in the ACP sequence at or before the ARP a.  The
+// second return value is false if there is no valid estimate yet.
+func (e *ARPEstimator) Anchor(a Anchor) (Anchor, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.Valid {
+		return a, false
+	}
+	n := float64(e.ACPsPerRotation)
+	back := math.Mod(e.phaseOf(a)-e.Phase, n)
+	if back < 0 {
+		back += n
+	}
+	// the anchor is p ACPs after a.ACP; p <= a.Frac
+	p := a.Frac - back
+	k := math.Floor(p)
+	return Anchor{ARPCount: a.ARPCount, ACP: a.ACP + uint32(int32(k)), Frac: p - k}, true
+}
+
+// save writes the estimator state to the configured file.  e.mu must be held.
+func (e *ARPEstimator) save() error {
+	e.unsaved = 0
+	buf, err := json.MarshalIndent(&e.estimatorState, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp := e.cfg.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.cfg.StateFile)
+}
+
+// Save writes the estimator state to the configured file, if any.
+func (e *ARPEstimator) Save() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cfg.StateFile == "" {
+		return nil
+	}
+	return e.save()
+}
+
+// Load reads estimator state from the configured file.  arpCount and
+// acpCount are the FPGA's current ARP and ACP counts; if either is
+// smaller than when the state was saved (for the ACP count, which
+// wraps, by 32-bit difference), the FPGA has been reset since then, so
+// the saved phase no longer applies and is not loaded.
+// Neither is it loaded if it was for a different number of ACPs per
+// rotation.  A missing file is not an error.
+func (e *ARPEstimator) Load(arpCount, acpCount uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cfg.StateFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(e.cfg.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s estimatorState
+	if err = json.Unmarshal(buf, &s); err != nil {
+		return fmt.Errorf("%s: %v", e.cfg.StateFile, err)
+	}
+	switch {
+	case s.ACPsPerRotation != e.ACPsPerRotation:
+		return fmt.Errorf("%s: saved state is for %d ACPs per rotation, not %d; ignoring it", e.cfg.StateFile, s.ACPsPerRotation, e.ACPsPerRotation)
+	case arpCount < s.LastARP || s.HasLast && int32(acpCount-s.LastACP) < 0:
+		return fmt.Errorf("%s: FPGA has been reset since state was saved; ignoring it", e.cfg.StateFile)
+	}
+	e.estimatorState = s
+	if len(e.Phases) > 0 {
+		e.estimate()
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+Package azimuth converts the ACP and ARP counts recorded with each
+scanline into an antenna azimuth.
+
+Each scanline header records the number of ACPs seen before its
+trigger, and the number of ADC clocks since the most recent of those
+ACPs.  The FPGA also records,
+at each ARP, the ACP count and the number of ADC clocks since the
+preceding ACP.  So for a scanline, the number of ACPs since the ARP
+is
+
+	(ACPCount - ACPAtARP) + ClockSinceACP / ACPPeriod - ClockSinceACPAtARP / ACPPeriod
+
+where ACPPeriod is the current interval between ACPs, in ADC clocks.
+Dividing by ACPsPerRotation gives the fraction of a rotation since
+the ARP, and adding the heading offset (the azimuth of the antenna
+when the ARP is detected) gives the azimuth.
+
+ACP counts are 32 bits and wrap around, so they are compared by
+32-bit subtraction.
+*/
+package azimuth
+
+import (
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/fpga"
+	"math"
+	"sync"
+)
+
+// Fixed is an azimuth in fixed-point form: units of 1/65536 of a
+// full circle, clockwise from the heading reference.
+type Fixed uint16
+
+// FIXED_PER_CIRCLE is the number of Fixed units in a full circle.
+const FIXED_PER_CIRCLE = 1 << 16
+
+// Degrees converts a Fixed azimuth to degrees.
+func (a Fixed) Degrees() float64 {
+	return float64(a) * 360 / FIXED_PER_CIRCLE
+}
+
+// ToFixed converts an azimuth in degrees to Fixed form; the azimuth
+// is first reduced to the range [0, 360).
+func ToFixed(deg float64) Fixed {
+	return Fixed(uint32(math.Round(normalize(deg)*FIXED_PER_CIRCLE/360)) % FIXED_PER_CIRCLE)
+}
+
+// normalize reduces an azimuth in degrees to the range [0, 360).
+func normalize(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg
+}
+
+// Anchor ties ACP counts to the ARP.
+type Anchor struct {
+	ARPCount uint32  // ARP count at the anchoring ARP
+	ACP      uint32  // ACP count at the anchoring ARP
+	Frac     float64 // time between that ACP and the anchoring ARP, as a fraction of the interval between ACPs
+}
+
+// Model converts scanline headers to azimuths.  It is safe for
+// concurrent use.
+type Model struct {
+	mu              sync.RWMutex
+	acpsPerRotation float64       // nominal ACPs per rotation
+	headingOffset   float64       // azimuth of antenna at ARP, degrees
+	anchor          Anchor        // most recent ARP
+	acpPeriod       float64       // ADC clocks between ACPs; 0 if unknown
+	anchored        bool          // true once anchor has been set
+	est             *ARPEstimator // if not nil, used by Update to set the anchor
+}
+
+// New returns a Model for a radar with acpsPerRotation ACPs per
+// rotation, whose antenna points at headingOffset degrees when the
+// ARP is detected.
+func New(acpsPerRotation uint32, headingOffset float64) *Model {
+	return &Model{acpsPerRotation: float64(acpsPerRotation), headingOffset: headingOffset}
+}
+
+// SetRadar changes the number of ACPs per rotation and the heading offset.
+func (m *Model) SetRadar(acpsPerRotation uint32, headingOffset float64) {
+	m.mu.Lock()
+	m.acpsPerRotation = float64(acpsPerRotation)
+	m.headingOffset = headingOffset
+	m.mu.Unlock()
+}
+
+// SetAnchor records the ACP count and offset at an ARP.
+func (m *Model) SetAnchor(a Anchor) {
+	m.mu.Lock()
+	m.anchor = a
+	m.anchored = true
+	m.mu.Unlock()
+}
+
+// SetACPPeriod records the current interval between ACPs, in ADC clocks.
+func (m *Model) SetACPPeriod(clocks float64) {
+	if clocks <= 0 {
+		return
+	}
+	m.mu.Lock()
+	m.acpPeriod = clocks
+	m.mu.Unlock()
+}
+
+// UseEstimator makes Update take the anchor from e, once e has a
+// valid estimate, rather than from the most recent ARP.
+func (m *Model) UseEstimator(e *ARPEstimator) {
+	m.mu.Lock()
+	m.est = e
+	m.mu.Unlock()
+}
+
+// Update sets the anchor and ACP period from the FPGA's saved
+// registers, which are a consistent snapshot taken at the most recent
+// captured trigger.  If an ARPEstimator is in use, the most recent ARP
+// is passed to it, and its estimate is used as the anchor.
+// fpga.Init() must have been called.
+func (m *Model) Update() {
+	r := fpga.Regs
+	acpClock, acpPrevClock := r.SavedACPClock, r.SavedACPPrevClock
+	arpCount, acpAtARP, clockSinceACP := r.SavedARPCount, r.SavedACPAtARP, r.SavedClockSinceACPAtARP
+	if acpClock > acpPrevClock {
+		m.SetACPPeriod(float64(acpClock - acpPrevClock))
+	}
+	if arpCount == 0 {
+		return
+	}
+	m.mu.RLock()
+	period, est := m.acpPeriod, m.est
+	m.mu.RUnlock()
+	if period <= 0 {
+		return
+	}
+	a := Anchor{ARPCount: arpCount, ACP: acpAtARP, Frac: math.Min(float64(clockSinceACP)/period, 1)}
+	if est != nil {
+		est.Observe(a)
+		if ea, ok := est.Anchor(a); ok {
+			a = ea
+		}
+	}
+	m.SetAnchor(a)
+}
+
+// Valid returns true if the model has enough information to compute azimuths.
+func (m *Model) Valid() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.anchored && m.acpPeriod > 0
+}
+
+// ACPsSinceARP returns the (fractional) number of ACPs between the
+// anchoring ARP and the scanline with header h.  This is negative for
+// scanlines captured before the anchoring ARP.
+func (m *Model) ACPsSinceARP(h *buffer.ScanlineHdr) float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.acpsSinceARP(h)
+}
+
+func (m *Model) acpsSinceARP(h *buffer.ScanlineHdr) float64 {
+	d := int32(h.ACPCount - m.anchor.ACP) // negative if scanline precedes anchoring ARP
+	frac := 0.0
+	if m.acpPeriod > 0 {
+		// an offset longer than the ACP period means the antenna
+		// slowed, or an ACP was missed; don't extrapolate past the
+		// next ACP
+		frac = math.Min(float64(h.ClockSinceACP)/m.acpPeriod, 1)
+	}
+	return float64(d) + frac - m.anchor.Frac
+}
+
+// Azimuth returns the azimuth of the scanline with header h, in
+// degrees clockwise from the heading reference, in the range [0, 360).
+// The result is meaningless unless Valid() is true.
+func (m *Model) Azimuth(h *buffer.ScanlineHdr) float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.acpsPerRotation <= 0 {
+		return 0
+	}
+	return normalize(360*m.acpsSinceARP(h)/m.acpsPerRotation + m.headingOffset)
+}
+
+// AzimuthFixed returns the azimuth of the scanline with header h in fixed-point form.
+func (m *Model) AzimuthFixed(h *buffer.ScanlineHdr) Fixed {
+	return ToFixed(m.Azimuth(h))
+}
@@ -0,0 +1,188 @@
+package buffer
+
+// Acquisition of scanlines from the FPGA.
+//
+// The FPGA digitizes one scanline each time it is armed and a trigger
+// arrives, and takes a snapshot of its counters (the Saved* registers)
+// at that trigger.  The acquisition loop waits for the FPGA to fire,
+// copies the samples and counters into the scanline buffer, then
+// re-arms it.  Digitizer parameters are only changed between these
+// steps, so that every scanline is digitized with the settings
+// recorded in its header.
+
+import (
+	"github.com/jbrzusto/ogdar/fpga"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ACQ_POLL_INTERVAL is how long the acquisition loop sleeps between
+// checks of whether the FPGA has fired.
+const ACQ_POLL_INTERVAL = 50 * time.Microsecond
+
+// Acquirer reads scanlines from the FPGA into a ScanlineBuff.
+type Acquirer struct {
+	captured  uint64 // scanlines captured; first for 64-bit alignment of atomic access on ARM
+	dropped   uint64 // scanlines not captured for lack of buffer space
+	slb       *ScanlineBuff
+	trigCount Counter64   // unwraps the FPGA's 32-bit trigger count
+	lastClock uint64      // TrigClock of previous scanline; lets us detect FPGA resets
+	params    chan params // parameter changes waiting to be applied
+	mu        sync.Mutex
+	hooks     []func(*Scanline)
+}
+
+// params is a pending parameter change.
+type params struct {
+	set  func()
+	done chan struct{}
+}
+
+// NewAcquirer returns an Acquirer which stores scanlines in slb.  Call
+// Run to start it.
+func NewAcquirer(slb *ScanlineBuff) *Acquirer {
+	return &Acquirer{slb: slb, params: make(chan params, 16)}
+}
+
+// AddHook arranges for f to be called with each new scanline.  f is
+// called from the acquisition goroutine, so it must be quick, and the
+// scanline is only valid until overwritten in the ring buffer.
+func (a *Acquirer) AddHook(f func(s *Scanline)) {
+	a.mu.Lock()
+	a.hooks = append(a.hooks, f)
+	a.mu.Unlock()
+}
+
+// SetParams arranges for set to be called between acquisitions, when
+// it can safely change the FPGA's digitizing registers or use the
+// FPGA for something else, such as fpga.Scope.  This happens after the
+// next scanline is read or, if there is none, while waiting for it.
+// The returned channel is closed once set has been called.
+func (a *Acquirer) SetParams(set func()) <-chan struct{} {
+	done := make(chan struct{})
+	a.params <- params{set, done}
+	return done
+}
+
+// Stats returns the number of scanlines captured, and the number
+// dropped for lack of buffer space.
+func (a *Acquirer) Stats() (captured, dropped uint64) {
+	return atomic.LoadUint64(&a.captured), atomic.LoadUint64(&a.dropped)
+}
+
+// Run acquires scanlines until stop is closed.  fpga.Init() must have
+// been called.
+func (a *Acquirer) Run(stop <-chan struct{}) {
+	fpga.Arm()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !fpga.HasFired() {
+			// changes can't wait for a trigger which may never come
+			// (e.g. because the thresholds being changed are wrong);
+			// make them now, and re-arm so that nothing captured
+			// while they were being made is kept
+			if a.applyParams() {
+				fpga.Arm()
+			}
+			time.Sleep(ACQ_POLL_INTERVAL)
+			continue
+		}
+		s := a.read()
+		a.applyParams()
+		fpga.Arm()
+		if s == nil {
+			continue
+		}
+		a.mu.Lock()
+		hooks := a.hooks
+		a.mu.Unlock()
+		for _, f := range hooks {
+			f(s)
+		}
+	}
+}
+
+// applyParams makes any pending parameter changes, returning true if
+// there were any.
+func (a *Acquirer) applyParams() (applied bool) {
+	for {
+		select {
+		case p := <-a.params:
+			p.set()
+			close(p.done)
+			applied = true
+		default:
+			return
+		}
+	}
+}
+
+// read copies the most recently digitized scanline and its metadata
+// from the FPGA into the scanline buffer, returning nil if there is no
+// room.
+func (a *Acquirer) read() *Scanline {
+	r := fpga.Regs
+	clock := r.SavedTrigClock
+	if clock < a.lastClock {
+		// the FPGA has been reset, restarting its counters
+		a.trigCount.Reset()
+	}
+	a.lastClock = clock
+	h := ScanlineHdr{
+		Version:       SCANLINE_HDR_VERSION,
+		DecimRateM1:   DecimRateM1(r.DecRate - 1),
+		Extra:         uint16(decimModeFor(r.DecRate, r.Options)) << 14,
+		TrigCount:     a.trigCount.Unwrap(r.SavedTrigCount),
+		TrigClock:     clock,
+		ARPCount:      r.SavedARPCount,
+		ACPCount:      r.SavedACPCount,
+		ClockSinceACP: clockSince(clock, r.SavedACPClock),
+	}
+	n := int(r.NumSamp)
+	i, err := a.slb.Next(n, h.TrigCount)
+	if err != nil {
+		atomic.AddUint64(&a.dropped, 1)
+		return nil
+	}
+	s := &a.slb.ScanBuff[i]
+	s.ScanlineHdr = h
+	d := s.Data()
+	for j := range d {
+		d[j] = Sample(fpga.VidBuf[j])
+	}
+	a.slb.nScanlines++
+	atomic.AddUint64(&a.captured, 1)
+	return s
+}
+
+// decimModeFor returns how the FPGA combines samples at decimation
+// rate decRate with the given Options register.
+func decimModeFor(decRate, options uint32) DecimMode {
+	if options&uint32(fpga.DDOPT_AVERAGING) == 0 {
+		return DECIM_DECIM
+	}
+	switch {
+	case options&uint32(fpga.DDOPT_USE_SUM) != 0 && fpga.CanSum(decRate):
+		return DECIM_SUM
+	case fpga.CanAverage(decRate):
+		return DECIM_AVG
+	}
+	return DECIM_DECIM
+}
+
+// clockSince returns the number of clocks from then to now, saturating
+// at the largest uint32.
+func clockSince(now, then uint64) uint32 {
+	if then > now {
+		return 0
+	}
+	if d := now - then; d < 1<<32 {
+		return uint32(d)
+	}
+	return 1<<32 - 1
+}
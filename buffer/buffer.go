@@ -40,6 +40,12 @@ const (
 	DECIM_AVG                    // the average of every n consecutive samples is used; n = 2^m for m = 1, 2, 3, 6, 10, 13, 15
 )
 
+// SCANLINE_HDR_VERSION identifies the layout of ScanlineHdr, so that
+// stored or transmitted headers can be decoded correctly.  Version 1
+// was the original layout with 32-bit trigger count and clock and a
+// packed ACP count and offset.
+const SCANLINE_HDR_VERSION = 2
+
 // ScanlineHdr provides metadata for a Scanline
 // These allow derivation of absolute time and azimuth:
 //
@@ -55,13 +61,43 @@ const (
 //
 // and provide sample spacing (DecimRateM1), initial distance from the radar (Extra, bits 13:0),
 // and treatment of multiple samples (Extra, bits 15:14).
+//
+// The FPGA's trigger counter is only 32 bits wide, so it is unwrapped
+// to 64 bits in software as scanlines are read (see Counter64).
+// Fields are ordered so that the header has no implicit padding.
 type ScanlineHdr struct {
-	ARPCount  uint32 // number of ARP pulses since reset; could wrap, but will take 170 years even at 48 RPM
-	TrigClock uint32 // ADC clock ticks since last ACP wraparound
-	TrigCount uint32 // low 32-bits of count of trigger pulses since reset, including those not captured
-	ACPClock  uint32 // bits 31:20 - ACPs since last ACP wraparound; bits 19:0 - ADC clock ticks since last ACP
+	Version uint16 // layout of this header; SCANLINE_HDR_VERSION
 	DecimRateM1
-	Extra uint16 // bits 15:14: DecimMode; bits 13:0 skipped clocks before first sample (i.e. additional trigger delay)
+	Extra         uint16 // bits 15:14: DecimMode; bits 13:0 skipped clocks before first sample (i.e. additional trigger delay)
+	_             uint16 // reserved
+	TrigCount     uint64 // count of trigger pulses since reset, including those not captured; serial number of the scanline
+	TrigClock     uint64 // ADC clock ticks since reset, at trigger
+	ARPCount      uint32 // number of ARP pulses since reset; could wrap, but will take 170 years even at 48 RPM
+	ACPCount      uint32 // number of ACP pulses since reset, at trigger; wraps, so compare counts by 32-bit subtraction
+	ClockSinceACP uint32 // ADC clock ticks between the most recent ACP and the trigger; saturates at 2^32 - 1 (34 s)
+	_             uint32 // reserved
+}
+
+// Counter64 extends a wrapping 32-bit FPGA counter to 64 bits.  It
+// must see the counter at least once per wraparound.
+type Counter64 struct {
+	hi   uint64 // high 32 bits, in place
+	last uint32 // most recent value of the 32-bit counter
+}
+
+// Unwrap returns the 64-bit count corresponding to the current
+// value v of the 32-bit counter.
+func (c *Counter64) Unwrap(v uint32) uint64 {
+	if v < c.last {
+		c.hi += 1 << 32
+	}
+	c.last = v
+	return c.hi | uint64(v)
+}
+
+// Reset restarts the count; call this after resetting the FPGA.
+func (c *Counter64) Reset() {
+	c.hi, c.last = 0, 0
 }
 
 // Scanline is a sequence of samples received after one radar pulse
@@ -87,6 +123,7 @@ type Sweep struct {
 	tw1     time.Time      // time of last scanline in sweep
 	clock   uint32         // base rate of sampling clock, in Hz
 	uniform bool           // does every scanline in this sweep have the same decimation rate and first sample range?
+	Ranging RangeParams    // digitizer settings for computing range, when sweep was acquired
 	n       uint16         // number of scanlines in this sweep (increases as sweep is accumulated)
 	s1      ScanlineHandle // handle for first scanline in this sweep
 	s2      ScanlineHandle // handle for last scanline in this sweep (changes as sweep is accumulated)
@@ -178,6 +215,21 @@ func (slb *ScanlineBuff) Next(n int, trig uint64) (i int, err error) {
 	return
 }
 
+// Store copies a scanline with header h and samples d into the
+// buffer, returning it, or nil if there is no room.  It is for sources
+// other than the FPGA, such as replays of recorded sweeps.
+func (slb *ScanlineBuff) Store(h ScanlineHdr, d []Sample) *Scanline {
+	i, err := slb.Next(len(d), h.TrigCount)
+	if err != nil {
+		return nil
+	}
+	s := &slb.ScanBuff[i]
+	s.ScanlineHdr = h
+	copy(s.Data(), d)
+	slb.nScanlines++
+	return s
+}
+
 func (s Scanline) Valid() bool {
 	return s.Samples[0] == NOT_A_SAMPLE && s.Samples[1] == Sample(s.TrigCount)
 }
@@ -0,0 +1,191 @@
+package buffer
+
+// Conversion of sample index to range.
+//
+// After a trigger pulse is detected, the FPGA waits TrigDelay ADC
+// clocks, then a further number of skipped clocks recorded in the
+// scanline header (Extra, bits 13:0), before consuming ADC samples.
+// Each stored sample consumes DecimRateM1 + 1 consecutive ADC samples,
+// so it represents the echo from an interval of ranges.  We take a
+// sample's range to be that of the middle of its interval when samples
+// are summed or averaged, and that of the last ADC sample used when
+// they are decimated.
+//
+// Range is measured from the antenna, so the delay between trigger
+// detection and the pulse leaving the antenna (due to cable length,
+// magnetron firing time, and so on) is subtracted.
+
+import (
+	"github.com/jbrzusto/ogdar/fpga"
+	"math"
+)
+
+// RangeParams holds the digitizer settings needed to compute ranges
+// which are not recorded in scanline headers.
+type RangeParams struct {
+	TrigDelay  uint32  // value of the FPGA's TrigDelay register, in ADC clocks
+	RangeDelay float64 // ADC clocks between trigger detection and the pulse leaving the antenna
+}
+
+// DecimRate returns the number of ADC samples consumed per stored sample.
+func (h *ScanlineHdr) DecimRate() uint32 {
+	return uint32(h.DecimRateM1) + 1
+}
+
+// DecimMode returns how ADC samples were combined into stored samples.
+func (h *ScanlineHdr) DecimMode() DecimMode {
+	return DecimMode(h.Extra >> 14)
+}
+
+// SkippedClocks returns the number of ADC clocks skipped after the
+// trigger delay and before the first sample.
+func (h *ScanlineHdr) SkippedClocks() uint32 {
+	return uint32(h.Extra & 0x3fff)
+}
+
+// SampleBits returns the number of significant bits in each sample:
+// those of the ADC, plus more when the FPGA sums ADC samples.
+func (h *ScanlineHdr) SampleBits() int {
+	bits := fpga.BPS_VID
+	if h.DecimMode() == DECIM_SUM {
+		for n := h.DecimRate(); n > 1; n = (n + 1) / 2 {
+			bits++
+		}
+	}
+	return bits
+}
+
+// RangeResolution returns the distance between consecutive samples, in metres.
+func (h *ScanlineHdr) RangeResolution() float64 {
+	return float64(h.DecimRate()) * fpga.RANGE_PER_CLOCK
+}
+
+// RangeOf returns the range of the i'th sample, in metres, for
+// digitizer settings p.  Ranges of samples from before the pulse left
+// the antenna are negative.
+func (h *ScanlineHdr) RangeOf(i int, p RangeParams) float64 {
+	n := float64(h.DecimRate())
+	pos := n*float64(i) + n - 1 // clock of last ADC sample used, from start of capture
+	if h.DecimMode() != DECIM_DECIM {
+		pos -= (n - 1) / 2
+	}
+	return (float64(p.TrigDelay+h.SkippedClocks()) + pos - p.RangeDelay) * fpga.RANGE_PER_CLOCK
+}
+
+// FirstRange returns the range of the first sample, in metres.
+func (h *ScanlineHdr) FirstRange(p RangeParams) float64 {
+	return h.RangeOf(0, p)
+}
+
+// NumSamples returns the number of samples in the scanline, not
+// counting the two-slot fingerprint.
+func (s *Scanline) NumSamples() int {
+	if len(s.Samples) < 2 {
+		return 0
+	}
+	return len(s.Samples) - 2
+}
+
+// Data returns the scanline's samples, without the two-slot fingerprint.
+func (s *Scanline) Data() []Sample {
+	if len(s.Samples) < 2 {
+		return nil
+	}
+	return s.Samples[2:]
+}
+
+// MaxRange returns the range of the scanline's last sample, in metres.
+func (s *Scanline) MaxRange(p RangeParams) float64 {
+	return s.RangeOf(s.NumSamples()-1, p)
+}
+
+// Reduce sets cells to a spoke of the scanline, digitized with
+// settings p, whose len(cells) cells of equal length cover ranges from
+// the antenna out to rng metres.  Each cell gets the largest sample
+// whose range falls in it, or the nearest sample if none do, keeping
+// its top bits bits; samples from before the pulse left the antenna
+// are left out, and cells beyond the last sample are set to 0.
+func (s *Scanline) Reduce(cells []byte, p RangeParams, rng float64, bits int) {
+	d := s.Data()
+	first, res := s.FirstRange(p), s.RangeResolution()
+	shift := s.SampleBits() - bits
+	if shift < 0 {
+		shift = 0
+	}
+	top := Sample(1)<<uint(bits) - 1
+	cellLen := rng / float64(len(cells))
+	for i := range cells {
+		j0 := int(math.Ceil((float64(i)*cellLen - first) / res))
+		j1 := int(math.Ceil((float64(i+1)*cellLen - first) / res))
+		if j0 < 0 {
+			j0 = 0
+		}
+		if j1 <= j0 {
+			j1 = j0 + 1
+		}
+		if j0 >= len(d) {
+			cells[i] = 0
+			continue
+		}
+		if j1 > len(d) {
+			j1 = len(d)
+		}
+		max := Sample(0)
+		for _, v := range d[j0:j1] {
+			if v > max {
+				max = v
+			}
+		}
+		if v := max >> uint(shift); v > top {
+			cells[i] = byte(top)
+		} else {
+			cells[i] = byte(v)
+		}
+	}
+}
+
+// firstLine returns the first scanline in the sweep, or nil if there
+// are none.
+func (sw *Sweep) firstLine() *Scanline {
+	switch {
+	case len(sw.Lines) > 0:
+		return &sw.Lines[0]
+	case len(sw.Lines2) > 0:
+		return &sw.Lines2[0]
+	}
+	return nil
+}
+
+// RangeOf returns the range of the i'th sample of the sweep's first
+// scanline, in metres.  If the sweep is uniform, this holds for all its
+// scanlines.
+func (sw *Sweep) RangeOf(i int) float64 {
+	if l := sw.firstLine(); l != nil {
+		return l.RangeOf(i, sw.Ranging)
+	}
+	return 0
+}
+
+// FirstRange returns the range of the first sample of the sweep's
+// first scanline, in metres.
+func (sw *Sweep) FirstRange() float64 {
+	return sw.RangeOf(0)
+}
+
+// RangeResolution returns the distance between consecutive samples of
+// the sweep's first scanline, in metres.
+func (sw *Sweep) RangeResolution() float64 {
+	if l := sw.firstLine(); l != nil {
+		return l.RangeResolution()
+	}
+	return 0
+}
+
+// MaxRange returns the range of the last sample of the sweep's first
+// scanline, in metres.
+func (sw *Sweep) MaxRange() float64 {
+	if l := sw.firstLine(); l != nil {
+		return l.MaxRange(sw.Ranging)
+	}
+	return 0
+}
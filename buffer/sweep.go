@@ -0,0 +1,178 @@
+package buffer
+
+// Assembly of scanlines into sweeps.
+//
+// A sweep is cut at each ARP: it holds the scanlines whose headers
+// have the same ARPCount.  The scanlines before the first ARP seen
+// make an incomplete sweep, which is discarded.  A completed sweep is
+// handed to clients with copies of its scanlines' headers, since the
+// slots in the scanline ring buffer are reused; its samples remain in
+// the sample ring buffer until overwritten, which Scanline.Valid
+// detects.
+
+import (
+	"github.com/jbrzusto/ogdar/fpga"
+	"math"
+	"sync"
+	"time"
+)
+
+// NewSweep returns a sweep holding lines, which were digitized with
+// settings ranging, from the rotation beginning at ARP count arp.
+// first and last are the times of the first and last scanlines.
+func NewSweep(arp uint32, ranging RangeParams, lines []Scanline, first, last time.Time) *Sweep {
+	sw := &Sweep{
+		ARP:     arp,
+		ts0:     first,
+		tw1:     last,
+		clock:   fpga.FAST_ADC_CLOCK,
+		uniform: true,
+		Ranging: ranging,
+		Lines:   lines,
+	}
+	if len(lines) > math.MaxUint16 {
+		sw.n = math.MaxUint16
+	} else {
+		sw.n = uint16(len(lines))
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i].DecimRateM1 != lines[0].DecimRateM1 || lines[i].Extra != lines[0].Extra {
+			sw.uniform = false
+			break
+		}
+	}
+	return sw
+}
+
+// NumLines returns the number of scanlines in the sweep.
+func (sw *Sweep) NumLines() int {
+	return len(sw.Lines) + len(sw.Lines2)
+}
+
+// Line returns the i'th scanline of the sweep.
+func (sw *Sweep) Line(i int) *Scanline {
+	if i < len(sw.Lines) {
+		return &sw.Lines[i]
+	}
+	return &sw.Lines2[i-len(sw.Lines)]
+}
+
+// Uniform returns true if every scanline in the sweep has the same
+// decimation rate and first sample range.
+func (sw *Sweep) Uniform() bool {
+	return sw.uniform
+}
+
+// Times returns the times at which the sweep's first and last
+// scanlines were acquired.
+func (sw *Sweep) Times() (first, last time.Time) {
+	return sw.ts0, sw.tw1
+}
+
+// ClockRate returns the rate of the ADC clock, in Hz, used for the
+// sweep's TrigClock values.
+func (sw *Sweep) ClockRate() uint32 {
+	return sw.clock
+}
+
+// SweepAssembler groups scanlines into sweeps.  Its Add method is
+// meant to be an Acquirer hook.
+type SweepAssembler struct {
+	mu         sync.Mutex
+	trigDelay  func() uint32             // returns the current TrigDelay, for Ranging of new sweeps
+	now        func(*Scanline) time.Time // returns the time of a scanline; see SetClock
+	rangeDelay float64                   // for Ranging of new sweeps; see SetRangeDelay
+	handlers   []func(*Sweep)            // called with each completed sweep
+	started    bool                      // true once an ARP has been seen, so that the current sweep is complete
+	arp        uint32                    // ARPCount of current sweep
+	ranging    RangeParams               // digitizer settings at start of current sweep
+	lines      []Scanline                // headers of scanlines in current sweep
+	first      time.Time                 // time of the first scanline of the current sweep
+	last       time.Time                 // time of the most recent scanline
+}
+
+// NewSweepAssembler returns a SweepAssembler.  trigDelay returns the
+// value of the FPGA's TrigDelay register (or its equivalent, for
+// replayed scanlines); it is called from Add at the start of each
+// sweep.  rangeDelay is the number of ADC clocks between trigger
+// detection and the pulse leaving the antenna.
+func NewSweepAssembler(trigDelay func() uint32, rangeDelay float64) *SweepAssembler {
+	return &SweepAssembler{trigDelay: trigDelay, now: func(*Scanline) time.Time { return time.Now() }, rangeDelay: rangeDelay}
+}
+
+// SetClock makes the assembler call now for the time of each scanline,
+// instead of using the time at which it is added.  ogdar uses this to
+// time scanlines from their trigger clocks, and replay sources so that
+// sweeps carry the times at which they were recorded.
+func (a *SweepAssembler) SetClock(now func(s *Scanline) time.Time) {
+	a.mu.Lock()
+	a.now = now
+	a.mu.Unlock()
+}
+
+// SetRangeDelay changes the range delay recorded in sweeps started
+// from now on.
+func (a *SweepAssembler) SetRangeDelay(rangeDelay float64) {
+	a.mu.Lock()
+	a.rangeDelay = rangeDelay
+	a.mu.Unlock()
+}
+
+// OnSweep arranges for f to be called with each completed sweep.  f
+// is called from the acquisition goroutine, so it must be quick.
+func (a *SweepAssembler) OnSweep(f func(*Sweep)) {
+	a.mu.Lock()
+	a.handlers = append(a.handlers, f)
+	a.mu.Unlock()
+}
+
+// Add adds the scanline s, completing the current sweep if s is from
+// the next rotation.
+func (a *SweepAssembler) Add(s *Scanline) {
+	a.mu.Lock()
+	var done *Sweep
+	now := a.now(s)
+	if len(a.lines) == 0 || s.ARPCount != a.arp {
+		if a.started && len(a.lines) > 0 {
+			done = NewSweep(a.arp, a.ranging, a.lines, a.first, a.last)
+		}
+		a.started = len(a.lines) > 0 || a.started
+		a.arp = s.ARPCount
+		a.ranging = RangeParams{TrigDelay: a.trigDelay(), RangeDelay: a.rangeDelay}
+		a.lines = make([]Scanline, 0, cap(a.lines))
+		a.first = now
+	}
+	a.lines = append(a.lines, *s)
+	a.last = now
+	handlers := a.handlers
+	a.mu.Unlock()
+	if done == nil {
+		return
+	}
+	for _, f := range handlers {
+		f(done)
+	}
+}
+
+// Flush completes the current sweep, handing it to handlers even if
+// its start was not seen, and treats the next scanline as the start of
+// a complete sweep.  Sources which know where sweeps begin, such as
+// replays of archived sweeps, call this at each boundary so that their
+// first and last sweeps are not discarded.
+func (a *SweepAssembler) Flush() {
+	a.mu.Lock()
+	var done *Sweep
+	if len(a.lines) > 0 {
+		done = NewSweep(a.arp, a.ranging, a.lines, a.first, a.last)
+	}
+	a.started = true
+	a.lines = make([]Scanline, 0, cap(a.lines))
+	handlers := a.handlers
+	a.mu.Unlock()
+	if done == nil {
+		return
+	}
+	for _, f := range handlers {
+		f(done)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Package calib recommends settings for the trigger, ACP and ARP pulse
+detectors from raw captures of those channels.
+
+Each channel is assumed to idle at a baseline level, with pulses
+that depart from it in one direction (the polarity).  The baseline
+is the median sample, the polarity is the direction of the larger
+excursion from it, and pulses are runs of samples beyond the
+midpoint between baseline and the largest excursion.  From these we
+get peak level, pulse width and (given at least two pulses) the
+interval between pulses.
+
+The detectors in the FPGA are Schmitt triggers: a pulse is detected
+when the signal crosses the excite threshold, and another cannot be
+detected until the signal has returned past the relax threshold and
+then a latency period has elapsed.  We put the excite threshold half
+way to the peak, the relax threshold a fifth of the way (or further,
+if needed to clear the noise), and the latency at half the gap
+between pulses.
+*/
+package calib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jbrzusto/ogdar/fpga"
+	"math"
+	"sort"
+)
+
+const (
+	ExciteFrac  = 0.5 // excite threshold, as fraction of distance from baseline to peak
+	RelaxFrac   = 0.2 // relax threshold, as fraction of distance from baseline to peak
+	NoiseMargin = 4   // minimum distance of relax threshold from baseline, in units of Noise
+	LatencyFrac = 0.5 // latency, as fraction of the gap between end of one pulse and start of the next
+	MinPulseSNR = 8   // pulses must exceed the baseline by at least this many units of Noise
+)
+
+// ErrNoPulses is returned by Analyse when the samples show no pulses
+// distinguishable from noise.
+var ErrNoPulses = errors.New("no pulses found")
+
+// PulseStats summarizes the pulses found in one channel's samples.
+type PulseStats struct {
+	Baseline  float64 // level of signal between pulses (median of all samples)
+	Noise     float64 // robust standard deviation of baseline (scaled median absolute deviation)
+	Positive  bool    // true if pulses rise above the baseline, false if they fall below it
+	Peak      float64 // median extreme level reached by pulses
+	NumPulses int     // number of complete pulses seen
+	Width     float64 // median pulse width at half height, in seconds
+	Period    float64 // median interval between starts of consecutive pulses, in seconds; 0 if fewer than two pulses
+}
+
+// Amplitude returns the signed distance from baseline to peak.
+func (ps PulseStats) Amplitude() float64 {
+	return ps.Peak - ps.Baseline
+}
+
+// Rate returns the pulse rate in Hz, or 0 if unknown.
+func (ps PulseStats) Rate() float64 {
+	if ps.Period <= 0 {
+		return 0
+	}
+	return 1 / ps.Period
+}
+
+// median returns the median of x, which is sorted in place.
+func median(x []float64) float64 {
+	sort.Float64s(x)
+	n := len(x)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return x[n/2]
+	}
+	return (x[n/2-1] + x[n/2]) / 2
+}
+
+// Analyse finds pulses in samples x taken dt seconds apart.
+func Analyse(x []int16, dt float64) (ps PulseStats, err error) {
+	if len(x) == 0 {
+		return ps, ErrNoPulses
+	}
+	f := make([]float64, len(x))
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i, v := range x {
+		f[i] = float64(v)
+		lo = math.Min(lo, f[i])
+		hi = math.Max(hi, f[i])
+	}
+	ps.Baseline = median(f)
+	for i, v := range x {
+		f[i] = math.Abs(float64(v) - ps.Baseline)
+	}
+	ps.Noise = 1.4826 * median(f)
+	ps.Positive = hi-ps.Baseline >= ps.Baseline-lo
+	ext := lo
+	if ps.Positive {
+		ext = hi
+	}
+	if math.Abs(ext-ps.Baseline) < MinPulseSNR*math.Max(ps.Noise, 1) {
+		return ps, ErrNoPulses
+	}
+	mid := (ps.Baseline + ext) / 2
+	beyond := func(v float64) bool {
+		if ps.Positive {
+			return v > mid
+		}
+		return v < mid
+	}
+	// find runs of samples beyond mid; ignore runs touching either end
+	// of the capture, since they might be incomplete
+	var peaks, widths, starts []float64
+	in := beyond(float64(x[0]))
+	start := 0
+	pk := 0.0
+	for i := 1; i < len(x); i++ {
+		v := float64(x[i])
+		b := beyond(v)
+		switch {
+		case b && !in:
+			start, pk = i, v
+		case b && in:
+			if (ps.Positive && v > pk) || (!ps.Positive && v < pk) {
+				pk = v
+			}
+		case !b && in && start > 0:
+			peaks = append(peaks, pk)
+			widths = append(widths, float64(i-start)*dt)
+			starts = append(starts, float64(start)*dt)
+		}
+		in = b
+	}
+	ps.NumPulses = len(peaks)
+	if ps.NumPulses == 0 {
+		return ps, ErrNoPulses
+	}
+	if ps.NumPulses > 1 {
+		gaps := make([]float64, len(starts)-1)
+		for i := range gaps {
+			gaps[i] = starts[i+1] - starts[i]
+		}
+		ps.Period = median(gaps)
+	}
+	ps.Peak = median(peaks)
+	ps.Width = median(widths)
+	return
+}
+
+// Settings are recommended register values for one pulse detector.
+type Settings struct {
+	Excite  int32  // excite threshold
+	Relax   int32  // relax threshold
+	Latency uint32 // latency, in ADC clocks
+}
+
+// Recommend returns detector settings for pulses described by ps,
+// for an ADC of the given number of bits.  period is the interval
+// between pulses in seconds, used if ps.Period is 0 (e.g. because the
+// capture was too short to see two pulses); if both are 0, latency is
+// not set.  maxLatency is the largest latency the detector accepts.
+// warnings describe problems the operator should look at.
+func Recommend(ps PulseStats, bits uint, period float64, maxLatency uint32) (s Settings, warnings []string) {
+	amp := ps.Amplitude()
+	relax := RelaxFrac * amp
+	if math.Abs(relax) < NoiseMargin*ps.Noise {
+		relax = math.Copysign(NoiseMargin*ps.Noise, amp)
+		if math.Abs(relax) >= ExciteFrac*math.Abs(amp) {
+			warnings = append(warnings, fmt.Sprintf("pulse amplitude %.0f is small compared to noise %.1f; detection will be unreliable", math.Abs(amp), ps.Noise))
+		}
+	}
+	lim := float64(int32(1) << (bits - 1))
+	clamp := func(v float64) int32 {
+		return int32(math.Max(-lim, math.Min(lim-1, math.Round(v))))
+	}
+	s.Excite = clamp(ps.Baseline + ExciteFrac*amp)
+	s.Relax = clamp(ps.Baseline + relax)
+	if math.Abs(ps.Peak) >= lim-1 || math.Abs(ps.Baseline) >= lim-1 {
+		warnings = append(warnings, "signal reaches the limit of the ADC range; consider attenuating it")
+	}
+	if ps.Period > 0 {
+		period = ps.Period
+	}
+	if period > 0 {
+		gap := period - ps.Width
+		if gap <= 0 {
+			warnings = append(warnings, "pulse width is not shorter than pulse interval")
+		} else {
+			lat := LatencyFrac * gap * fpga.FAST_ADC_CLOCK
+			if lat > float64(maxLatency) {
+				lat = float64(maxLatency)
+			}
+			s.Latency = uint32(lat)
+		}
+	} else {
+		warnings = append(warnings, "pulse interval unknown; latency not set")
+	}
+	return
+}
@@ -0,0 +1,231 @@
+package calib
+
+// Capture raw channels from the FPGA and recommend detector settings.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jbrzusto/ogdar/fpga"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	MaxTrigLatency = 65535      // largest TrigLatency accepted by the FPGA
+	MaxACPLatency  = 1000000    // largest ACPLatency accepted by the FPGA
+	MaxARPLatency  = 0xffffffff // ARPLatency is a full 32-bit register
+	PeriodDecRate  = 64         // decimation rate for the trigger capture used to measure PRF; gives ~ 8 ms of samples
+	ScopeTimeout   = time.Second
+)
+
+// Channel is the analysis of one channel, with recommended settings.
+type Channel struct {
+	Name     string     // channel name, as used in register names: "Trig", "ACP" or "ARP"
+	Stats    PulseStats // pulses found in the channel
+	Settings Settings   // recommended register settings
+	Warnings []string   // problems the operator should know about
+	Err      error      // non-nil if no pulses could be found
+}
+
+// Report holds recommendations for all three pulse detectors, and
+// the pulse rates they imply.
+type Report struct {
+	Trig, ACP, ARP Channel
+	PRF            float64 // trigger pulses per second
+	ACPRate        float64 // ACPs per second
+	RPM            float64 // antenna rotations per minute, from ACPRate and acpsPerRotation
+}
+
+// Calibrate captures raw samples from all channels using immediate
+// triggering, so that it works even when the current thresholds are
+// wrong, and recommends settings for each detector.
+// acpsPerRotation is the nominal number of ACPs per ARP, used to
+// estimate the ARP interval, since a single capture is much shorter
+// than a rotation.  A full-rate capture is also much shorter than the
+// interval between trigger pulses at low PRFs, so up to tries captures
+// are made looking for a trigger pulse and an ARP pulse.  If no
+// trigger pulse is seen at full rate, the trigger is analysed from the
+// decimated capture used to measure the PRF, which spans several
+// pulses but gives their shape less precisely.  Registers changed
+// during capture are restored.
+func Calibrate(acpsPerRotation int, tries int) (*Report, error) {
+	oldDecRate, oldOptions := fpga.Regs.DecRate, fpga.Regs.Options
+	defer func() {
+		fpga.Regs.DecRate = oldDecRate
+		fpga.Regs.Options = oldOptions
+	}()
+	fpga.Regs.Options = 0
+
+	// full-rate captures for trigger pulse shape, and for ACP and ARP
+	fpga.Regs.DecRate = 1
+	sc, err := fpga.Scope(fpga.TRG_IMMEDIATE, fpga.SAMPLES_PER_BUFF, ScopeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{Trig: Channel{Name: "Trig"}, ACP: Channel{Name: "ACP"}, ARP: Channel{Name: "ARP"}}
+	r.Trig.Stats, r.Trig.Err = Analyse(sc.Trig, sc.FastPeriod)
+	r.ACP.Stats, r.ACP.Err = Analyse(sc.ACP, sc.SlowPeriod)
+	r.ARP.Stats, r.ARP.Err = Analyse(sc.ARP, sc.SlowPeriod)
+	for i := 1; i < tries && (r.Trig.Err != nil || r.ARP.Err != nil); i++ {
+		if sc, err = fpga.Scope(fpga.TRG_IMMEDIATE, fpga.SAMPLES_PER_BUFF, ScopeTimeout); err != nil {
+			return nil, err
+		}
+		if r.Trig.Err != nil {
+			r.Trig.Stats, r.Trig.Err = Analyse(sc.Trig, sc.FastPeriod)
+		}
+		if r.ARP.Err != nil {
+			r.ARP.Stats, r.ARP.Err = Analyse(sc.ARP, sc.SlowPeriod)
+		}
+	}
+
+	// decimated capture to see several trigger pulses
+	var trigWarnings []string
+	if r.Trig.Err != nil || r.Trig.Stats.Period == 0 {
+		fpga.Regs.DecRate = PeriodDecRate
+		if sc, err = fpga.Scope(fpga.TRG_IMMEDIATE, fpga.SAMPLES_PER_BUFF, ScopeTimeout); err != nil {
+			return nil, err
+		}
+		ps, err := Analyse(sc.Trig, sc.FastPeriod)
+		switch {
+		case err != nil:
+		case r.Trig.Err != nil:
+			r.Trig.Stats, r.Trig.Err = ps, nil
+			trigWarnings = append(trigWarnings, fmt.Sprintf("no trigger pulse was seen in %d full-rate captures, so the pulse width is only known to within %.3g s; check the latency with the scope", tries, sc.FastPeriod))
+		default:
+			r.Trig.Stats.Period = ps.Period
+		}
+	}
+
+	r.PRF = r.Trig.Stats.Rate()
+	r.ACPRate = r.ACP.Stats.Rate()
+	arpPeriod := 0.0
+	if r.ACPRate > 0 && acpsPerRotation > 0 {
+		arpPeriod = float64(acpsPerRotation) / r.ACPRate
+		r.RPM = 60 / arpPeriod
+	}
+	if r.Trig.Err == nil {
+		r.Trig.Settings, r.Trig.Warnings = Recommend(r.Trig.Stats, fpga.BPS_TRIG, 0, MaxTrigLatency)
+		r.Trig.Warnings = append(r.Trig.Warnings, trigWarnings...)
+	}
+	if r.ACP.Err == nil {
+		r.ACP.Settings, r.ACP.Warnings = Recommend(r.ACP.Stats, fpga.BPS_ACP, 0, MaxACPLatency)
+	}
+	if r.ARP.Err == nil {
+		r.ARP.Settings, r.ARP.Warnings = Recommend(r.ARP.Stats, fpga.BPS_ARP, arpPeriod, MaxARPLatency)
+	}
+	return r, nil
+}
+
+// polarity returns a human-readable pulse polarity.
+func (ps PulseStats) polarity() string {
+	if ps.Positive {
+		return "positive"
+	}
+	return "negative"
+}
+
+// WriteSummary writes a human-readable description of the report to w.
+func (r *Report) WriteSummary(w io.Writer) {
+	for _, c := range []*Channel{&r.Trig, &r.ACP, &r.ARP} {
+		fmt.Fprintf(w, "%s channel:\n", c.Name)
+		if c.Err != nil {
+			fmt.Fprintf(w, "   %v\n", c.Err)
+			continue
+		}
+		s := &c.Stats
+		fmt.Fprintf(w, "   %s pulses from baseline %.0f (noise %.1f) to peak %.0f; width %.3g s", s.polarity(), s.Baseline, s.Noise, s.Peak, s.Width)
+		if s.Period > 0 {
+			fmt.Fprintf(w, "; interval %.4g s", s.Period)
+		}
+		fmt.Fprintln(w)
+		for _, x := range c.Warnings {
+			fmt.Fprintf(w, "   WARNING: %s\n", x)
+		}
+	}
+	fmt.Fprintf(w, "Expected PRF: %.0f Hz\nExpected ACP rate: %.1f Hz\n", r.PRF, r.ACPRate)
+	if r.RPM > 0 {
+		fmt.Fprintf(w, "Implied antenna speed: %.1f RPM\n", r.RPM)
+	}
+}
+
+// WriteTOML writes the recommended settings to w as the
+// corresponding keys of the [digdar] section of ogdar.toml.  Channels
+// without recommendations are omitted.
+func (r *Report) WriteTOML(w io.Writer) {
+	fmt.Fprintln(w, "[digdar]")
+	for _, c := range []*Channel{&r.Trig, &r.ACP, &r.ARP} {
+		if c.Err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "%sThreshExcite = %d\n%sThreshRelax = %d\n", c.Name, c.Settings.Excite, c.Name, c.Settings.Relax)
+		if c.Settings.Latency > 0 {
+			fmt.Fprintf(w, "%sLatency = %d\n", c.Name, c.Settings.Latency)
+		}
+	}
+}
+
+// Apply writes the recommended settings to the FPGA.  Channels
+// without recommendations, and unknown latencies, are left as-is.
+func (r *Report) Apply() {
+	set := func(name string, v uint64) {
+		f, _ := fpga.FindRegField(name)
+		f.Set(v)
+	}
+	for _, c := range []*Channel{&r.Trig, &r.ACP, &r.ARP} {
+		if c.Err != nil {
+			continue
+		}
+		set(c.Name+"ThreshExcite", uint64(uint32(c.Settings.Excite)))
+		set(c.Name+"ThreshRelax", uint64(uint32(c.Settings.Relax)))
+		if c.Settings.Latency > 0 {
+			set(c.Name+"Latency", uint64(c.Settings.Latency))
+		}
+	}
+}
+
+// MainBangSamples is the number of video samples captured when
+// looking for the main bang.
+const MainBangSamples = 2000
+
+// MeasureTrigDelay estimates the delay, in ADC clocks, between
+// detection of a trigger pulse and the radar's "main bang" (the
+// leakage of the transmitted pulse into the video channel), by
+// capturing video with no delay and finding the first sample which
+// departs from the video baseline by at least half the largest
+// departure.  The trigger detector must already be working.
+// Registers changed during capture are restored.
+func MeasureTrigDelay() (uint32, error) {
+	oldDecRate, oldOptions, oldDelay := fpga.Regs.DecRate, fpga.Regs.Options, fpga.Regs.TrigDelay
+	defer func() {
+		fpga.Regs.DecRate = oldDecRate
+		fpga.Regs.Options = oldOptions
+		fpga.Regs.TrigDelay = oldDelay
+	}()
+	fpga.Regs.DecRate = 1
+	fpga.Regs.Options = 0
+	fpga.Regs.TrigDelay = 0
+	sc, err := fpga.Scope(fpga.TRG_TRIG, MainBangSamples, ScopeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	ps, err := Analyse(sc.Vid, sc.FastPeriod)
+	if err != nil && err != ErrNoPulses {
+		return 0, err
+	}
+	dev := make([]float64, len(sc.Vid))
+	big := 0.0
+	for i, v := range sc.Vid {
+		dev[i] = math.Abs(float64(v) - ps.Baseline)
+		big = math.Max(big, dev[i])
+	}
+	if big < MinPulseSNR*math.Max(ps.Noise, 1) {
+		return 0, errors.New("no main bang found in video; is the radar transmitting?")
+	}
+	for i, d := range dev {
+		if d >= big/2 {
+			return uint32(i), nil
+		}
+	}
+	return 0, nil // not reached
+}
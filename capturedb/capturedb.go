@@ -0,0 +1,322 @@
+/*
+Package capturedb records sweeps in an SQLite database, and reads them
+back.  A database has one of two layouts, chosen when it is created:
+LAYOUT_OGDAR, which keeps everything in ogdar's scanline headers and
+radar parameters, and LAYOUT_DIGDAR, that of the capture databases
+written by the C version of digdar, for scripts written to read those.
+
+# Schema
+
+A database with LAYOUT_OGDAR has three tables.  modes holds each distinct combination
+of digitizer and radar settings; sweeps holds one row per sweep, and
+pulses one row per scanline:
+
+	CREATE TABLE modes (
+	   mode        INTEGER PRIMARY KEY, -- ID of this combination of settings
+	   ns          INTEGER,             -- samples per pulse
+	   decim       INTEGER,             -- ADC clocks per sample
+	   decim_mode  INTEGER,             -- how clocks are combined: 0 = decimate, 1 = sum, 2 = average
+	   skip        INTEGER,             -- ADC clocks skipped after the trigger delay, before the first sample
+	   trig_delay  INTEGER,             -- ADC clocks from trigger to start of capture
+	   range_delay DOUBLE,              -- ADC clocks from trigger to pulse leaving the antenna
+	   clock_rate  DOUBLE,              -- ADC clock rate, in Hz
+	   radar       TEXT,                -- radar make and model
+	   pulse       TEXT,                -- pulse length
+	   profile     TEXT,                -- ogdar operating profile
+	   prf         INTEGER,             -- nominal PRF, in Hz
+	   acps        INTEGER,             -- nominal ACPs per rotation
+	   power       INTEGER,             -- transmitted power, in watts
+	   heading     DOUBLE,              -- azimuth at ARP, in degrees clockwise from the heading reference
+	   beamwidth   DOUBLE,              -- horizontal beamwidth, in degrees
+	   rpm         DOUBLE               -- nominal rotation rate
+	);
+	CREATE TABLE sweeps (
+	   sweep_key   INTEGER PRIMARY KEY, -- ID of this sweep
+	   ts          DOUBLE,              -- time of first pulse, in seconds since 1970-01-01 UTC
+	   ts_end      DOUBLE,              -- time of last pulse
+	   mode        INTEGER,             -- settings; references modes.mode
+	   num_arp     INTEGER,             -- ARP count since reset
+	   np          INTEGER              -- number of pulses
+	);
+	CREATE TABLE pulses (
+	   sweep_key   INTEGER,             -- references sweeps.sweep_key
+	   ts          DOUBLE,              -- time of trigger, in seconds since 1970-01-01 UTC
+	   num_trig    INTEGER,             -- trigger count since reset
+	   trig_clock  INTEGER,             -- ADC clock count at trigger
+	   num_acp     INTEGER,             -- ACP count at trigger
+	   acp_clock   INTEGER,             -- ADC clock count at most recent ACP
+	   num_arp     INTEGER,             -- ARP count at trigger
+	   samples     BLOB                 -- ns 16-bit little-endian samples
+	);
+
+Pulses are in acquisition order within each sweep.  The time of each
+pulse is interpolated between the sweep's first and last pulses using
+the ADC clock.  Scanlines overwritten in the ring buffer before they
+could be recorded are left out.
+
+A database with LAYOUT_DIGDAR has the tables described in digdar.go.
+*/
+package capturedb
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/buffer"
+	_ "github.com/mattn/go-sqlite3"
+	"sync"
+	"time"
+)
+
+// Database layouts.
+const (
+	LAYOUT_OGDAR  = "ogdar"  // ogdar's own; see the package comment
+	LAYOUT_DIGDAR = "digdar" // that of digdar's capture databases; see digdar.go
+)
+
+// schema creates the tables described in the package comment.
+const schema = `
+CREATE TABLE IF NOT EXISTS modes (
+   mode        INTEGER PRIMARY KEY,
+   ns          INTEGER,
+   decim       INTEGER,
+   decim_mode  INTEGER,
+   skip        INTEGER,
+   trig_delay  INTEGER,
+   range_delay DOUBLE,
+   clock_rate  DOUBLE,
+   radar       TEXT,
+   pulse       TEXT,
+   profile     TEXT,
+   prf         INTEGER,
+   acps        INTEGER,
+   power       INTEGER,
+   heading     DOUBLE,
+   beamwidth   DOUBLE,
+   rpm         DOUBLE
+);
+CREATE TABLE IF NOT EXISTS sweeps (
+   sweep_key   INTEGER PRIMARY KEY,
+   ts          DOUBLE,
+   ts_end      DOUBLE,
+   mode        INTEGER,
+   num_arp     INTEGER,
+   np          INTEGER
+);
+CREATE TABLE IF NOT EXISTS pulses (
+   sweep_key   INTEGER,
+   ts          DOUBLE,
+   num_trig    INTEGER,
+   trig_clock  INTEGER,
+   num_acp     INTEGER,
+   acp_clock   INTEGER,
+   num_arp     INTEGER,
+   samples     BLOB
+);
+CREATE INDEX IF NOT EXISTS pulses_sweep_key ON pulses (sweep_key);
+`
+
+// modeColumns are the columns of modes other than mode, in the order
+// of the values returned by modeValues.
+const modeColumns = "ns, decim, decim_mode, skip, trig_delay, range_delay, clock_rate, radar, pulse, profile, prf, acps, power, heading, beamwidth, rpm"
+
+// DB is a capture database.  It is safe for concurrent use.
+type DB struct {
+	mu     sync.Mutex
+	db     *sql.DB
+	layout string // LAYOUT_OGDAR or LAYOUT_DIGDAR
+}
+
+// Open opens the capture database at path, creating it with the given
+// layout if necessary.  layout "" means an existing database's layout,
+// or LAYOUT_OGDAR for a new one; it is an error for an existing
+// database to have a different layout.
+func Open(path, layout string) (*DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{db: db}
+	if err = d.setLayout(layout); err == nil {
+		s := schema
+		if d.layout == LAYOUT_DIGDAR {
+			s = digdarSchema
+		}
+		_, err = db.Exec(s)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// setLayout sets d.layout to that of the tables in the database, or to
+// layout if it has none yet.
+func (d *DB) setLayout(layout string) error {
+	if layout != "" && layout != LAYOUT_OGDAR && layout != LAYOUT_DIGDAR {
+		return fmt.Errorf("unknown capture database layout %q; must be %s or %s", layout, LAYOUT_OGDAR, LAYOUT_DIGDAR)
+	}
+	var has string
+	err := d.db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name IN ('modes', 'param_settings')").Scan(&has)
+	switch {
+	case err == sql.ErrNoRows:
+		d.layout = layout
+		if d.layout == "" {
+			d.layout = LAYOUT_OGDAR
+		}
+		return nil
+	case err != nil:
+		return err
+	case has == "modes":
+		d.layout = LAYOUT_OGDAR
+	default:
+		d.layout = LAYOUT_DIGDAR
+	}
+	if layout != "" && layout != d.layout {
+		return fmt.Errorf("database has layout %s, not %s", d.layout, layout)
+	}
+	return nil
+}
+
+// Layout returns the database's layout: LAYOUT_OGDAR or LAYOUT_DIGDAR.
+func (d *DB) Layout() string {
+	return d.layout
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// modeValues returns the values of modeColumns for a sweep whose first
+// scanline is l, recorded with ranging and p.
+func modeValues(l *buffer.Scanline, ranging buffer.RangeParams, clockRate uint32, p archive.Params) []interface{} {
+	return []interface{}{l.NumSamples(), l.DecimRate(), int(l.DecimMode()), l.SkippedClocks(), ranging.TrigDelay, ranging.RangeDelay, float64(clockRate),
+		p.Model, p.Pulse, p.Profile, p.PRF, p.ACPsPerRotation, p.Power, p.HeadingOffset, p.Beamwidth, p.RPM}
+}
+
+// seconds returns t as seconds since 1970-01-01 UTC.
+func seconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// WriteSweep records sw in the database, with p as the radar's
+// parameters.  Scanlines whose samples have been overwritten in the
+// ring buffer are left out; lost is their number.  The sweep is
+// recorded in a single transaction, so readers never see part of it.
+// This makes DB an archive.Store.
+func (d *DB) WriteSweep(sw *buffer.Sweep, p archive.Params) (lost int, err error) {
+	if sw.NumLines() == 0 {
+		return 0, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if d.layout == LAYOUT_DIGDAR {
+		lost, err = writeDigdar(tx, sw, p)
+	} else {
+		lost, err = writeOgdar(tx, sw, p)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return
+}
+
+// writeOgdar records sw in tx, as for WriteSweep, with LAYOUT_OGDAR.
+func writeOgdar(tx *sql.Tx, sw *buffer.Sweep, p archive.Params) (lost int, err error) {
+	first, last := sw.Times()
+	l0 := sw.Line(0)
+	vals := modeValues(l0, sw.Ranging, sw.ClockRate(), p)
+	var mode int64
+	err = tx.QueryRow("SELECT mode FROM modes WHERE ("+modeColumns+") = (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", vals...).Scan(&mode)
+	if err == sql.ErrNoRows {
+		var res sql.Result
+		if res, err = tx.Exec("INSERT INTO modes ("+modeColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", vals...); err == nil {
+			mode, err = res.LastInsertId()
+		}
+	}
+	if err != nil {
+		return
+	}
+	res, err := tx.Exec("INSERT INTO sweeps (ts, ts_end, mode, num_arp, np) VALUES (?, ?, ?, ?, 0)", seconds(first), seconds(last), mode, sw.ARP)
+	if err != nil {
+		return
+	}
+	key, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	ins, err := tx.Prepare("INSERT INTO pulses (sweep_key, ts, num_trig, trig_clock, num_acp, acp_clock, num_arp, samples) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return
+	}
+	defer ins.Close()
+	ts := pulseTimes(sw)
+	np := 0
+	var blob []byte
+	for i := 0; i < sw.NumLines(); i++ {
+		l := sw.Line(i)
+		// copy the samples before checking they are still valid, in
+		// case they are overwritten while being copied
+		blob = appendSamples(blob[:0], l.Data())
+		if !l.Valid() {
+			lost++
+			continue
+		}
+		if _, err = ins.Exec(key, ts(l), l.TrigCount, l.TrigClock, l.ACPCount, l.TrigClock-uint64(l.ClockSinceACP), l.ARPCount, blob); err != nil {
+			return
+		}
+		np++
+	}
+	_, err = tx.Exec("UPDATE sweeps SET np = ? WHERE sweep_key = ?", np, key)
+	return
+}
+
+// pulseTimes returns a function giving the time of each scanline of
+// sw, in seconds since 1970-01-01 UTC, interpolated between the
+// sweep's first and last scanlines using the ADC clock.
+func pulseTimes(sw *buffer.Sweep) func(l *buffer.Scanline) float64 {
+	first, last := sw.Times()
+	l0 := sw.Line(0)
+	// seconds per ADC clock
+	spc := 1 / float64(sw.ClockRate())
+	if n := sw.NumLines(); n > 1 {
+		if dc := sw.Line(n-1).TrigClock - l0.TrigClock; dc > 0 {
+			spc = last.Sub(first).Seconds() / float64(dc)
+		}
+	}
+	return func(l *buffer.Scanline) float64 {
+		return seconds(first) + float64(l.TrigClock-l0.TrigClock)*spc
+	}
+}
+
+// appendSamples appends d to b as 16-bit little-endian values.
+func appendSamples(b []byte, d []buffer.Sample) []byte {
+	for _, s := range d {
+		b = append(b, byte(s), byte(s>>8))
+	}
+	return b
+}
+
+// decodeSamples returns the samples in the blob b, preceded by the
+// two-slot fingerprint for a scanline with trigger count trig.
+func decodeSamples(b []byte, trig uint64) []buffer.Sample {
+	s := make([]buffer.Sample, 2+len(b)/2)
+	s[0] = buffer.NOT_A_SAMPLE
+	s[1] = buffer.Sample(trig)
+	for i := 2; i < len(s); i++ {
+		s[i] = buffer.Sample(binary.LittleEndian.Uint16(b[2*(i-2):]))
+	}
+	return s
+}
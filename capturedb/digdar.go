@@ -0,0 +1,233 @@
+package capturedb
+
+// LAYOUT_DIGDAR: the layout of the capture databases written by the C
+// version of digdar, so that scripts written to read those can read
+// ogdar's.  There are three tables:
+//
+//	CREATE TABLE pulses (
+//	   sweep_key   INTEGER,             -- references sweeps.sweep_key
+//	   ts          DOUBLE,              -- time of trigger, in seconds since 1970-01-01 UTC
+//	   trigs       INTEGER,             -- trigger count since reset
+//	   trig_clock  INTEGER,             -- ADC clock count at trigger
+//	   azi         FLOAT,               -- azimuth, as a fraction of a circle clockwise from the heading reference
+//	   elev        FLOAT,               -- antenna elevation; always 0
+//	   rot         INTEGER,             -- rotation: ARP count at trigger
+//	   samples     BLOB                 -- 16-bit little-endian samples
+//	);
+//	CREATE TABLE sweeps (
+//	   sweep_key   INTEGER PRIMARY KEY, -- ID of this sweep
+//	   ts          DOUBLE               -- time of first pulse, in seconds since 1970-01-01 UTC
+//	);
+//	CREATE TABLE param_settings (
+//	   ts          DOUBLE,              -- time from which param has value val
+//	   param       TEXT,                -- name of a digitizer or radar setting
+//	   val         DOUBLE
+//	);
+//
+// Settings are recorded in param_settings, with the time of the first
+// pulse of the sweep they were first used for, whenever they change.
+// The params are those of LAYOUT_OGDAR's modes table which are
+// numbers: ns, decim, decim_mode, skip, trig_delay, range_delay,
+// clock_rate, prf, acps, power, heading, beamwidth and rpm.  The
+// radar's model, pulse length and profile are not recorded.
+//
+// A pulse's azimuth is reckoned from the ACPs since the first pulse of
+// its sweep, which follows the ARP, and the radar's heading offset.
+// The ACP counts and clocks of LAYOUT_OGDAR's pulses are not recorded,
+// so sweeps read back from this layout have ACP counts reckoned from
+// azi and rot, and ClockSinceACP unknown (math.MaxUint32).
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/buffer"
+	"math"
+)
+
+// digdarSchema creates the tables described above.
+const digdarSchema = `
+CREATE TABLE IF NOT EXISTS pulses (
+   sweep_key   INTEGER,
+   ts          DOUBLE,
+   trigs       INTEGER,
+   trig_clock  INTEGER,
+   azi         FLOAT,
+   elev        FLOAT,
+   rot         INTEGER,
+   samples     BLOB
+);
+CREATE TABLE IF NOT EXISTS sweeps (
+   sweep_key   INTEGER PRIMARY KEY,
+   ts          DOUBLE
+);
+CREATE TABLE IF NOT EXISTS param_settings (
+   ts          DOUBLE,
+   param       TEXT,
+   val         DOUBLE
+);
+CREATE INDEX IF NOT EXISTS pulses_sweep_key ON pulses (sweep_key);
+CREATE INDEX IF NOT EXISTS param_settings_param ON param_settings (param, ts);
+`
+
+// digdarParams are the names of the params recorded in param_settings,
+// in the order of the values returned by digdarValues.
+var digdarParams = []string{"ns", "decim", "decim_mode", "skip", "trig_delay", "range_delay", "clock_rate", "prf", "acps", "power", "heading", "beamwidth", "rpm"}
+
+// digdarValues returns the values of digdarParams for a sweep whose
+// first scanline is l, recorded with ranging and p.
+func digdarValues(l *buffer.Scanline, ranging buffer.RangeParams, clockRate uint32, p archive.Params) []float64 {
+	return []float64{float64(l.NumSamples()), float64(l.DecimRate()), float64(l.DecimMode()), float64(l.SkippedClocks()), float64(ranging.TrigDelay), ranging.RangeDelay, float64(clockRate),
+		float64(p.PRF), float64(p.ACPsPerRotation), float64(p.Power), p.HeadingOffset, p.Beamwidth, p.RPM}
+}
+
+// queryRower is a *sql.DB or *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// paramAt returns the value param had at time ts, according to q, and
+// false if it had none.
+func paramAt(q queryRower, param string, ts float64) (v float64, ok bool, err error) {
+	err = q.QueryRow("SELECT val FROM param_settings WHERE param = ? AND ts <= ? ORDER BY ts DESC LIMIT 1", param, ts).Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return v, err == nil, err
+}
+
+// writeDigdar records sw in tx, as for WriteSweep, with LAYOUT_DIGDAR.
+func writeDigdar(tx *sql.Tx, sw *buffer.Sweep, p archive.Params) (lost int, err error) {
+	first, _ := sw.Times()
+	ts0 := seconds(first)
+	l0 := sw.Line(0)
+	for i, v := range digdarValues(l0, sw.Ranging, sw.ClockRate(), p) {
+		old, ok, err := paramAt(tx, digdarParams[i], math.Inf(1))
+		if err != nil {
+			return 0, err
+		}
+		if ok && old == v {
+			continue
+		}
+		if _, err = tx.Exec("INSERT INTO param_settings (ts, param, val) VALUES (?, ?, ?)", ts0, digdarParams[i], v); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec("INSERT INTO sweeps (ts) VALUES (?)", ts0)
+	if err != nil {
+		return
+	}
+	key, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	ins, err := tx.Prepare("INSERT INTO pulses (sweep_key, ts, trigs, trig_clock, azi, elev, rot, samples) VALUES (?, ?, ?, ?, ?, 0, ?, ?)")
+	if err != nil {
+		return
+	}
+	defer ins.Close()
+	ts := pulseTimes(sw)
+	acps := float64(p.ACPsPerRotation)
+	if acps == 0 {
+		acps = 1
+	}
+	var blob []byte
+	for i := 0; i < sw.NumLines(); i++ {
+		l := sw.Line(i)
+		// copy the samples before checking they are still valid, in
+		// case they are overwritten while being copied
+		blob = appendSamples(blob[:0], l.Data())
+		if !l.Valid() {
+			lost++
+			continue
+		}
+		azi := p.HeadingOffset/360 + float64(l.ACPCount-l0.ACPCount)/acps
+		azi -= math.Floor(azi)
+		if _, err = ins.Exec(key, ts(l), l.TrigCount, l.TrigClock, azi, l.ARPCount, blob); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// digdarSweeps is Sweeps for LAYOUT_DIGDAR.
+func (d *DB) digdarSweeps(from, to float64) (sweeps []SweepInfo, err error) {
+	rows, err := d.db.Query(`SELECT s.sweep_key, COALESCE(MIN(p.rot), 0), s.ts, COALESCE(MAX(p.ts), s.ts), COUNT(p.sweep_key)
+		FROM sweeps s LEFT JOIN pulses p ON p.sweep_key = s.sweep_key
+		WHERE s.ts >= ? AND s.ts < ? GROUP BY s.sweep_key ORDER BY s.ts`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s SweepInfo
+		var ts, tsEnd float64
+		if err = rows.Scan(&s.Key, &s.ARP, &ts, &tsEnd, &s.NumLines); err != nil {
+			return nil, err
+		}
+		s.First, s.Last = fromSeconds(ts), fromSeconds(tsEnd)
+		sweeps = append(sweeps, s)
+	}
+	return sweeps, rows.Err()
+}
+
+// readDigdar is ReadSweep for LAYOUT_DIGDAR.
+func (d *DB) readDigdar(key int64) (*archive.Header, *buffer.Sweep, error) {
+	h := &archive.Header{HdrVersion: buffer.SCANLINE_HDR_VERSION, Uniform: true}
+	var ts float64
+	err := d.db.QueryRow("SELECT ts FROM sweeps WHERE sweep_key = ?", key).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("no sweep with key %d", key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	val := make(map[string]float64, len(digdarParams))
+	for _, param := range digdarParams {
+		v, ok, err := paramAt(d.db, param, ts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("sweep %d: no value for %s in param_settings", key, param)
+		}
+		val[param] = v
+	}
+	h.Ranging = buffer.RangeParams{TrigDelay: uint32(val["trig_delay"]), RangeDelay: val["range_delay"]}
+	h.ClockRate = uint32(val["clock_rate"])
+	h.PRF, h.ACPsPerRotation, h.Power = uint16(val["prf"]), uint16(val["acps"]), uint16(val["power"])
+	h.HeadingOffset, h.Beamwidth, h.RPM = val["heading"], val["beamwidth"], val["rpm"]
+	acps := val["acps"]
+	rows, err := d.db.Query("SELECT ts, trigs, trig_clock, azi, rot, samples FROM pulses WHERE sweep_key = ? ORDER BY rowid", key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var lines []buffer.Scanline
+	tsEnd := ts
+	for rows.Next() {
+		var l buffer.Scanline
+		var azi float64
+		var blob []byte
+		if err = rows.Scan(&tsEnd, &l.TrigCount, &l.TrigClock, &azi, &l.ARPCount, &blob); err != nil {
+			return nil, nil, err
+		}
+		l.Version = buffer.SCANLINE_HDR_VERSION
+		l.DecimRateM1 = buffer.DecimRateM1(val["decim"] - 1)
+		l.Extra = uint16(val["decim_mode"])<<14 | uint16(val["skip"])&0x3fff
+		a := azi - h.HeadingOffset/360
+		a -= math.Floor(a)
+		l.ACPCount = l.ARPCount*uint32(acps) + uint32(math.Round(a*acps))
+		l.ClockSinceACP = math.MaxUint32
+		l.Samples = decodeSamples(blob, l.TrigCount)
+		lines = append(lines, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines) > 0 {
+		h.ARP = lines[0].ARPCount
+	}
+	h.NumLines, h.First, h.Last = len(lines), fromSeconds(ts), fromSeconds(tsEnd)
+	return h, buffer.NewSweep(h.ARP, h.Ranging, lines, h.First, h.Last), nil
+}
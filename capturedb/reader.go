@@ -0,0 +1,110 @@
+package capturedb
+
+// Reading sweeps from a capture database.
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/buffer"
+	"math"
+	"time"
+)
+
+// SweepInfo summarizes a sweep in the database.
+type SweepInfo struct {
+	Key      int64     // sweep_key
+	ARP      uint32    // ARP count at start of sweep
+	First    time.Time // time of first pulse
+	Last     time.Time // time of last pulse
+	NumLines int       // number of pulses
+}
+
+// fromSeconds returns the time s seconds after 1970-01-01 UTC.
+func fromSeconds(s float64) time.Time {
+	sec, frac := math.Modf(s)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// Sweeps returns a summary of the sweeps in the database which began
+// in the interval [from, to), in order of time.  A zero to means no
+// upper limit.
+func (d *DB) Sweeps(from, to time.Time) (sweeps []SweepInfo, err error) {
+	end := math.Inf(1)
+	if !to.IsZero() {
+		end = seconds(to)
+	}
+	if d.layout == LAYOUT_DIGDAR {
+		return d.digdarSweeps(seconds(from), end)
+	}
+	rows, err := d.db.Query("SELECT sweep_key, num_arp, ts, ts_end, np FROM sweeps WHERE ts >= ? AND ts < ? ORDER BY ts", seconds(from), end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s SweepInfo
+		var ts, tsEnd float64
+		if err = rows.Scan(&s.Key, &s.ARP, &ts, &tsEnd, &s.NumLines); err != nil {
+			return nil, err
+		}
+		s.First, s.Last = fromSeconds(ts), fromSeconds(tsEnd)
+		sweeps = append(sweeps, s)
+	}
+	return sweeps, rows.Err()
+}
+
+// ReadSweep returns the sweep with the given key, and a header
+// describing it as if it had been read from a sweep file.  The
+// header's Version is 0, since the database has no format version.
+// Values a LAYOUT_DIGDAR database doesn't record are reckoned or left
+// zero, as described in digdar.go.
+func (d *DB) ReadSweep(key int64) (*archive.Header, *buffer.Sweep, error) {
+	if d.layout == LAYOUT_DIGDAR {
+		return d.readDigdar(key)
+	}
+	h := &archive.Header{HdrVersion: buffer.SCANLINE_HDR_VERSION}
+	var ts, tsEnd, clockRate float64
+	var ns, decim, decimMode, skip int
+	err := d.db.QueryRow(`SELECT s.num_arp, s.ts, s.ts_end, m.ns, m.decim, m.decim_mode, m.skip, m.trig_delay, m.range_delay, m.clock_rate,
+		m.radar, m.pulse, m.profile, m.prf, m.acps, m.power, m.heading, m.beamwidth, m.rpm
+		FROM sweeps s JOIN modes m ON s.mode = m.mode WHERE s.sweep_key = ?`, key).Scan(
+		&h.ARP, &ts, &tsEnd, &ns, &decim, &decimMode, &skip, &h.Ranging.TrigDelay, &h.Ranging.RangeDelay, &clockRate,
+		&h.Model, &h.Pulse, &h.Profile, &h.PRF, &h.ACPsPerRotation, &h.Power, &h.HeadingOffset, &h.Beamwidth, &h.RPM)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("no sweep with key %d", key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	h.First, h.Last, h.ClockRate, h.Uniform = fromSeconds(ts), fromSeconds(tsEnd), uint32(clockRate), true
+	rows, err := d.db.Query("SELECT num_trig, trig_clock, num_acp, acp_clock, num_arp, samples FROM pulses WHERE sweep_key = ? ORDER BY rowid", key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var lines []buffer.Scanline
+	for rows.Next() {
+		var l buffer.Scanline
+		var acpClock uint64
+		var blob []byte
+		if err = rows.Scan(&l.TrigCount, &l.TrigClock, &l.ACPCount, &acpClock, &l.ARPCount, &blob); err != nil {
+			return nil, nil, err
+		}
+		l.Version = buffer.SCANLINE_HDR_VERSION
+		l.DecimRateM1 = buffer.DecimRateM1(decim - 1)
+		l.Extra = uint16(decimMode)<<14 | uint16(skip)&0x3fff
+		if d := l.TrigClock - acpClock; acpClock <= l.TrigClock && d < 1<<32 {
+			l.ClockSinceACP = uint32(d)
+		} else {
+			l.ClockSinceACP = math.MaxUint32
+		}
+		l.Samples = decodeSamples(blob, l.TrigCount)
+		lines = append(lines, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	h.NumLines = len(lines)
+	return h, buffer.NewSweep(h.ARP, h.Ranging, lines, h.First, h.Last), nil
+}
@@ -0,0 +1,528 @@
+package main
+
+// ogdar sub-commands.  These are run instead of the digitizer when
+// ogdar is invoked as
+//
+//    ogdar COMMAND ARGS...
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/asterix"
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/calib"
+	"github.com/jbrzusto/ogdar/capturedb"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/navico"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// command is an ogdar sub-command
+type command struct {
+	args     string                    // summary of arguments, for usage message
+	help     string                    // one-line description, for usage message
+	needFPGA bool                      // if true, the FPGA is initialized before run is called
+	run      func(args []string) error // does the work
+}
+
+// commands maps sub-command names to their implementations.  It is
+// filled in by init() to avoid an initialization loop with cmdHelp.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"calibrate":    {"[-tries N] [-apply]", "capture raw trigger, ACP and ARP channels and recommend pulse detector settings", true, cmdCalibrate},
+		"br24dump":     {"[-n N] [ADDR]", "listen for Navico BR24 spokes on UDP address ADDR (default: " + navico.DATA_ADDR + ") and describe each datagram", false, cmdBR24Dump},
+		"cat240dump":   {"[-n N] ADDR", "listen for ASTERIX CAT240 video on UDP address ADDR (unicast or multicast) and describe each message", false, cmdCat240Dump},
+		"check-config": {"[FILE]", "check a config file (default: the one ogdar would use) and report every problem, without touching the FPGA", false, cmdCheckConfig},
+		"dbinfo":       {"DB [KEY...]", "list the sweeps recorded in a capture database, or describe those with the given keys", false, cmdDBInfo},
+		"help":         {"", "show this message", false, cmdHelp},
+		"migrate":      {"[-o FILE] [-f] OLDFILE", "rewrite OLDFILE (e.g. a digdar.toml) as an ogdar config file (default: ogdar.toml)", false, cmdMigrate},
+		"setup":        {"[-o FILE] [-rotations N]", "interactively measure the radar's signals and write a config file for it (default: ogdar.toml)", true, cmdSetup},
+		"setreg":       {"NAME VALUE", "set the FPGA register NAME to VALUE (negative values allowed for thresholds)", true, cmdSetReg},
+		"radars":       {"", "list the radar models in the built-in catalogue, which can be used for Model in [radar]", false, cmdRadars},
+		"regdump":      {"[FILE]", "write all readable FPGA registers to FILE (default: stdout) in ogdar.toml [digdar] format", true, cmdRegDump},
+		"regload":      {"FILE", "write rw registers from the [digdar] section of FILE to the FPGA and verify them", true, cmdRegLoad},
+		"replay":       {"[-speed X] [-loop] [-q] [-stream ADDR] [-asterix ADDR] [-navico ADDR] FILE|DIR...", "run archived sweep files through ogdar's pipeline in place of the FPGA, with their recorded timing, sending them to the network outputs configured in [stream], [asterix] and [navico]", false, cmdReplay},
+		"sweepinfo":    {"FILE...", "describe archived sweep files", false, cmdSweepInfo},
+		"scope":        {"[-n N] [-timeout T] [-json] SOURCE [FILE]", "capture raw video, trigger, ACP and ARP channels once, triggered by SOURCE (immediate, trig, acp or arp), as CSV or JSON", true, cmdScope},
+	}
+}
+
+// runCommand runs the sub-command named by args[0], with arguments
+// args[1:].  found is false if there is no such command.
+func runCommand(args []string) (found bool, err error) {
+	c, ok := commands[args[0]]
+	if !ok {
+		return false, nil
+	}
+	if c.needFPGA {
+		Init()
+		defer Fini()
+	}
+	return true, c.run(args[1:])
+}
+
+// cmdHelp prints a summary of ogdar's sub-commands.
+func cmdHelp(args []string) error {
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Println("Usage: ogdar [OPTIONS] [COMMAND ARGS...]\n\nWith no command, run the digitizer.  Options are:")
+	fmt.Println()
+	flag.CommandLine.SetOutput(os.Stdout)
+	flag.PrintDefaults()
+	fmt.Printf("\nConfig file values can be overridden by environment variables named\n%sSECTION_KEY, e.g. %sDIGDAR_NUMSAMP.\n\nCommands are:\n", envPrefix, envPrefix)
+	for _, n := range names {
+		c := commands[n]
+		fmt.Printf("\n  %s %s\n      %s\n", n, c.args, c.help)
+	}
+	return nil
+}
+
+// cmdSetReg sets a single register by name.
+func cmdSetReg(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: ogdar setreg NAME VALUE")
+	}
+	f, ok := FindRegField(args[0])
+	if !ok {
+		return fmt.Errorf("no register named %q", args[0])
+	}
+	if f.Mode == "r" {
+		return fmt.Errorf("register %s is read-only", f.Name)
+	}
+	v, err := f.Parse(args[1])
+	if err != nil {
+		return err
+	}
+	old := f.Get()
+	f.Set(v)
+	if f.Mode == "p" {
+		fmt.Printf("%s <- %s\n", f.Name, f.Format(v))
+		return nil
+	}
+	now := f.Get()
+	fmt.Printf("%s: %s -> %s\n", f.Name, f.Format(old), f.Format(now))
+	if !f.Same(v, now) {
+		return fmt.Errorf("%s reads back as %s, not %s", f.Name, f.Format(now), f.Format(v))
+	}
+	return nil
+}
+
+// cmdRegDump writes all readable registers as a TOML file with a
+// [digdar] section, which can be read by loadConfig or cmdRegLoad.
+func cmdRegDump(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ogdar regdump [FILE]")
+	}
+	out := os.Stdout
+	if len(args) == 1 {
+		var err error
+		if out, err = os.Create(args[0]); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	fmt.Fprintf(out, "# FPGA registers dumped by 'ogdar regdump' at %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(out, "#\n# Registers marked read-only are ignored by 'ogdar regload'.\n\n")
+	writeDigdarSection(out, true, fpgaValue)
+	return nil
+}
+
+// cmdRegLoad writes the rw registers found in the [digdar] section
+// of a TOML file to the FPGA, then reads them back, reporting any
+// which do not hold the written value.
+func cmdRegLoad(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: ogdar regload FILE")
+	}
+	c, warnings, err := readConfigFile(args[0], false)
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	if err != nil {
+		return err
+	}
+	if len(c.Digdar) == 0 {
+		return fmt.Errorf("%s: no [digdar] section found", args[0])
+	}
+	ws := c.Regs
+	bad := 0
+	// parseDigdar returns registers in storage order, so the result doesn't depend on map order
+	for _, w := range ws {
+		w.f.Set(w.v)
+	}
+	for _, w := range ws {
+		if now := w.f.Get(); !w.f.Same(w.v, now) {
+			fmt.Printf("%s: wrote %s but read back %s\n", w.f.Name, w.f.Format(w.v), w.f.Format(now))
+			bad++
+		}
+	}
+	fmt.Printf("wrote %d registers\n", len(ws))
+	if bad > 0 {
+		return fmt.Errorf("%d register(s) not set correctly", bad)
+	}
+	return nil
+}
+
+// cmdCheckConfig reads and validates a config file, reporting every
+// problem found in it.
+func cmdCheckConfig(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ogdar check-config [FILE]")
+	}
+	var path string
+	if len(args) == 1 {
+		path = args[0]
+	} else {
+		var err error
+		if path, err = findConfigFile(); err != nil {
+			return err
+		}
+	}
+	c, warnings, err := readConfigFile(path, true)
+	for _, w := range warnings {
+		fmt.Printf("%s: %s\n", path, w)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: OK; %d FPGA register values, radar %q\n", path, len(c.Regs), c.Radar.Model)
+	for _, p := range c.Profiles.List {
+		fmt.Printf("  profile %s: PRF %d, %d register values\n", p.Name, p.PRF, len(p.Regs))
+	}
+	return nil
+}
+
+// cmdRadars lists the catalogue of radar models.
+func cmdRadars(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: ogdar radars")
+	}
+	writeRadarModels(os.Stdout)
+	return nil
+}
+
+// printEffectiveConfig implements the --print-config option: it
+// writes the configuration ogdar would use, with the source of each
+// value, to stdout.  Warnings go to stderr, so that the output can be
+// saved as a config file.
+func printEffectiveConfig() error {
+	path, err := findConfigFile()
+	var c *configFile
+	var warnings []string
+	switch {
+	case err == errConfigNotFound:
+		// as when ogdar runs without a config file
+		fmt.Fprintln(os.Stderr, "no config file found, so ogdar would use its (likely bogus) defaults")
+		path = "default config"
+		c, warnings, err = defaultConfig(true)
+	case err != nil:
+		return err
+	default:
+		c, warnings, err = readConfigFile(path, true)
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, w)
+	}
+	if err != nil {
+		return err
+	}
+	writeEffectiveConfig(os.Stdout, c)
+	return nil
+}
+
+// cmdMigrate rewrites a config file, such as a digdar.toml from the C
+// version of digdar, in ogdar's format, translating digdar's keys and
+// dropping unknown ones.
+func cmdMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	out := fs.String("o", "ogdar.toml", "config file to write")
+	force := fs.Bool("f", false, "overwrite the config file if it exists")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: ogdar migrate [-o FILE] [-f] OLDFILE")
+	}
+	in := fs.Arg(0)
+	c, warnings, err := readConfigFile(in, false)
+	for _, w := range warnings {
+		fmt.Printf("%s: %s\n", in, w)
+	}
+	if err != nil {
+		return fmt.Errorf("%v\n%s not written", err, *out)
+	}
+	if _, err := os.Stat(*out); err == nil && !*force {
+		return fmt.Errorf("%s exists; use -f to overwrite it", *out)
+	}
+	vals := make(map[*RegField]uint64, len(c.Regs))
+	for _, rc := range c.Regs {
+		vals[rc.f] = rc.v
+	}
+	val := func(f *RegField) (uint64, bool) {
+		v, ok := vals[f]
+		return v, ok
+	}
+	if err := writeConfig(*out, fmt.Sprintf("Migrated from %s by 'ogdar migrate'", in), c, val); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", *out)
+	return nil
+}
+
+// cmdScope captures raw samples from all four channels and writes
+// them as CSV or JSON.
+func cmdScope(args []string) error {
+	fs := flag.NewFlagSet("scope", flag.ContinueOnError)
+	n := fs.Int("n", 0, "number of samples to capture (default: current NumSamp)")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for a trigger")
+	asJSON := fs.Bool("json", false, "write JSON instead of CSV")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("usage: ogdar scope [-n N] [-timeout T] [-json] SOURCE [FILE]")
+	}
+	t, err := ParseTrigType(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sc, err := Scope(t, *n, *timeout)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if fs.NArg() == 2 {
+		if out, err = os.Create(fs.Arg(1)); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if *asJSON {
+		return json.NewEncoder(out).Encode(sc)
+	}
+	return sc.WriteCSV(out)
+}
+
+// cmdCalibrate analyses raw captures of the trigger, ACP and ARP
+// channels and recommends thresholds and latencies, which are
+// written to the FPGA only if the user asks for it and confirms.
+func cmdCalibrate(args []string) error {
+	fs := flag.NewFlagSet("calibrate", flag.ContinueOnError)
+	tries := fs.Int("tries", 30, "maximum number of captures made while looking for trigger and ARP pulses")
+	apply := fs.Bool("apply", false, "after confirmation, write recommended settings to the FPGA")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// only ACPsPerRotation is needed from the config file; loadConfig
+	// would also write its [digdar] values to the FPGA, which is left
+	// alone until the user confirms the recommended settings
+	acps := 450 // as in defaultSettings
+	path, err := findConfigFile()
+	if err == nil {
+		var c *configFile
+		if c, _, err = readConfigFile(path, true); err == nil && c != nil && c.Radar.ACPsPerRotation > 0 {
+			acps = int(c.Radar.ACPsPerRotation)
+		}
+	}
+	if err != nil {
+		if err != errConfigNotFound {
+			fmt.Println(err)
+		}
+		fmt.Printf("using default of %d ACPs per rotation\n", acps)
+	}
+	r, err := calib.Calibrate(acps, *tries)
+	if err != nil {
+		return err
+	}
+	r.WriteSummary(os.Stdout)
+	fmt.Println("\nRecommended settings:")
+	r.WriteTOML(os.Stdout)
+	if !*apply || !confirm("\nWrite these settings to the FPGA?") {
+		return nil
+	}
+	r.Apply()
+	return nil
+}
+
+// cmdSweepInfo prints the header of each archived sweep file, and a
+// summary of its scanlines.
+func cmdSweepInfo(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ogdar sweepinfo FILE...")
+	}
+	for _, path := range args {
+		h, sw, err := archive.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		printSweepInfo(path, h, sw)
+	}
+	return nil
+}
+
+// printSweepInfo prints the header h of the sweep sw, called name, and
+// a summary of its scanlines.
+func printSweepInfo(name string, h *archive.Header, sw *buffer.Sweep) {
+	fmt.Printf("%s:\n  radar %q, pulse %q, profile %q, PRF %d, %d ACPs per rotation\n", name, h.Model, h.Pulse, h.Profile, h.PRF, h.ACPsPerRotation)
+	fmt.Printf("  ARP %d, %s to %s (%.3f s)\n", h.ARP, h.First.UTC().Format(time.RFC3339Nano), h.Last.UTC().Format(time.RFC3339Nano), h.Last.Sub(h.First).Seconds())
+	fmt.Printf("  %d scanlines", sw.NumLines())
+	if sw.NumLines() > 0 {
+		first, last := sw.Line(0), sw.Line(sw.NumLines()-1)
+		fmt.Printf(" of %d samples; triggers %d...%d; range %.1f...%.1f m", first.NumSamples(), first.TrigCount, last.TrigCount, sw.FirstRange(), sw.MaxRange())
+		if !h.Uniform {
+			fmt.Print(" (for first scanline; sampling varies)")
+		}
+	}
+	fmt.Println()
+}
+
+// cmdDBInfo lists the sweeps in a capture database, or describes the
+// sweeps with the given keys as sweepinfo does for files.
+func cmdDBInfo(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ogdar dbinfo DB [KEY...]")
+	}
+	// capturedb.Open would create a missing database
+	if _, err := os.Stat(args[0]); err != nil {
+		return err
+	}
+	db, err := capturedb.Open(args[0], "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if len(args) == 1 {
+		sweeps, err := db.Sweeps(time.Time{}, time.Time{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d sweeps (%s layout)\n", len(sweeps), db.Layout())
+		for _, s := range sweeps {
+			fmt.Printf("  key %d: ARP %d, %s, %.3f s, %d scanlines\n", s.Key, s.ARP, s.First.UTC().Format(time.RFC3339Nano), s.Last.Sub(s.First).Seconds(), s.NumLines)
+		}
+		return nil
+	}
+	for _, a := range args[1:] {
+		key, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad sweep key %q", a)
+		}
+		h, sw, err := db.ReadSweep(key)
+		if err != nil {
+			return err
+		}
+		printSweepInfo(fmt.Sprintf("sweep %d", key), h, sw)
+	}
+	return nil
+}
+
+// cmdCat240Dump receives ASTERIX CAT240 video messages, such as those
+// sent by ogdar, and prints a line for each.
+func cmdCat240Dump(args []string) error {
+	fs := flag.NewFlagSet("cat240dump", flag.ContinueOnError)
+	n := fs.Int("n", 0, "stop after N messages (default: run until interrupted)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: ogdar cat240dump [-n N] ADDR")
+	}
+	conn, err := listenUDP(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b := make([]byte, 1<<16)
+	for i := 0; *n == 0 || i < *n; i++ {
+		m, from, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return err
+		}
+		v, err := asterix.Decode(b[:m])
+		if err != nil {
+			fmt.Printf("%s: %d bytes: %v\n", from, m, err)
+			continue
+		}
+		max := uint16(0)
+		for _, c := range v.Cells {
+			if c > max {
+				max = c
+			}
+		}
+		fmt.Printf("%s: SAC/SIC %d/%d #%d az %.2f...%.2f, %d %d-bit cells of %.1f ns from cell %d, max %d, at %s\n",
+			from, v.SAC, v.SIC, v.Index, float64(v.StartAz)*360/asterix.AZIMUTHS_PER_CIRCLE, float64(v.EndAz)*360/asterix.AZIMUTHS_PER_CIRCLE,
+			len(v.Cells), v.Bits, v.CellDur*1e9, v.StartRange, max, v.TimeOfDay)
+	}
+	return nil
+}
+
+// cmdBR24Dump receives Navico BR24 spoke datagrams, such as those sent
+// by ogdar, and prints a line for each.
+func cmdBR24Dump(args []string) error {
+	fs := flag.NewFlagSet("br24dump", flag.ContinueOnError)
+	n := fs.Int("n", 0, "stop after N datagrams (default: run until interrupted)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New("usage: ogdar br24dump [-n N] [ADDR]")
+	}
+	a := navico.DATA_ADDR
+	if fs.NArg() == 1 {
+		a = fs.Arg(0)
+	}
+	conn, err := listenUDP(a)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b := make([]byte, 1<<16)
+	for i := 0; *n == 0 || i < *n; i++ {
+		m, from, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return err
+		}
+		sp := navico.Decode(b[:m])
+		if len(sp) == 0 {
+			fmt.Printf("%s: %d bytes: no valid spokes\n", from, m)
+			continue
+		}
+		first, last := sp[0], sp[len(sp)-1]
+		max := uint8(0)
+		for _, s := range sp {
+			for _, c := range s.Cells {
+				if c > max {
+					max = c
+				}
+			}
+		}
+		fmt.Printf("%s: %d spokes #%d...#%d, angle %.2f...%.2f, range %.0f m, max %d\n",
+			from, len(sp), first.Count, last.Count, float64(first.Angle)*360/navico.ANGLES, float64(last.Angle)*360/navico.ANGLES, first.Range, max)
+	}
+	return nil
+}
+
+// listenUDP returns a socket receiving datagrams sent to addr, joining
+// its group if it is a multicast address.
+func listenUDP(addr string) (*net.UDPConn, error) {
+	a, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	if a.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp4", nil, a)
+	}
+	return net.ListenUDP("udp4", a)
+}
@@ -3,58 +3,284 @@ package main
 // this file contains all the code that directly uses the viper package
 // hopefully the go build system can avoid having to rebuild this every time.
 import (
-	. "github.com/jbrzusto/ogdar/fpga"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/asterix"
+	"github.com/jbrzusto/ogdar/azimuth"
+	"github.com/jbrzusto/ogdar/monitor"
+	"github.com/jbrzusto/ogdar/navico"
+	"github.com/jbrzusto/ogdar/stream"
+	"github.com/jbrzusto/ogdar/timing"
+	"github.com/jbrzusto/ogdar/web"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
+// errConfigNotFound is returned by loadConfig when there is no config file.
+var errConfigNotFound = errors.New("config file 'ogdar.toml' not found")
+
+// configDirs are searched in order for the config file.  /opt is the
+// top-level of the SD card on the current redpitaya linux image; the
+// current directory is for convenience.
+var configDirs = []string{"/opt", "."}
+
+// configPath is the config file given by the --config flag; "" means
+// none was given.
+var configPath string
+
+// findConfigFile returns the path to the config file read by
+// loadConfig: configPath or, if that is empty, the file named by
+// $OGDAR_CONFIG.  If neither is given, it is the first 'ogdar.toml' in
+// configDirs or, failing that, the first 'digdar.toml'.  It returns
+// errConfigNotFound if there is no such file, except that a file
+// given explicitly but missing is reported as such.
+func findConfigFile() (string, error) {
+	path, from := configPath, "--config"
+	if path == "" {
+		path, from = os.Getenv(envConfig), "$"+envConfig
+	}
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("config file %s given by %s: %v", path, from, err)
+		}
+		return path, nil
+	}
+	for _, name := range []string{"ogdar.toml", "digdar.toml"} {
+		for _, dir := range configDirs {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", errConfigNotFound
+}
+
 // loadConfig reads configuration from a TOML-formatted file called 'ogdar.toml'
-// It looks for this in the /opt folder (which is the top-level of the SD card, on the
-// current redpitaya linux image) and then in the current directory,
-// for convenience.  The file must be called "ogdar.toml"
-// Returns true if a config file was read.
-func loadConfig() bool {
-	viper.SetConfigName("ogdar") // name of config file (without extension)
-	viper.AddConfigPath("/opt")  // path to look for the config file in
-	viper.AddConfigPath(".")     // optionally look for config in the working directory
-	err := viper.ReadInConfig()  // Find and read the config file
-	if err != nil {              // Error reading the config file
-		return false
+// It looks for this in the /opt folder and then in the current directory,
+// unless another file is given by --config or $OGDAR_CONFIG
+// (see findConfigFile).  If there is no "ogdar.toml", a "digdar.toml" from
+// the C version of digdar is read instead.  Values in the file are
+// overridden by environment variables (see env.go).
+// Returns errConfigNotFound if there is no config file, or a *configErrors
+// listing every problem found in it.  In either case, nothing is changed.
+func loadConfig() error {
+	path, err := findConfigFile()
+	if err != nil {
+		return err
+	}
+	viper.SetConfigFile(path)
+	viper.SetConfigType("toml")
+	if err := viper.ReadInConfig(); err != nil { // Error reading the config file
+		return &configErrors{path, []error{err}}
 	}
+	c, warnings, errs := decodeConfig(viper.GetViper(), true)
+	for _, w := range warnings {
+		fmt.Printf("%s: %s\n", path, w)
+	}
+	if filepath.Base(path) == "digdar.toml" {
+		fmt.Printf("%s is a digdar config file; use 'ogdar migrate %s' to convert it to ogdar.toml\n", path, path)
+	}
+	if len(errs) > 0 {
+		return &configErrors{path, errs}
+	}
+	applyConfig(c)
+	return nil
+}
+
+// applyConfig stores the values in c in Regs and the globals.
+func applyConfig(c *configFile) {
 	// store the values in Regs; this will be pulse detection thresholds, decimation rates
 	// and so on.  See 'ogdar.toml' for details.
-	viper.UnmarshalKey("digdar", Regs)
-	viper.UnmarshalKey("radar", &Radar)
-	return true
+	for _, rc := range c.Profiles.regsFor(c.Profiles.Active) {
+		rc.f.Set(rc.v)
+	}
+	Radar, MonitorConfig, ARPConfig, TimeConfig, ArchiveConfig = c.Radar, c.Monitor, c.ARP, c.Time, c.Archive
+	StreamConfig, AsterixConfig, NavicoConfig, WebConfig = c.Stream, c.Asterix, c.Navico, c.Web
+	Profiles, ActiveProfile = c.Profiles, c.Profiles.Active
+}
+
+// defaultSettings are sane defaults for critical digitizing registers,
+// used when there is no config file.  There is absolutely no guarantee
+// that the values here make any sense for a particular radar, but they
+// work for at least one of the test radars (a Furuno FR-8252 with CHS
+// Lab's front-end board.)
+var defaultSettings = map[string]interface{}{
+	"digdar": map[string]interface{}{
+		"decrate":          1,
+		"numsamp":          4000,
+		"options":          7,
+		"trigsource":       2,
+		"trigthreshexcite": -6550,
+		"trigthreshrelax":  -8000,
+		"triglatency":      12500,
+		"trigdelay":        30,
+		"acpthreshexcite":  -1638,
+		"acpthreshrelax":   1228,
+		"acplatency":       500000,
+		"arpthreshexcite":  -1638,
+		"arpthreshrelax":   1228,
+		"arplatency":       125000000,
+	},
+	"radar": map[string]interface{}{
+		"model":           "WARNING: using default (bogus!) config because file ogdar.toml not found",
+		"prf":             2100,
+		"acpsperrotation": 450,
+		"power":           25000,
+	},
 }
 
-// unsign gets around not being able to cast signed *constants*
-// into an unsigned int.
-func unsign (x int32) uint32 {
-	return uint32(x)
+// defaultConfig returns the config used when there is no config file:
+// defaultSettings, overridden by environment variables if useEnv is
+// true.  Values from defaultSettings have no recorded source, so
+// writeEffectiveConfig shows them as "default".
+func defaultConfig(useEnv bool) (c *configFile, warnings []string, err error) {
+	v := viper.New()
+	v.MergeConfigMap(defaultSettings)
+	c, warnings, errs := decodeConfig(v, useEnv)
+	for k, src := range c.Sources {
+		if src == "" {
+			delete(c.Sources, k)
+		}
+	}
+	if len(errs) > 0 {
+		err = &configErrors{"default config", errs}
+	}
+	return
 }
 
-// setDefaultConfig sets sane defaults for critical digitizing registers.
-// This function should only be called if no other config information is
-// available!  There is absolutely no guarantee that the values here make
-// any sense for a particular radar, but they work for at least one of
-// the test radars (a Furuno FR-8252 with CHS Lab's front-end board.)
+// setDefaultConfig stores the config from defaultConfig in Regs and
+// the globals.  This function should only be called if no other
+// config information is available!  Environment variables override
+// the defaults, as they would values in a config file, unless any of
+// them is invalid.
 func setDefaultConfig() {
-	Regs.DecRate = 1
-	Regs.NumSamp = 4000
-	Regs.Options = 7
-	Regs.TrigSource = 2
-	Regs.TrigThreshExcite = unsign(-6550)
-	Regs.TrigThreshRelax = unsign(-8000)
-	Regs.TrigLatency = 12500
-	Regs.TrigDelay = 30
-	Regs.ACPThreshExcite = unsign(-1638)
-	Regs.ACPThreshRelax = 1228
-	Regs.ACPLatency = 500000
-	Regs.ARPThreshExcite = unsign(-1638)
-	Regs.ARPThreshRelax = 1228
-	Regs.ARPLatency = 125000000
-	Radar.Model = "WARNING: using default (bogus!) config because file ogdar.toml not found"
-	Radar.PRF = 2100
-	Radar.ACPsPerRotation = 450
-	Radar.Power = 25000
+	c, warnings, err := defaultConfig(true)
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	if err != nil {
+		fmt.Printf("%v\nignoring environment variables\n", err)
+		c, _, _ = defaultConfig(false)
+	}
+	applyConfig(c)
+}
+
+// configFile holds the sections of a config file, decoded as by
+// loadConfig but without being stored in Regs or the globals.
+type configFile struct {
+	Digdar   map[string]interface{} // [digdar] values, keyed by lower-cased register name
+	Regs     []regChange            // valid values of rw registers from [digdar], in storage order
+	Radar    radar
+	Monitor  monitor.Config
+	ARP      azimuth.EstimatorConfig
+	Time     timing.Config
+	Archive  archive.Config
+	Stream   stream.Config
+	Asterix  asterix.Config
+	Navico   navico.Config
+	Web      web.Config
+	Profiles profileSet
+	Sources  map[string]string // source of each value given, keyed by lower-cased section.key; see decodeConfig
+}
+
+// readConfigFile reads the config file at path.  Sections other than
+// [digdar], and values within them, which are missing from the file
+// take their current values.  If useEnv is true, values in the file
+// are overridden by environment variables, as they are for loadConfig.
+// warnings describe keys which were translated from digdar's names, or
+// ignored.  If the file can't be read, or has any invalid values, err
+// is a *configErrors listing every problem.
+func readConfigFile(path string, useEnv bool) (c *configFile, warnings []string, err error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("toml")
+	if err = v.ReadInConfig(); err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		return nil, nil, &configErrors{path, []error{err}}
+	}
+	c, warnings, errs := decodeConfig(v, useEnv)
+	if len(errs) > 0 {
+		err = &configErrors{path, errs}
+	}
+	return
+}
+
+// decodeConfig decodes and validates the settings read by v, after
+// translating digdar keys and dropping unknown ones (see
+// normalizeSettings), and, if useEnv is true, applying overrides from
+// environment variables.  The source of each value, either the file
+// or an environment variable, is recorded in c.Sources.  errs holds
+// every problem found.
+func decodeConfig(v *viper.Viper, useEnv bool) (c *configFile, warnings []string, errs []error) {
+	settings, warnings := normalizeSettings(v.AllSettings())
+	sources := make(map[string]string)
+	addSources(sources, "", settings, v.ConfigFileUsed())
+	if useEnv {
+		env, vars, w := envSettings()
+		warnings = append(warnings, w...)
+		mergeSettings(settings, env)
+		for k, name := range vars {
+			sources[k] = name
+		}
+	}
+	n := viper.New()
+	n.MergeConfigMap(settings)
+	c = &configFile{Digdar: n.GetStringMap("digdar"), Radar: Radar, Monitor: MonitorConfig, ARP: ARPConfig, Time: TimeConfig, Archive: ArchiveConfig, Stream: StreamConfig, Asterix: AsterixConfig, Navico: NavicoConfig, Web: WebConfig, Sources: sources}
+	c.Regs, errs = parseDigdar(c.Digdar, "digdar")
+	errs = append(errs, checkDigdar(c.Regs, "digdar")...)
+	// values for a catalogued model are the defaults for those in [radar]
+	model, pulse := c.Radar.Model, ""
+	if n.IsSet("radar.model") {
+		model = n.GetString("radar.model")
+	}
+	if n.IsSet("radar.pulse") {
+		pulse = n.GetString("radar.pulse")
+	}
+	if m := findRadarModel(model); m != nil {
+		for _, f := range m.applyTo(&c.Radar, pulse) {
+			if k := "radar." + strings.ToLower(f); sources[k] == "" {
+				sources[k] = "model " + m.Name
+			}
+		}
+	}
+	for _, s := range []struct {
+		key string
+		dst interface{}
+	}{{"radar", &c.Radar}, {"monitor", &c.Monitor}, {"arp", &c.ARP}, {"time", &c.Time}, {"archive", &c.Archive}, {"stream", &c.Stream}, {"asterix", &c.Asterix}, {"navico", &c.Navico}, {"web", &c.Web}} {
+		err := n.UnmarshalKey(s.key, s.dst)
+		if err == nil {
+			continue
+		}
+		if me, ok := err.(*mapstructure.Error); ok {
+			for _, e := range me.Errors {
+				errs = append(errs, errorf(s.key, "%s", e))
+			}
+		} else {
+			errs = append(errs, errorf(s.key, "%v", err))
+		}
+	}
+	errs = append(errs, checkConfig(c)...)
+	errs = append(errs, checkRadar(&c.Radar)...)
+	warnings = append(warnings, polarityWarnings(&c.Radar, c.Regs)...)
+	var perrs []error
+	c.Profiles, perrs = decodeProfiles(n.GetStringMap("profiles"))
+	c.Profiles.Base = c.Regs
+	errs = append(errs, perrs...)
+	errs = append(errs, checkProfiles(c)...)
+	return
+}
+
+// watchConfig arranges for changed to be called with the path of the
+// config file found by loadConfig whenever that file is written.
+func watchConfig(changed func(path string)) {
+	viper.OnConfigChange(func(e fsnotify.Event) { changed(e.Name) })
+	viper.WatchConfig()
 }
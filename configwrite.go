@@ -0,0 +1,280 @@
+package main
+
+// Writing configuration files in the format read by loadConfig.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/asterix"
+	"github.com/jbrzusto/ogdar/azimuth"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/monitor"
+	"github.com/jbrzusto/ogdar/navico"
+	"github.com/jbrzusto/ogdar/stream"
+	"github.com/jbrzusto/ogdar/timing"
+	"github.com/jbrzusto/ogdar/web"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// regValue returns the value to write for register f, and false if
+// there is none.
+type regValue func(f *RegField) (uint64, bool)
+
+// fpgaValue is a regValue giving the register's current value in the
+// FPGA.
+func fpgaValue(f *RegField) (uint64, bool) {
+	return f.Get(), true
+}
+
+// writeDigdarSection writes a [digdar] section holding the values of
+// the FPGA's rw registers given by val, each preceded by its
+// description as a comment.  If readOnly is true, the values of
+// read-only registers are also written; loadConfig and regload ignore
+// these.
+func writeDigdarSection(w io.Writer, readOnly bool, val regValue) {
+	fmt.Fprintln(w, "[digdar]")
+	for i := range RegFields {
+		f := &RegFields[i]
+		if !f.Readable() || (!readOnly && !f.Writable()) {
+			continue
+		}
+		v, ok := val(f)
+		if !ok {
+			continue
+		}
+		ro := ""
+		if !f.Writable() {
+			ro = "(read-only) "
+		}
+		fmt.Fprintf(w, "\n# %s%s\n%s = %s\n", ro, f.Desc, f.Name, f.Format(v))
+	}
+}
+
+// writeRadarSection writes a [radar] section holding the values in r.
+// If r.Model is in the catalogue, values which match the catalogue's
+// are commented out, so that they follow the catalogue's value for
+// Pulse; otherwise, unknown (zero) values are commented out, so that
+// they don't override the catalogue if Model is changed.
+func writeRadarSection(w io.Writer, r *radar) {
+	var cat radar
+	m := findRadarModel(r.Model)
+	if m != nil {
+		m.applyTo(&cat, r.Pulse)
+	}
+	field := func(desc, key string, val, catVal interface{}) {
+		prefix := ""
+		switch {
+		case m != nil && val == catVal:
+			prefix = "# "
+			desc += " (commented out: same as the catalogue's value)"
+		case m == nil && val == catVal:
+			prefix = "# "
+			desc += " (commented out: unknown)"
+		}
+		fmt.Fprintf(w, "\n# %s\n%s%s = %s\n", desc, prefix, key, tomlValue(val))
+	}
+	fmt.Fprintf(w, "[radar]\n\n# radar make/model; displayed on the console and possibly included in output files.\n# Models listed by 'ogdar radars' fill in the values below.\nModel = %q\n", r.Model)
+	if m != nil {
+		fmt.Fprintf(w, "\n# pulse length in use: one of %s; selects the PRF\nPulse = %q\n", m.pulseNames(), r.Pulse)
+	}
+	field("approximate Pulse Repetition Frequency, in Hz, for the mode being digitized", "PRF", r.PRF, cat.PRF)
+	field("number of ACPs in one rotation of the antenna", "ACPsPerRotation", r.ACPsPerRotation, cat.ACPsPerRotation)
+	field("transmitted power, in watts", "Power", r.Power, cat.Power)
+	field("direction of trigger pulses: \"positive\" or \"negative\"", "TrigPolarity", r.TrigPolarity, cat.TrigPolarity)
+	field("direction of echoes in the video signal: \"positive\" or \"negative\"", "VideoPolarity", r.VideoPolarity, cat.VideoPolarity)
+	field("horizontal beamwidth of the antenna, in degrees", "Beamwidth", r.Beamwidth, cat.Beamwidth)
+	field("nominal antenna rotation rate, in RPM", "RPM", r.RPM, cat.RPM)
+	fmt.Fprintf(w, "\n# azimuth of the antenna when the ARP is detected, in degrees clockwise from the heading reference\nHeadingOffset = %g\n", r.HeadingOffset)
+	fmt.Fprintf(w, "\n# ADC clocks (8 ns) between trigger detection and the pulse leaving the antenna; ranges are measured from then\nRangeDelay = %g\n", r.RangeDelay)
+}
+
+// writeMonitorSection writes a [monitor] section holding the values in c.
+func writeMonitorSection(w io.Writer, c *monitor.Config) {
+	fmt.Fprintf(w, "[monitor]\n\n# how often to check the radar's signals\nInterval = %q\n", c.Interval)
+	fmt.Fprintf(w, "\n# maximum fractional deviation of measured PRF from PRF\nPRFTolerance = %g\n", c.PRFTolerance)
+	fmt.Fprintf(w, "\n# maximum deviation of ACPs between consecutive ARPs from ACPsPerRotation\nACPTolerance = %d\n", c.ACPTolerance)
+	fmt.Fprintf(w, "\n# acceptable range of antenna rotation rates, in RPM; 0 means don't check\nMinRPM = %g\nMaxRPM = %g\n", c.MinRPM, c.MaxRPM)
+	fmt.Fprintf(w, "\n# how long without an ARP before reporting a problem\nARPTimeout = %q\n", c.ARPTimeout)
+}
+
+// writeARPSection writes an [arp] section holding the values in c.
+func writeARPSection(w io.Writer, c *azimuth.EstimatorConfig) {
+	fmt.Fprintf(w, "[arp]\n\n# number of recent ARPs used to estimate the ARP's position in the ACP sequence\nWindow = %d\n", c.Window)
+	fmt.Fprintf(w, "\n# number of ARPs needed before the estimate is used\nMinARPs = %d\n", c.MinARPs)
+	fmt.Fprintf(w, "\n# ARPs further than this many ACPs from the estimate are ignored\nTolerance = %g\n", c.Tolerance)
+	fmt.Fprintf(w, "\n# file in which the estimate is saved across restarts of ogdar; \"\" means don't save\nStateFile = %q\n", c.StateFile)
+	fmt.Fprintf(w, "\n# save the estimate after this many ARPs\nSaveEvery = %d\n", c.SaveEvery)
+}
+
+// writeTimeSection writes a [time] section holding the values in c.
+func writeTimeSection(w io.Writer, c *timing.Config) {
+	fmt.Fprintf(w, "[time]\n\n# how often to pair the ADC clock count with the system time\nInterval = %q\n", c.Interval)
+	fmt.Fprintf(w, "\n# number of recent pairs used to estimate ADC clock rate and offset\nWindow = %d\n", c.Window)
+}
+
+// writeProfilesSection writes a [profiles] section holding the
+// profiles in ps.
+func writeProfilesSection(w io.Writer, ps *profileSet) {
+	fmt.Fprintf(w, "[profiles]\n\n# profile to use at startup\nActive = %q\n", ps.Active)
+	fmt.Fprintf(w, "\n# switch to the profile whose PRF matches the measured PRF\nAutoSelect = %v\n", ps.AutoSelect)
+	for _, p := range ps.List {
+		fmt.Fprintf(w, "\n[profiles.%s]\nPRF = %d\n", p.Name, p.PRF)
+		if len(p.Regs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n[profiles.%s.digdar]\n", p.Name)
+		for _, rc := range p.Regs {
+			fmt.Fprintf(w, "%s = %s\n", rc.f.Name, rc.f.Format(rc.v))
+		}
+	}
+}
+
+// writeArchiveSection writes an [archive] section holding the values in c.
+func writeArchiveSection(w io.Writer, c *archive.Config) {
+	fmt.Fprintf(w, "[archive]\n\n# directory in which to write a file for each sweep; \"\" means don't\nDir = %q\n", c.Dir)
+	fmt.Fprintf(w, "\n# SQLite capture database to record sweeps in; \"\" means don't\nDB = %q\n", c.DB)
+	fmt.Fprintf(w, "\n# layout of DB if it is created: \"ogdar\", or \"digdar\" as for digdar's capture databases\nDBLayout = %q\n", c.DBLayout)
+	fmt.Fprintf(w, "\n# archive one sweep in this many\nEvery = %d\n", c.Every)
+}
+
+// writeStreamSection writes a [stream] section holding the values in c.
+func writeStreamSection(w io.Writer, c *stream.Config) {
+	fmt.Fprintf(w, "[stream]\n\n# TCP address on which to serve scanlines and sweeps, e.g. \":12345\"; \"\" means don't\nAddr = %q\n", c.Addr)
+	fmt.Fprintf(w, "\n# connections beyond this many are refused\nMaxClients = %d\n", c.MaxClients)
+	fmt.Fprintf(w, "\n# megabytes which can wait to be sent to a client before data for it are dropped\nMaxQueue = %d\n", c.MaxQueue)
+}
+
+// writeAsterixSection writes an [asterix] section holding the values in c.
+func writeAsterixSection(w io.Writer, c *asterix.Config) {
+	fmt.Fprintf(w, "[asterix]\n\n# UDP address (host:port, unicast or multicast) to send CAT240 video to; \"\" means don't\nAddr = %q\n", c.Addr)
+	fmt.Fprintf(w, "\n# network interface for multicast; \"\" means the system's choice\nInterface = %q\n", c.Interface)
+	fmt.Fprintf(w, "\n# time-to-live of multicast datagrams, in hops\nTTL = %d\n", c.TTL)
+	fmt.Fprintf(w, "\n# data source identifier: system area code and system identification code\nSAC = %d\nSIC = %d\n", c.SAC, c.SIC)
+	fmt.Fprintf(w, "\n# bits per video cell: 8 or 16\nBits = %d\n", c.Bits)
+}
+
+// writeNavicoSection writes a [navico] section holding the values in c.
+func writeNavicoSection(w io.Writer, c *navico.Config) {
+	fmt.Fprintf(w, "[navico]\n\n# UDP address to send BR24 spokes to, normally %q; \"\" means don't\nAddr = %q\n", navico.DATA_ADDR, c.Addr)
+	fmt.Fprintf(w, "\n# UDP address to send BR24 status reports to, normally %q; \"\" means don't\nReportAddr = %q\n", navico.REPORT_ADDR, c.ReportAddr)
+	fmt.Fprintf(w, "\n# network interface for multicast; \"\" means the system's choice\nInterface = %q\n", c.Interface)
+	fmt.Fprintf(w, "\n# time-to-live of multicast datagrams, in hops\nTTL = %d\n", c.TTL)
+	fmt.Fprintf(w, "\n# display range, in metres; 0 means the range of each scanline\nRange = %g\n", c.Range)
+}
+
+// writeWebSection writes a [web] section holding the values in c.
+func writeWebSection(w io.Writer, c *web.Config) {
+	fmt.Fprintf(w, "[web]\n\n# TCP address on which to serve the web interface, e.g. \":8080\" for all interfaces; \"\" means don't\nAddr = %q\n", c.Addr)
+	fmt.Fprintf(w, "\n# if true, registers can be viewed but not changed from the web interface\nReadOnly = %t\n", c.ReadOnly)
+}
+
+// currentConfig returns the current values of Radar, MonitorConfig,
+// ARPConfig, TimeConfig, ArchiveConfig, StreamConfig, AsterixConfig,
+// NavicoConfig, WebConfig and Profiles, for writeConfig.
+func currentConfig() *configFile {
+	return &configFile{Radar: Radar, Monitor: MonitorConfig, ARP: ARPConfig, Time: TimeConfig, Archive: ArchiveConfig, Stream: StreamConfig, Asterix: AsterixConfig, Navico: NavicoConfig, Web: WebConfig, Profiles: Profiles}
+}
+
+// writeConfig writes a complete config file to path, with [digdar]
+// values from val and other sections from c.  what describes the
+// origin of the file, and is included in a comment at its top.
+func writeConfig(path, what string, c *configFile, val regValue) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "# This is a configuration file for ogdar\n# %s at %s\n#\n# https://github.com/jbrzusto/ogdar\n\n", what, time.Now().UTC().Format(time.RFC3339))
+	writeDigdarSection(f, false, val)
+	fmt.Fprintln(f)
+	writeRadarSection(f, &c.Radar)
+	fmt.Fprintln(f)
+	writeMonitorSection(f, &c.Monitor)
+	fmt.Fprintln(f)
+	writeARPSection(f, &c.ARP)
+	fmt.Fprintln(f)
+	writeTimeSection(f, &c.Time)
+	fmt.Fprintln(f)
+	writeArchiveSection(f, &c.Archive)
+	fmt.Fprintln(f)
+	writeStreamSection(f, &c.Stream)
+	fmt.Fprintln(f)
+	writeAsterixSection(f, &c.Asterix)
+	fmt.Fprintln(f)
+	writeNavicoSection(f, &c.Navico)
+	fmt.Fprintln(f)
+	writeWebSection(f, &c.Web)
+	if len(c.Profiles.List) > 0 {
+		fmt.Fprintln(f)
+		writeProfilesSection(f, &c.Profiles)
+	}
+	return f.Close()
+}
+
+// writeEffectiveConfig writes the values in c as a config file, each
+// followed by a comment giving its source: the config file, an
+// environment variable, or "default".  Values in [digdar] are those
+// given, not those in the FPGA; rw registers not given are listed in
+// a comment.
+func writeEffectiveConfig(w io.Writer, c *configFile) {
+	source := func(key string) string {
+		if src, ok := c.Sources[strings.ToLower(key)]; ok {
+			return src
+		}
+		return "default"
+	}
+	fmt.Fprintln(w, "# Effective ogdar configuration.  Each value is followed by its source:\n# the config file, an environment variable, or \"default\".\n\n[digdar]")
+	given := make(map[*RegField]bool, len(c.Regs))
+	for _, rc := range c.Regs {
+		given[rc.f] = true
+		fmt.Fprintf(w, "%s = %s  # %s\n", rc.f.Name, rc.f.Format(rc.v), source("digdar."+rc.f.Name))
+	}
+	var missing []string
+	for i := range RegFields {
+		if f := &RegFields[i]; f.Writable() && !given[f] {
+			missing = append(missing, f.Name)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "# not given, so left at the FPGA's current value: %s\n", strings.Join(missing, ", "))
+	}
+	for _, s := range []struct {
+		name string
+		val  interface{}
+	}{{"radar", c.Radar}, {"monitor", c.Monitor}, {"arp", c.ARP}, {"time", c.Time}, {"archive", c.Archive}, {"stream", c.Stream}, {"asterix", c.Asterix}, {"navico", c.Navico}, {"web", c.Web}} {
+		fmt.Fprintf(w, "\n[%s]\n", s.name)
+		v := reflect.ValueOf(s.val)
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			fmt.Fprintf(w, "%s = %s  # %s\n", name, tomlValue(v.Field(i).Interface()), source(s.name+"."+name))
+		}
+	}
+	ps := &c.Profiles
+	fmt.Fprintf(w, "\n[profiles]\nActive = %q  # %s\nAutoSelect = %v  # %s\n", ps.Active, source("profiles.Active"), ps.AutoSelect, source("profiles.AutoSelect"))
+	for _, p := range ps.List {
+		key := "profiles." + p.Name
+		fmt.Fprintf(w, "\n[%s]\nPRF = %d  # %s\n", key, p.PRF, source(key+".PRF"))
+		if len(p.Regs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n[%s.digdar]\n", key)
+		for _, rc := range p.Regs {
+			fmt.Fprintf(w, "%s = %s  # %s\n", rc.f.Name, rc.f.Format(rc.v), source(key+".digdar."+rc.f.Name))
+		}
+	}
+}
+
+// tomlValue formats x as a TOML value.
+func tomlValue(x interface{}) string {
+	switch x := x.(type) {
+	case string:
+		return fmt.Sprintf("%q", x)
+	case time.Duration:
+		return fmt.Sprintf("%q", x.String())
+	default:
+		return fmt.Sprint(x)
+	}
+}
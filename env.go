@@ -0,0 +1,95 @@
+package main
+
+// Environment variable overrides for config file values.  A variable
+// called OGDAR_SECTION_KEY overrides KEY in [SECTION] of the config
+// file, e.g.
+//
+//    OGDAR_DIGDAR_NUMSAMP=6000 OGDAR_RADAR_PRF=600 ogdar
+//
+// SECTION and KEY are case-insensitive.  Only [profiles]'s Active and
+// AutoSelect can be overridden, not values within individual
+// profiles.  Overrides also apply when the config file is reloaded.
+// OGDAR_CONFIG is not an override; it names the config file (see
+// findConfigFile).
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	envPrefix = "OGDAR_"       // prefix of environment variables overriding config values
+	envConfig = "OGDAR_CONFIG" // environment variable naming the config file
+)
+
+// envSettings returns the config values overridden by environment
+// variables, in the form returned by normalizeSettings, along with
+// the variable giving each value, keyed by lower-cased section.key.
+// warnings describe variables which were ignored.
+func envSettings() (settings map[string]interface{}, vars map[string]string, warnings []string) {
+	settings = make(map[string]interface{})
+	vars = make(map[string]string)
+	for _, kv := range os.Environ() {
+		i := strings.IndexByte(kv, '=')
+		name, val := kv[:i], kv[i+1:]
+		if !strings.HasPrefix(name, envPrefix) || name == envConfig {
+			continue
+		}
+		sk := strings.SplitN(strings.ToLower(name[len(envPrefix):]), "_", 2)
+		if len(sk) != 2 {
+			warnings = append(warnings, fmt.Sprintf("ignoring environment variable %s: not of the form %sSECTION_KEY", name, envPrefix))
+			continue
+		}
+		s, k := sk[0], sk[1]
+		var known, settable bool
+		if s == "profiles" {
+			known = k == "active" || k == "autoselect"
+			settable = known
+		} else {
+			_, known, settable = lookupKey(s, k)
+		}
+		switch {
+		case !known:
+			warnings = append(warnings, fmt.Sprintf("ignoring environment variable %s: no key %s.%s", name, s, k))
+		case !settable:
+			warnings = append(warnings, fmt.Sprintf("ignoring environment variable %s: %s.%s is read-only", name, s, k))
+		default:
+			m, ok := settings[s].(map[string]interface{})
+			if !ok {
+				m = make(map[string]interface{})
+				settings[s] = m
+			}
+			m[k] = val
+			vars[s+"."+k] = name
+		}
+	}
+	return
+}
+
+// mergeSettings copies the values in the sections of from into to,
+// replacing any already there.
+func mergeSettings(to, from map[string]interface{}) {
+	for s, vals := range from {
+		m, ok := to[s].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			to[s] = m
+		}
+		for k, v := range vals.(map[string]interface{}) {
+			m[k] = v
+		}
+	}
+}
+
+// addSources records src as the source of each value in settings,
+// under its lower-cased key, prefixed by prefix, in sources.
+func addSources(sources map[string]string, prefix string, settings map[string]interface{}, src string) {
+	for k, v := range settings {
+		if m, ok := v.(map[string]interface{}); ok {
+			addSources(sources, prefix+k+".", m, src)
+		} else {
+			sources[prefix+k] = src
+		}
+	}
+}
@@ -70,6 +70,10 @@ const (
 	BPS_ACP                = 12                   // bits per sample, ACP channel sample (slow ADC B)
 )
 
+// RANGE_PER_CLOCK is the radar range increment, in metres, per fast
+// ADC clock: the distance light travels out and back in 8 ns.
+const RANGE_PER_CLOCK = 299792458.0 / 2 / FAST_ADC_CLOCK
+
 // TrigType enumerates sources for a trigger, and flags for Armed (bit 8) and Fired (bit 9)
 type TrigType uint32
 
@@ -123,7 +127,9 @@ const (
 //
 // As an exception, it *is* safe to change just the 'desc:' component
 // of the field tags.  These descriptions will appear in ogdar's web
-// interface.
+// interface.  The 'signed:' component is also safe to change; it
+// gives the width in bits of registers holding signed values, and is
+// only used by ogdar when parsing and printing register values.
 
 //go:notinheap
 type regs struct {
@@ -137,9 +143,9 @@ type regs struct {
 
 	Options uint32 `reg:"options" mode:"rw" desc:"Options: digdar-specific options; see type DigdarOption bit[0]: Average samples; bit[1]: Sum samples; bit[2]: Negate video; bit[3]: Counting mode"`
 
-	TrigThreshExcite uint32 `reg:"trig_thresh_excite" mode:"rw" desc:"Trigger Excite Threshold: Trigger pulse is detected after trigger channel ADC value meets or exceeds this value (in direction away from the Trigger Relax Threshold).  -8192...8191"`
+	TrigThreshExcite uint32 `reg:"trig_thresh_excite" mode:"rw" signed:"14" desc:"Trigger Excite Threshold: Trigger pulse is detected after trigger channel ADC value meets or exceeds this value (in direction away from the Trigger Relax Threshold).  -8192...8191"`
 
-	TrigThreshRelax uint32 `reg:"trig_thresh_relax" mode:"rw" desc:"Trigger Relax Threshold: After a trigger pulse has been detected, the trigger channel ADC value must meet or exceed this value (in direction away from the Trigger Excite Threshold) before a trigger will be detected again.  (Serves to debounce signal in Schmitt trigger style).  -8192...8191"`
+	TrigThreshRelax uint32 `reg:"trig_thresh_relax" mode:"rw" signed:"14" desc:"Trigger Relax Threshold: After a trigger pulse has been detected, the trigger channel ADC value must meet or exceed this value (in direction away from the Trigger Excite Threshold) before a trigger will be detected again.  (Serves to debounce signal in Schmitt trigger style).  -8192...8191"`
 
 	TrigDelay uint32 `reg:"trig_delay" mode:"rw" desc:"Trigger Delay: How long to wait after trigger is detected before starting to capture samples from the video channel.  The delay is in units of ADC clocks; i.e. the value is multiplied by 8 nanoseconds."`
 	// Note: this usage of 'delay' is traditional for radar
@@ -151,15 +157,15 @@ type regs struct {
 
 	TrigCount uint32 `reg:"trig_count" mode:"r" is_wire:"y" desc:"Trigger Count: number of trigger pulses detected since last reset"`
 
-	ACPThreshExcite uint32 `reg:"acp_thresh_excite" mode:"rw" desc:"ACP Excite Threshold: the AC Pulse is detected when the ACP channel value meets or exceeds this value (in direction away from the ACP Relax Threshold).  -2048...2047"`
+	ACPThreshExcite uint32 `reg:"acp_thresh_excite" mode:"rw" signed:"12" desc:"ACP Excite Threshold: the AC Pulse is detected when the ACP channel value meets or exceeds this value (in direction away from the ACP Relax Threshold).  -2048...2047"`
 
-	ACPThreshRelax uint32 `reg:"acp_thresh_relax" mode:"rw" desc:"ACP Relax Threshold: After an ACP has been detected, the acp channel ADC value must meet or exceed this value (in direction away from acp_thresh_excite) before an ACP will be detected again.  (Serves to debounce signal in Schmitt trigger style).  -2048...2047"`
+	ACPThreshRelax uint32 `reg:"acp_thresh_relax" mode:"rw" signed:"12" desc:"ACP Relax Threshold: After an ACP has been detected, the acp channel ADC value must meet or exceed this value (in direction away from acp_thresh_excite) before an ACP will be detected again.  (Serves to debounce signal in Schmitt trigger style).  -2048...2047"`
 
 	ACPLatency uint32 `reg:"acp_latency" mode:"rw" desc:"ACP Latency: how long to wait after ACP relaxation before allowing next excitation.  To further debounce the acp signal, we can specify a minimum wait time between relaxation and excitation.  0...1000000 (which gets multiplied by 8 nanoseconds)"`
 
-	ARPThreshExcite uint32 `reg:"arp_thresh_excite" mode:"rw" desc:"ARP Excite Threshold: the AR Pulse is detected when the ARP channel value meets or exceeds this value (in direction away from the ARP Relax Threshold).  -2048..2047"`
+	ARPThreshExcite uint32 `reg:"arp_thresh_excite" mode:"rw" signed:"12" desc:"ARP Excite Threshold: the AR Pulse is detected when the ARP channel value meets or exceeds this value (in direction away from the ARP Relax Threshold).  -2048..2047"`
 
-	ARPThreshRelax uint32 `reg:"arp_thresh_relax" mode:"rw" desc:"ARP Relax Threshold: After an ARP has been detected, the acp channel ADC value must meet or exceed this value (in direction away from arp_thresh_excite) before an ARP will be detected again.  (Serves to debounce signal in Schmitt trigger style).  -2048..2047"`
+	ARPThreshRelax uint32 `reg:"arp_thresh_relax" mode:"rw" signed:"12" desc:"ARP Relax Threshold: After an ARP has been detected, the acp channel ADC value must meet or exceed this value (in direction away from arp_thresh_excite) before an ARP will be detected again.  (Serves to debounce signal in Schmitt trigger style).  -2048..2047"`
 
 	ARPLatency uint32 `reg:"arp_latency" mode:"rw" desc:"ARP Latency: how long to wait after ARP relaxation before allowing next excitation.  To further debounce the acp signal, we can specify a minimum wait time between relaxation and excitation.  0...1000000 (which gets multiplied by 8 nanoseconds)"`
 
@@ -512,6 +518,22 @@ func SetDecim(decim uint32) bool {
 	return true
 }
 
+// CanSum returns true if the FPGA can sum, rather than decimate,
+// samples at the decimation rate decim (see DDOPT_USE_SUM).
+func CanSum(decim uint32) bool {
+	return decim >= 1 && decim <= 4
+}
+
+// CanAverage returns true if the FPGA can average, rather than
+// decimate, samples at the decimation rate decim (see DDOPT_AVERAGING).
+func CanAverage(decim uint32) bool {
+	switch decim {
+	case 1, 2, 4, 8, 64, 1024, 8192, 65536:
+		return true
+	}
+	return false
+}
+
 // SetNumSamp sets the number of samples to acquire after a trigger.
 // Must be in the range 1...SAMPLES_PER_BUFF
 // returns true on success; false otherwise
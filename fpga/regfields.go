@@ -0,0 +1,176 @@
+package fpga
+
+// Access to FPGA registers by field name, as used in the [digdar]
+// section of ogdar.toml.  Unlike RegMap, which splits 64-bit
+// registers into _lo and _hi halves, a RegField refers to a whole
+// field of the register struct, and knows whether its value is
+// signed.
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// RegField describes one field of the FPGA register struct.
+type RegField struct {
+	Name   string  // name of the field; this is also its key in the [digdar] section of ogdar.toml
+	Mode   string  // "rw", "r", or "p" (p for pulse or one-shot)
+	Desc   string  // human-readable description of the register
+	Size   int     // size of register, in bytes; 4 or 8
+	Signed int     // if non-zero, the register holds a signed value this many bits wide
+	offset uintptr // offset of the register from the start of Regs
+}
+
+var (
+	RegFields   []RegField     // RegFields holds all fields of the register struct, in storage order
+	regFieldMap map[string]int // regFieldMap translates from the lower-cased name of a field to its index in RegFields
+)
+
+// init builds RegFields from the register struct type.  This needs
+// no access to the FPGA, so register names, modes and ranges are
+// available even when not running on a redpitaya.
+func init() {
+	t := reflect.TypeOf((*regs)(nil)).Elem()
+	RegFields = make([]RegField, 0, t.NumField())
+	regFieldMap = make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		rf := RegField{
+			Name:   f.Name,
+			Mode:   f.Tag.Get("mode"),
+			Desc:   f.Tag.Get("desc"),
+			Size:   int(f.Type.Size()),
+			offset: f.Offset,
+		}
+		if s := f.Tag.Get("signed"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 2 || n > 8*rf.Size {
+				panic("bad 'signed' tag on fpga.regs field " + f.Name)
+			}
+			rf.Signed = n
+		}
+		regFieldMap[strings.ToLower(f.Name)] = len(RegFields)
+		RegFields = append(RegFields, rf)
+	}
+}
+
+// FindRegField returns the RegField with the given name, ignoring
+// case.  The second return value is false if there is no such field.
+func FindRegField(name string) (*RegField, bool) {
+	i, ok := regFieldMap[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+	return &RegFields[i], true
+}
+
+// Readable returns true if the register can be read.
+func (f *RegField) Readable() bool {
+	return f.Mode == "r" || f.Mode == "rw"
+}
+
+// Writable returns true if the register can be written and will
+// keep the written value.
+func (f *RegField) Writable() bool {
+	return f.Mode == "rw"
+}
+
+// mask returns the bit mask for the valid bits of the register.
+func (f *RegField) mask() uint64 {
+	if f.Size == 8 {
+		return ^uint64(0)
+	}
+	return 1<<uint(8*f.Size) - 1
+}
+
+// Get returns the current value of the register.  Init() must have
+// been called.
+func (f *RegField) Get() uint64 {
+	p := unsafe.Pointer(uintptr(unsafe.Pointer(Regs)) + f.offset)
+	if f.Size == 8 {
+		// read as two 32-bit halves; the FPGA bus is only 32 bits wide
+		lo := *(*uint32)(p)
+		hi := *(*uint32)(unsafe.Pointer(uintptr(p) + 4))
+		return uint64(hi)<<32 | uint64(lo)
+	}
+	return uint64(*(*uint32)(p))
+}
+
+// Set writes a value to the register.  Init() must have been called.
+func (f *RegField) Set(v uint64) {
+	p := unsafe.Pointer(uintptr(unsafe.Pointer(Regs)) + f.offset)
+	if f.Size == 8 {
+		*(*uint32)(p) = uint32(v)
+		*(*uint32)(unsafe.Pointer(uintptr(p) + 4)) = uint32(v >> 32)
+		return
+	}
+	*(*uint32)(p) = uint32(v)
+}
+
+// Int returns the value v, as stored in the register, converted to a
+// signed integer if the register is signed.  Only the low-order
+// Signed bits of v are used, so this works whether the FPGA returns
+// sign-extended or zero-extended values.
+func (f *RegField) Int(v uint64) int64 {
+	if f.Signed == 0 {
+		return int64(v & f.mask())
+	}
+	sh := uint(64 - f.Signed)
+	return int64(v<<sh) >> sh
+}
+
+// Range returns the minimum and maximum values that can be stored in
+// the register.
+func (f *RegField) Range() (min, max int64) {
+	if f.Signed != 0 {
+		return -1 << uint(f.Signed-1), 1<<uint(f.Signed-1) - 1
+	}
+	if f.Size == 8 {
+		// not representable in an int64, but no 64-bit register is writable
+		return 0, 1<<63 - 1
+	}
+	return 0, int64(f.mask())
+}
+
+// Parse converts a string to a value suitable for storing in the
+// register.  Signed registers accept negative values, which are
+// stored in two's complement form.  Hexadecimal (0x...) and octal
+// (0...) values are also accepted.
+func (f *RegField) Parse(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if f.Signed != 0 {
+		v, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid value %q", f.Name, s)
+		}
+		if min, max := f.Range(); v < min || v > max {
+			return 0, fmt.Errorf("%s: value %d out of range %d...%d", f.Name, v, min, max)
+		}
+		return uint64(v) & f.mask(), nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8*f.Size)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid value %q; must be an unsigned %d-bit integer", f.Name, s, 8*f.Size)
+	}
+	return v, nil
+}
+
+// Format returns the value v as a string, in the form accepted by Parse.
+func (f *RegField) Format(v uint64) string {
+	if f.Size == 8 {
+		return strconv.FormatUint(v, 10)
+	}
+	return strconv.FormatInt(f.Int(v), 10)
+}
+
+// Same returns true if the register values a and b are equivalent;
+// for signed registers, only the low-order Signed bits are compared.
+func (f *RegField) Same(a, b uint64) bool {
+	if f.Signed != 0 {
+		return f.Int(a) == f.Int(b)
+	}
+	return a&f.mask() == b&f.mask()
+}
@@ -0,0 +1,120 @@
+package fpga
+
+// Raw capture of all four radar channels, for calibrating the
+// trigger, ACP and ARP pulse detectors.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ScopeCapture holds raw samples from the four radar channels, recorded
+// simultaneously after a single trigger.  Samples are signed values:
+// the fast channels (video and trigger) have 14 significant bits, the
+// slow channels (ACP and ARP) have 12.
+type ScopeCapture struct {
+	Source     TrigType  `json:"source"`      // what triggered the capture
+	Time       time.Time `json:"time"`        // system time at which capture completed
+	FastPeriod float64   `json:"fast_period"` // time between samples on the video and trigger channels, in seconds
+	SlowPeriod float64   `json:"slow_period"` // time between samples on the ACP and ARP channels, in seconds
+	Vid        []int16   `json:"vid"`         // video channel (fast ADC A)
+	Trig       []int16   `json:"trig"`        // trigger channel (fast ADC B)
+	ACP        []int16   `json:"acp"`         // ACP channel (slow ADC A)
+	ARP        []int16   `json:"arp"`         // ARP channel (slow ADC B)
+}
+
+// ScopePollInterval is how often Scope checks whether the FPGA has fired.
+const ScopePollInterval = time.Millisecond
+
+// ErrScopeTimeout is returned by Scope when no trigger was detected in time.
+var ErrScopeTimeout = errors.New("timed out waiting for trigger")
+
+// signExtend returns the low-order bits of x as a signed value.
+func signExtend(x uint32, bits uint) int16 {
+	return int16(int32(x<<(32-bits)) >> (32 - bits))
+}
+
+// Scope arms the FPGA once with trigger source t, waits up to timeout
+// for acquisition to finish, and returns the first n samples of each
+// channel's buffer.  If n is 0, the current value of NumSamp is used.
+// Summing of decimated video samples (DDOPT_USE_SUM) is turned off
+// for the capture, since sums are wider than BPS_VID bits; samples
+// are averaged or decimated instead.  TrigSource, NumSamp and Options
+// are restored before returning, so this can be used between normal
+// acquisitions.
+func Scope(t TrigType, n int, timeout time.Duration) (*ScopeCapture, error) {
+	if t == TRG_NONE || t > TRG_ARP {
+		return nil, fmt.Errorf("invalid trigger source %d", t)
+	}
+	oldSource, oldNumSamp, oldOptions := Regs.TrigSource, Regs.NumSamp, Regs.Options
+	defer func() {
+		Regs.TrigSource = oldSource
+		Regs.NumSamp = oldNumSamp
+		Regs.Options = oldOptions
+	}()
+	if n == 0 {
+		n = int(oldNumSamp)
+	} else if !SetNumSamp(uint32(n)) {
+		return nil, fmt.Errorf("invalid number of samples %d; must be 1...%d", n, SAMPLES_PER_BUFF)
+	}
+	Regs.Options = oldOptions &^ uint32(DDOPT_USE_SUM)
+	SelectTrig(t)
+	Arm()
+	deadline := time.Now().Add(timeout)
+	for !HasFired() {
+		if time.Now().After(deadline) {
+			return nil, ErrScopeTimeout
+		}
+		time.Sleep(ScopePollInterval)
+	}
+	sc := &ScopeCapture{
+		Source:     t,
+		Time:       time.Now(),
+		FastPeriod: float64(Regs.DecRate) * FAST_ADC_SAMPLE_PERIOD,
+		SlowPeriod: SLOW_ADC_SAMPLE_PERIOD,
+		Vid:        make([]int16, n),
+		Trig:       make([]int16, n),
+		ACP:        make([]int16, n),
+		ARP:        make([]int16, n),
+	}
+	for i := 0; i < n; i++ {
+		// video samples are unsigned (offset binary); the others are
+		// raw two's complement ADC values, like the thresholds
+		sc.Vid[i] = int16(VidBuf[i]&(1<<BPS_VID-1)) - 1<<(BPS_VID-1)
+		sc.Trig[i] = signExtend(TrigBuf[i], BPS_TRIG)
+		sc.ACP[i] = signExtend(ACPBuf[i], BPS_ACP)
+		sc.ARP[i] = signExtend(ARPBuf[i], BPS_ARP)
+	}
+	return sc, nil
+}
+
+// WriteCSV writes the capture to w as CSV with a header line, one row
+// per sample index.  Times are relative to the start of capture, in
+// seconds, for the fast and slow channels respectively.
+func (sc *ScopeCapture) WriteCSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "i,fast_time,slow_time,vid,trig,acp,arp")
+	for i := range sc.Vid {
+		fmt.Fprintf(bw, "%d,%g,%g,%d,%d,%d,%d\n", i, float64(i)*sc.FastPeriod, float64(i)*sc.SlowPeriod, sc.Vid[i], sc.Trig[i], sc.ACP[i], sc.ARP[i])
+	}
+	return bw.Flush()
+}
+
+// ParseTrigType converts a trigger source name ("immediate", "trig",
+// "acp" or "arp") to a TrigType.
+func ParseTrigType(s string) (TrigType, error) {
+	switch s {
+	case "immediate":
+		return TRG_IMMEDIATE, nil
+	case "trig":
+		return TRG_TRIG, nil
+	case "acp":
+		return TRG_ACP, nil
+	case "arp":
+		return TRG_ARP, nil
+	}
+	return TRG_NONE, fmt.Errorf("unknown trigger source %q; must be one of immediate, trig, acp, arp", s)
+}
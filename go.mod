@@ -2,4 +2,11 @@ module github.com/jbrzusto/ogdar
 
 go 1.12
 
-require github.com/spf13/viper v1.4.0
+require (
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/gorilla/websocket v1.4.1
+	github.com/mattn/go-sqlite3 v1.11.0
+	github.com/mitchellh/mapstructure v1.1.2
+	github.com/spf13/cast v1.3.0
+	github.com/spf13/viper v1.4.0
+)
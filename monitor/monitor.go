@@ -0,0 +1,227 @@
+/*
+Package monitor watches the radar's trigger, ACP and ARP signals and
+compares them to what the radar is supposed to be doing.
+
+PRF is computed from the change in TrigCount and TrigClock between
+polls, antenna speed from the interval between the two most recent
+ARPs, and ACPs per rotation from ACPPerARP.  Any of these deviating
+from the expected values by more than the configured tolerance puts
+the radar into the StateDegraded state; missing triggers or ARPs put
+it into StateNoTrigger or StateNoARP.
+*/
+package monitor
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/fpga"
+	"math"
+	"sync"
+	"time"
+)
+
+// State is the overall health of the radar signals.
+type State int
+
+const (
+	StateUnknown   State = iota // not enough measurements yet
+	StateOK                     // all measurements within tolerance
+	StateDegraded               // trigger and ARP present, but something is out of tolerance
+	StateNoTrigger              // no trigger pulses detected
+	StateNoARP                  // triggers detected, but no ARP pulses
+)
+
+var stateNames = [...]string{"unknown", "OK", "degraded", "no trigger", "no ARP"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// Config holds the monitor's tolerances.  It is read from the
+// [monitor] section of ogdar.toml.
+type Config struct {
+	Interval     time.Duration // how often to poll the FPGA registers
+	PRFTolerance float64       // maximum fractional deviation of measured PRF from expected PRF
+	ACPTolerance uint32        // maximum deviation of measured ACPs per rotation from expected, in ACPs
+	MinRPM       float64       // minimum acceptable antenna rotation rate; 0 means don't check
+	MaxRPM       float64       // maximum acceptable antenna rotation rate; 0 means don't check
+	ARPTimeout   time.Duration // how long without an ARP before declaring StateNoARP
+}
+
+// DefaultConfig is used for any values not given in ogdar.toml.
+var DefaultConfig = Config{
+	Interval:     time.Second,
+	PRFTolerance: 0.05,
+	ACPTolerance: 2,
+	MinRPM:       0,
+	MaxRPM:       0,
+	ARPTimeout:   10 * time.Second,
+}
+
+// Expected is what the radar should be doing; this comes from the
+// [radar] section of ogdar.toml.
+type Expected struct {
+	PRF             float64 // pulse repetition frequency, Hz
+	ACPsPerRotation uint32  // ACPs per antenna rotation
+}
+
+// Status is a snapshot of the monitor's measurements.
+type Status struct {
+	State           State     // overall health
+	Time            time.Time // when the status was computed
+	PRF             float64   // measured pulse repetition frequency, Hz; 0 if unknown
+	RPM             float64   // measured antenna rotation rate; 0 if unknown
+	ACPsPerRotation uint32    // ACPs between the two most recent ARPs; 0 if unknown
+	Problems        []string  // human-readable descriptions of deviations from expected values
+}
+
+// Monitor periodically polls the FPGA and maintains a Status.
+type Monitor struct {
+	mu        sync.Mutex
+	cfg       Config
+	exp       Expected
+	status    Status
+	listeners []chan<- Status
+	// values at previous poll
+	trigCount uint32
+	trigClock uint64
+	arpCount  uint32
+	lastARP   time.Time
+	polled    bool
+}
+
+// New returns a Monitor with the given tolerances and expectations.
+// Call Run to start it.
+func New(cfg Config, exp Expected) *Monitor {
+	return &Monitor{cfg: cfg, exp: exp}
+}
+
+// SetConfig changes the monitor's tolerances.
+func (m *Monitor) SetConfig(cfg Config) {
+	m.mu.Lock()
+	m.cfg = cfg
+	m.mu.Unlock()
+}
+
+// SetExpected changes what the monitor expects the radar to be doing.
+func (m *Monitor) SetExpected(exp Expected) {
+	m.mu.Lock()
+	m.exp = exp
+	m.mu.Unlock()
+}
+
+// Status returns the most recent status.
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Notify arranges for ch to receive the new status whenever the
+// monitor's State changes.  Sends do not block, so a status change is
+// dropped if ch is not ready.
+func (m *Monitor) Notify(ch chan<- Status) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, ch)
+	m.mu.Unlock()
+}
+
+// Run polls the FPGA until stop is closed.  fpga.Init() must have been called.
+func (m *Monitor) Run(stop <-chan struct{}) {
+	for {
+		m.poll()
+		m.mu.Lock()
+		d := m.cfg.Interval
+		m.mu.Unlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+// poll reads the FPGA registers and updates the status.
+func (m *Monitor) poll() {
+	now := time.Now()
+	r := fpga.Regs
+	trigCount, trigClock := r.TrigCount, r.TrigClock
+	arpCount, arpClock, arpPrevClock := r.ARPCount, r.ARPClock, r.ARPPrevClock
+	acpPerARP := r.ACPPerARP
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := Status{Time: now}
+	if !m.polled {
+		m.polled = true
+		m.lastARP = now
+	} else {
+		if trigCount != m.trigCount && trigClock != m.trigClock {
+			s.PRF = float64(trigCount-m.trigCount) * fpga.FAST_ADC_CLOCK / float64(trigClock-m.trigClock)
+		}
+		if arpCount != m.arpCount {
+			m.lastARP = now
+		}
+		if arpCount >= 2 && arpClock > arpPrevClock {
+			s.RPM = 60 * fpga.FAST_ADC_CLOCK / float64(arpClock-arpPrevClock)
+			s.ACPsPerRotation = acpPerARP
+		}
+		s.State = m.assess(&s, trigCount == m.trigCount, now.Sub(m.lastARP) > m.cfg.ARPTimeout)
+	}
+	m.trigCount, m.trigClock, m.arpCount = trigCount, trigClock, arpCount
+	changed := s.State != m.status.State
+	m.status = s
+	if changed {
+		for _, ch := range m.listeners {
+			select {
+			case ch <- s:
+			default:
+			}
+		}
+	}
+}
+
+// assess compares the measurements in s to expected values, recording
+// problems in s, and returns the resulting state.
+func (m *Monitor) assess(s *Status, noTrigger, noARP bool) State {
+	if noTrigger {
+		s.Problems = append(s.Problems, "no trigger pulses detected")
+		return StateNoTrigger
+	}
+	if m.exp.PRF > 0 && math.Abs(s.PRF-m.exp.PRF) > m.cfg.PRFTolerance*m.exp.PRF {
+		s.Problems = append(s.Problems, fmt.Sprintf("PRF is %.0f Hz; expected %.0f Hz", s.PRF, m.exp.PRF))
+	}
+	if noARP {
+		s.Problems = append(s.Problems, fmt.Sprintf("no ARP detected in %v", m.cfg.ARPTimeout))
+		return StateNoARP
+	}
+	if s.RPM > 0 {
+		if (m.cfg.MinRPM > 0 && s.RPM < m.cfg.MinRPM) || (m.cfg.MaxRPM > 0 && s.RPM > m.cfg.MaxRPM) {
+			s.Problems = append(s.Problems, fmt.Sprintf("antenna speed is %.1f RPM; expected %g...%g", s.RPM, m.cfg.MinRPM, m.cfg.MaxRPM))
+		}
+		if m.exp.ACPsPerRotation > 0 {
+			d := int64(s.ACPsPerRotation) - int64(m.exp.ACPsPerRotation)
+			if d < -int64(m.cfg.ACPTolerance) || d > int64(m.cfg.ACPTolerance) {
+				s.Problems = append(s.Problems, fmt.Sprintf("%d ACPs per rotation; expected %d", s.ACPsPerRotation, m.exp.ACPsPerRotation))
+			}
+		}
+	}
+	if len(s.Problems) > 0 {
+		return StateDegraded
+	}
+	if s.RPM == 0 {
+		return StateUnknown
+	}
+	return StateOK
+}
+
+// String returns a one-line summary of the status.
+func (s Status) String() string {
+	str := fmt.Sprintf("%s: PRF = %.0f Hz, RPM = %.1f, ACPs per rotation = %d", s.State, s.PRF, s.RPM, s.ACPsPerRotation)
+	for _, p := range s.Problems {
+		str += "; " + p
+	}
+	return str
+}
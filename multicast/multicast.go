@@ -0,0 +1,63 @@
+/*
+Package multicast sets up UDP sockets for sending multicast
+datagrams, as used by ogdar's network outputs: ASTERIX video and
+Navico spokes.
+*/
+package multicast
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SetOptions sets the time-to-live of multicast datagrams sent from
+// conn to ttl hops, and the network interface they are sent from to
+// the one named iface; "" means the system's choice.
+func SetOptions(conn *net.UDPConn, iface string, ttl int) error {
+	var ifAddr [4]byte
+	if iface != "" {
+		var err error
+		if ifAddr, err = InterfaceAddr(iface); err != nil {
+			return err
+		}
+	}
+	rc, err := conn.SyscallConn()
+	if err == nil {
+		ctlErr := rc.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+			if err == nil && iface != "" {
+				err = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ifAddr)
+			}
+		})
+		if err == nil {
+			err = ctlErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("setting multicast options: %v", err)
+	}
+	return nil
+}
+
+// InterfaceAddr returns the IPv4 address of the named network interface.
+func InterfaceAddr(name string) (a [4]byte, err error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return
+	}
+	for _, ad := range addrs {
+		if ipn, ok := ad.(*net.IPNet); ok {
+			if ip4 := ipn.IP.To4(); ip4 != nil {
+				copy(a[:], ip4)
+				return a, nil
+			}
+		}
+	}
+	return a, errors.New("interface " + name + " has no IPv4 address")
+}
@@ -0,0 +1,150 @@
+/*
+Package navico sends scanlines as the spoke multicast of a Navico
+BR24 radar, so that OpenCPN's radar plugin (radar_pi, or the older
+br24radar_pi) can display them as if from a BR24.  In the plugin,
+choose the BR24 radar type.
+
+# Spokes
+
+A BR24 sends 2048 spokes per rotation, each of 1024 4-bit cells
+covering the range from the antenna out to the display range.
+Scanlines are reduced to spokes like this:
+
+  - each scanline's azimuth picks its spoke; all scanlines falling in
+    the same spoke are combined, cell by cell, by taking the maximum
+  - each cell is the maximum of the samples whose ranges fall in it,
+    or the nearest sample if none do; samples from before the pulse
+    left the antenna are left out
+  - samples are scaled to 4 bits by dropping their low-order bits
+  - when scanlines are sparser than spokes, spokes skipped between
+    two scanlines (up to MAX_FILL of them) are filled with the earlier
+    one, so that the picture has no gaps
+
+The display range is Config.Range, or, if that is 0, the range of the
+last sample of each scanline.
+
+# Packets
+
+Spokes are sent SPOKES_PER_FRAME to a datagram, to Config.Addr.  Each
+datagram has an 8-byte frame header (all zero; receivers ignore it),
+then each spoke: a 24-byte header followed by its cells, packed two
+to a byte in 512 bytes, the nearer cell of each pair in the low
+nibble.  This is how radar_pi unpacks them.  Spoke header fields are
+little-endian:
+
+	offset  size  contents
+	     0     1  header length: 24
+	     1     1  status: STATUS_VALID
+	     2     2  spoke counter, wrapping
+	     4     4  00 44 0d 0e
+	     8     2  angle, in units of 360/4096 degrees clockwise from the bow
+	    10     2  heading: HEADING_NONE, as ogdar has no compass
+	    12     4  display range r, as the integer nearest r * sqrt(2) / 10
+	              for r in metres
+	    16     8  zero
+
+Receivers also want to see the radar transmitting, so a status report
+(01 C4, status 2) is sent to Config.ReportAddr every REPORT_INTERVAL.
+ogdar does not control a radar, so commands the plugin sends (to turn
+the radar on, change its range, and so on) are ignored.
+*/
+package navico
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+const (
+	SPOKES           = 2048             // spokes per rotation
+	SPOKE_LEN        = 1024             // cells per spoke
+	SPOKE_BYTES      = SPOKE_LEN / 2    // bytes of cells per spoke, two to a byte
+	CELL_BITS        = 4                // bits per cell
+	ANGLES           = 4096             // angle units per rotation, in spoke headers
+	SPOKES_PER_FRAME = 32               // spokes per datagram
+	FRAME_HDR_SIZE   = 8                // bytes in a datagram's frame header
+	SPOKE_HDR_SIZE   = 24               // bytes in a spoke header
+	STATUS_VALID     = 0x02             // spoke header status of a valid spoke
+	HEADING_NONE     = 0x8000           // spoke header heading when there is no compass
+	MAX_FILL         = SPOKES / 64      // most skipped spokes filled from the previous one
+	REPORT_INTERVAL  = time.Second      // time between status reports
+	DATA_ADDR        = "236.6.7.8:6678" // where a BR24 sends spokes
+	REPORT_ADDR      = "236.6.7.9:6679" // where a BR24 sends reports
+)
+
+// spokeMark is at offset 4 of every spoke header.
+var spokeMark = [4]byte{0x00, 0x44, 0x0d, 0x0e}
+
+// statusReport is the report telling receivers the radar is
+// transmitting.
+var statusReport = [18]byte{0x01, 0xc4, 0x02}
+
+// Config holds parameters for a Sender.  It is read from the [navico]
+// section of ogdar.toml.
+type Config struct {
+	Addr       string  // UDP address to send spokes to, normally DATA_ADDR; "" means don't send
+	ReportAddr string  // UDP address to send status reports to, normally REPORT_ADDR; "" means don't
+	Interface  string  // network interface for multicast; "" means the system's choice
+	TTL        int     // time-to-live of multicast datagrams, in hops
+	Range      float64 // display range, in metres; 0 means the range of each scanline
+}
+
+// DefaultConfig is used for any values not given in ogdar.toml.
+var DefaultConfig = Config{
+	Addr:       "",
+	ReportAddr: REPORT_ADDR,
+	Interface:  "",
+	TTL:        1,
+	Range:      0,
+}
+
+// appendSpoke appends spoke number spoke, with counter count, display
+// range rng metres and cells c, to the datagram b.  Cells must be less
+// than 1<<CELL_BITS.
+func appendSpoke(b []byte, spoke int, count uint16, rng float64, c *[SPOKE_LEN]byte) []byte {
+	var h [SPOKE_HDR_SIZE]byte
+	h[0] = SPOKE_HDR_SIZE
+	h[1] = STATUS_VALID
+	binary.LittleEndian.PutUint16(h[2:], count)
+	copy(h[4:], spokeMark[:])
+	binary.LittleEndian.PutUint16(h[8:], uint16(spoke*ANGLES/SPOKES))
+	binary.LittleEndian.PutUint16(h[10:], HEADING_NONE)
+	binary.LittleEndian.PutUint32(h[12:], uint32(math.Round(rng*math.Sqrt2/10))&0xffffff)
+	b = append(b, h[:]...)
+	for i := 0; i < SPOKE_LEN; i += 2 {
+		b = append(b, c[i]|c[i+1]<<CELL_BITS)
+	}
+	return b
+}
+
+// Spoke is a decoded spoke.
+type Spoke struct {
+	Count uint16           // spoke counter
+	Angle int              // in units of 360/ANGLES degrees
+	Range float64          // display range, in metres
+	Cells [SPOKE_LEN]uint8 // cells, unpacked; each is less than 1<<CELL_BITS
+}
+
+// Decode returns the spokes in datagram b, ignoring any which are
+// truncated or not valid.
+func Decode(b []byte) (sp []Spoke) {
+	if len(b) < FRAME_HDR_SIZE {
+		return
+	}
+	for b = b[FRAME_HDR_SIZE:]; len(b) >= SPOKE_HDR_SIZE+SPOKE_BYTES; b = b[SPOKE_HDR_SIZE+SPOKE_BYTES:] {
+		if b[0] != SPOKE_HDR_SIZE || b[1] != STATUS_VALID {
+			continue
+		}
+		s := Spoke{
+			Count: binary.LittleEndian.Uint16(b[2:]),
+			Angle: int(binary.LittleEndian.Uint16(b[8:])),
+			Range: float64(binary.LittleEndian.Uint32(b[12:])&0xffffff) * 10 / math.Sqrt2,
+		}
+		for i, v := range b[SPOKE_HDR_SIZE : SPOKE_HDR_SIZE+SPOKE_BYTES] {
+			s.Cells[2*i], s.Cells[2*i+1] = v&0x0f, v>>CELL_BITS
+		}
+		sp = append(sp, s)
+	}
+	return
+}
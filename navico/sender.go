@@ -0,0 +1,184 @@
+package navico
+
+// Assembling spokes and sending them over UDP.
+
+import (
+	"github.com/jbrzusto/ogdar/azimuth"
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/multicast"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QUEUE_LEN is the number of datagrams which can wait to be sent;
+// further datagrams are dropped until there is room.
+const QUEUE_LEN = 256
+
+// Sender sends scanlines as BR24 spokes.  It is safe for concurrent
+// use.
+type Sender struct {
+	sent    uint64 // datagrams sent; first for 64-bit alignment of atomic access on ARM
+	dropped uint64 // datagrams not sent because the queue was full, or because of an error
+	mu      sync.Mutex
+	cfg     Config
+	ranging buffer.RangeParams
+	azi     *azimuth.Model
+	spoke   int             // spoke being assembled; -1 if none
+	cells   [SPOKE_LEN]byte // cells of the spoke being assembled
+	rng     float64         // display range of the spoke being assembled
+	count   uint16          // spoke counter
+	frame   []byte          // datagram being filled
+	queue   chan []byte
+}
+
+// NewSender returns a Sender which takes the azimuth of each scanline
+// from azi.  Call Run to start it.
+func NewSender(cfg Config, azi *azimuth.Model) *Sender {
+	return &Sender{cfg: cfg, azi: azi, spoke: -1, queue: make(chan []byte, QUEUE_LEN)}
+}
+
+// SetConfig changes the sender's configuration.  Changes to Addr,
+// ReportAddr, Interface and TTL take effect when Run is next called.
+func (s *Sender) SetConfig(cfg Config) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+}
+
+// SetRanging sets the digitizer settings used to compute the ranges of
+// samples.
+func (s *Sender) SetRanging(r buffer.RangeParams) {
+	s.mu.Lock()
+	s.ranging = r
+	s.mu.Unlock()
+}
+
+// Stats returns the number of datagrams sent and dropped.
+func (s *Sender) Stats() (sent, dropped uint64) {
+	return atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.dropped)
+}
+
+// AddScanline adds l to the spoke for its azimuth, if that is known.
+// It does not block, so it can be an Acquirer hook.
+func (s *Sender) AddScanline(l *buffer.Scanline) {
+	if !s.azi.Valid() {
+		return
+	}
+	spoke := int(s.azi.Azimuth(&l.ScanlineHdr)*SPOKES/360) % SPOKES
+	s.mu.Lock()
+	r, rng := s.ranging, s.cfg.Range
+	s.mu.Unlock()
+	if l.NumSamples() == 0 {
+		return
+	}
+	if rng <= 0 {
+		rng = l.MaxRange(r)
+	}
+	if rng <= 0 {
+		return
+	}
+	var c [SPOKE_LEN]byte
+	l.Reduce(c[:], r, rng, CELL_BITS)
+	// reducing copies the samples; check that they weren't overwritten
+	// while it did
+	if !l.Valid() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if spoke == s.spoke {
+		for i, v := range c {
+			if v > s.cells[i] {
+				s.cells[i] = v
+			}
+		}
+		return
+	}
+	if s.spoke >= 0 {
+		s.emit(s.spoke)
+		if gap := (spoke - s.spoke + SPOKES) % SPOKES; gap <= MAX_FILL {
+			for i := 1; i < gap; i++ {
+				s.emit((s.spoke + i) % SPOKES)
+			}
+		}
+	}
+	s.spoke, s.cells, s.rng = spoke, c, rng
+}
+
+// emit adds the spoke being assembled to the datagram being filled, as
+// spoke number spoke, queueing the datagram if it is full.  s.mu must
+// be held.
+func (s *Sender) emit(spoke int) {
+	if s.frame == nil {
+		s.frame = make([]byte, FRAME_HDR_SIZE, FRAME_HDR_SIZE+SPOKES_PER_FRAME*(SPOKE_HDR_SIZE+SPOKE_BYTES))
+	}
+	s.frame = appendSpoke(s.frame, spoke, s.count, s.rng, &s.cells)
+	s.count++
+	if len(s.frame) < cap(s.frame) {
+		return
+	}
+	select {
+	case s.queue <- s.frame:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+	s.frame = nil
+}
+
+// Run sends queued datagrams, and status reports, to the configured
+// addresses until stop is closed.  It returns an error if it can't
+// set up the socket.
+func (s *Sender) Run(stop <-chan struct{}) error {
+	s.mu.Lock()
+	cfg := s.cfg
+	s.mu.Unlock()
+	data, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	var report *net.UDPAddr
+	if cfg.ReportAddr != "" {
+		if report, err = net.ResolveUDPAddr("udp4", cfg.ReportAddr); err != nil {
+			return err
+		}
+	}
+	conn, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tick := time.NewTicker(REPORT_INTERVAL)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-tick.C:
+			if report != nil {
+				conn.WriteToUDP(statusReport[:], report)
+			}
+		case b := <-s.queue:
+			if _, err := conn.WriteToUDP(b, data); err != nil {
+				atomic.AddUint64(&s.dropped, 1)
+				continue
+			}
+			atomic.AddUint64(&s.sent, 1)
+		}
+	}
+}
+
+// listen returns a UDP socket for sending, with its multicast
+// interface and TTL set as in cfg.
+func listen(cfg Config) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := multicast.SetOptions(conn, cfg.Interface, cfg.TTL); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/azimuth"
 	. "github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/capturedb"
 	. "github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/monitor"
+	"github.com/jbrzusto/ogdar/timing"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -12,33 +21,159 @@ import (
 var Radar radar
 
 
+// MonitorConfig holds tolerances for the radar health monitor.  Values
+// not given in the config file keep their defaults.
+var MonitorConfig = monitor.DefaultConfig
+
+// ARPConfig holds parameters for statistical estimation of the ARP's
+// position in the ACP sequence.
+var ARPConfig = azimuth.DefaultEstimatorConfig
+
+// TimeConfig holds parameters for the model converting ADC clock
+// counts to UTC.
+var TimeConfig = timing.DefaultConfig
+
+// ArchiveConfig holds parameters for archiving sweeps to disk.
+var ArchiveConfig = archive.DefaultConfig
+
+var printConfig = flag.Bool("print-config", false, "print the configuration ogdar would use, with the source of each value, then exit")
+
+func init() {
+	flag.StringVar(&configPath, "config", "", "read configuration from `FILE` instead of searching for ogdar.toml")
+}
+
 // keep track of whether a valid config file was found
 // so we can show the user on the web interface.
 var configFound bool
 
 func main() {
+	flag.Usage = func() { cmdHelp(nil) }
+	flag.Parse()
+	if *printConfig {
+		if err := printEffectiveConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "ogdar: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if args := flag.Args(); len(args) > 0 {
+		found, err := runCommand(args)
+		if !found {
+			fmt.Fprintf(os.Stderr, "ogdar: unknown command %q; try 'ogdar help'\n", args[0])
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ogdar %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		return
+	}
 	Init()
-	configFound = loadConfig()
+	err := loadConfig()
+	if err != nil && err != errConfigNotFound {
+		fmt.Fprintln(os.Stderr, err)
+		Fini()
+		os.Exit(1)
+	}
+	configFound = err == nil
 	if !configFound {
-		fmt.Println("--- CRITICAL WARNING! ---\n\n  Config file 'ogdar.toml' not found.\n\nI am using a (likely bogus) default config.\n\n")
+		fmt.Println("--- CRITICAL WARNING! ---\n\n  Config file 'ogdar.toml' not found.\n\nI am using a (likely bogus) default config.")
+		fmt.Println()
 		setDefaultConfig()
 	}
 	fmt.Printf("Using radar: \n%+v\n", Radar)
-	buffer := SampleBuff{}
+	if ActiveProfile != "" {
+		fmt.Printf("Using profile %s\n", ActiveProfile)
+	}
+	scanlines := &ScanlineBuff{SampleBuff: new(SampleBuff)}
 	clks, _ := GetRegPtrByName("Clocks_lo")
 	fmt.Printf("Clocks pointer is %p\n", clks)
 	fmt.Printf("Clocks is %d\n", *clks)
-	fmt.Printf("Length of buffer is %d\n", len(buffer.SampBuff))
+	fmt.Printf("Length of buffer is %d\n", len(scanlines.SampBuff))
 	for i := 1; i < NumRegs(); i++ {
 		if i != 0 {
 			p, _ := GetRegPtrByIndex(i)
 			fmt.Printf("%-25s: *(%p) = %d\n", RegName(i), p, *p)
 		}
 	}
-	nt := Regs.TrigCount
-	for i := 1; i < 100; i++ {
-		time.Sleep(time.Second)
-		fmt.Printf("Clocks = %d, PRF = %d, ARPCount = %d, ACPPerARP = %d\n", *clks, (Regs.TrigCount-nt)/uint32(i), Regs.ARPCount, Regs.ACPPerARP)
+	mon := monitor.New(MonitorConfig, expectedFor(&Radar, &Profiles, ActiveProfile))
+	changes := make(chan monitor.Status, 1)
+	mon.Notify(changes)
+	stop := make(chan struct{})
+	go mon.Run(stop)
+	clock := timing.New(TimeConfig)
+	go clock.Run(stop)
+	est := azimuth.NewARPEstimator(uint32(Radar.ACPsPerRotation), ARPConfig)
+	if err := est.Load(Regs.ARPCount, Regs.ACPCount); err != nil {
+		fmt.Println(err)
+	}
+	azi := azimuth.New(uint32(Radar.ACPsPerRotation), Radar.HeadingOffset)
+	azi.UseEstimator(est)
+	acq := NewAcquirer(scanlines)
+	// time scanlines by their trigger clocks, once the time model has data
+	now := func(s *Scanline) time.Time {
+		if t, _, ok := clock.Time(s.TrigClock); ok {
+			return t
+		}
+		return time.Now()
+	}
+	asm := NewSweepAssembler(func() uint32 { return Regs.TrigDelay }, Radar.RangeDelay)
+	asm.SetClock(now)
+	acq.AddHook(asm.Add)
+	arch := archive.NewWriter(ArchiveConfig, Radar.archiveParams(ActiveProfile))
+	asm.OnSweep(arch.Add)
+	if ArchiveConfig.DB != "" {
+		db, err := capturedb.Open(ArchiveConfig.DB, ArchiveConfig.DBLayout)
+		if err != nil {
+			fmt.Printf("Unable to open capture database: %v\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		arch.SetStore(db)
+	}
+	go arch.Run(stop)
+	if ArchiveConfig.Dir != "" {
+		fmt.Printf("Archiving one sweep in %d to %s\n", ArchiveConfig.Every, ArchiveConfig.Dir)
+	}
+	if ArchiveConfig.DB != "" {
+		fmt.Printf("Recording one sweep in %d in %s\n", ArchiveConfig.Every, ArchiveConfig.DB)
+	}
+	acqDone := make(chan struct{})
+	go func() {
+		acq.Run(stop)
+		close(acqDone)
+	}()
+	srv := startStream(StreamConfig, acq, asm, stop)
+	snd := startAsterix(AsterixConfig, acq, azi, now, stop)
+	nav := startNavico(NavicoConfig, acq, azi, stop)
+	rl := &reloader{acq: acq, mon: mon, azi: azi, est: est, clock: clock, asm: asm, arch: arch, srv: srv, snd: snd, nav: nav}
+	var path string
+	if configFound {
+		path, _ = findConfigFile()
+	}
+	rl.web = startWeb(WebConfig, &webBackend{rl: rl, path: path}, acq, asm, azi, stop)
+	rl.setOutputParams()
+	if configFound {
+		watchConfig(rl.reload)
+	}
+	tick := time.NewTicker(250 * time.Millisecond)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case s := <-changes:
+			fmt.Printf("%s radar status: %s\n", s.Time.Format("2006-01-02 15:04:05"), s)
+			go rl.autoSelect(s.PRF) // waits for the acquirer, so don't block here
+		case <-tick.C:
+			azi.Update()
+		case <-sigs:
+			close(stop)
+			<-acqDone // don't unmap the FPGA while it is being read
+			if err := est.Save(); err != nil {
+				fmt.Println(err)
+			}
+			Fini()
+			return
+		}
 	}
-	Fini()
 }
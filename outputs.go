@@ -0,0 +1,88 @@
+package main
+
+// Network outputs.  These serve scanlines and sweeps from either the
+// FPGA or a replay of archived sweeps, so are started the same way by
+// main and by the replay command.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/asterix"
+	"github.com/jbrzusto/ogdar/azimuth"
+	. "github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/navico"
+	"github.com/jbrzusto/ogdar/stream"
+	"time"
+)
+
+// scanlineSource is where scanlines come from: an Acquirer reading
+// the FPGA, or a replay.Source.
+type scanlineSource interface {
+	AddHook(f func(*Scanline))
+}
+
+// StreamConfig holds parameters for the TCP stream server.
+var StreamConfig = stream.DefaultConfig
+
+// AsterixConfig holds parameters for ASTERIX CAT240 video output.
+var AsterixConfig = asterix.DefaultConfig
+
+// NavicoConfig holds parameters for Navico BR24 spoke output.
+var NavicoConfig = navico.DefaultConfig
+
+// startStream starts serving scanlines from src and sweeps from asm
+// over TCP, if cfg.Addr is set, until stop is closed.  The server is
+// returned even if it is not started, so that its settings can be
+// updated on reload.
+func startStream(cfg stream.Config, src scanlineSource, asm *SweepAssembler, stop <-chan struct{}) *stream.Server {
+	srv := stream.New(cfg)
+	if cfg.Addr == "" {
+		return srv
+	}
+	src.AddHook(srv.AddScanline)
+	asm.OnSweep(srv.AddSweep)
+	go func() {
+		if err := srv.Run(stop); err != nil {
+			fmt.Printf("Unable to serve stream: %v\n", err)
+		}
+	}()
+	fmt.Printf("Streaming scanlines and sweeps on %s\n", cfg.Addr)
+	return srv
+}
+
+// startAsterix starts sending scanlines from src as ASTERIX CAT240
+// video, if cfg.Addr is set, until stop is closed.  Azimuths come from
+// azi and times from timeOf.  The sender is returned even if it is not
+// started, so that its settings can be updated on reload.
+func startAsterix(cfg asterix.Config, src scanlineSource, azi *azimuth.Model, timeOf func(*Scanline) time.Time, stop <-chan struct{}) *asterix.Sender {
+	snd := asterix.NewSender(cfg, azi, timeOf)
+	if cfg.Addr == "" {
+		return snd
+	}
+	src.AddHook(snd.AddScanline)
+	go func() {
+		if err := snd.Run(stop); err != nil {
+			fmt.Printf("Unable to send ASTERIX video: %v\n", err)
+		}
+	}()
+	fmt.Printf("Sending ASTERIX CAT240 video to %s\n", cfg.Addr)
+	return snd
+}
+
+// startNavico starts sending scanlines from src as Navico BR24 spokes,
+// if cfg.Addr is set, until stop is closed.  Azimuths come from azi.
+// The sender is returned even if it is not started, so that its
+// settings can be updated on reload.
+func startNavico(cfg navico.Config, src scanlineSource, azi *azimuth.Model, stop <-chan struct{}) *navico.Sender {
+	nav := navico.NewSender(cfg, azi)
+	if cfg.Addr == "" {
+		return nav
+	}
+	src.AddHook(nav.AddScanline)
+	go func() {
+		if err := nav.Run(stop); err != nil {
+			fmt.Printf("Unable to send Navico spokes: %v\n", err)
+		}
+	}()
+	fmt.Printf("Sending Navico BR24 spokes to %s\n", cfg.Addr)
+	return nav
+}
@@ -0,0 +1,229 @@
+package main
+
+// Named operating profiles.  Marine radars change PRF (and pulse
+// length) with range scale, and each mode needs its own digitizer
+// settings, e.g. a shorter TrigLatency at higher PRF, or more samples
+// at longer range.  A profile is a named set of [digdar] values which
+// override those in the [digdar] section, along with the PRF expected
+// in that mode:
+//
+//   [profiles]
+//   Active = "short"
+//   AutoSelect = true
+//
+//   [profiles.short]
+//   PRF = 2100
+//   [profiles.short.digdar]
+//   NumSamp = 2000
+//
+// Every register set by a profile must also be set in [digdar], so
+// that switching profiles always sets it.  The active profile can be
+// changed at runtime by editing Active in
+// the config file.  If AutoSelect is true, ogdar switches to the
+// profile whose PRF matches the measured PRF whenever the radar
+// monitor reports a change.  Profile names are case-insensitive, and
+// are shown in lower case.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/buffer"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/monitor"
+	"github.com/spf13/cast"
+	"math"
+	"sort"
+	"strings"
+)
+
+// profile is a named set of digitizer settings for one radar mode.
+type profile struct {
+	Name   string
+	PRF    uint16                 // PRF expected in this mode, in Hz; 0 means use PRF from [radar]
+	Digdar map[string]interface{} // [profiles.NAME.digdar] values, keyed by lower-cased register name
+	Regs   []regChange            // valid values from Digdar, in storage order
+}
+
+// profileSet holds the [profiles] section of the config file.
+type profileSet struct {
+	Active     string      // name of profile to use at startup; "" means none
+	AutoSelect bool        // if true, switch to the profile whose PRF matches the measured PRF
+	List       []*profile  // profiles, sorted by name
+	Base       []regChange // register values from [digdar], which profiles override
+}
+
+// Profiles holds the operating profiles from the config file.
+var Profiles profileSet
+
+// ActiveProfile is the name of the profile in use; "" means none.
+// This differs from Profiles.Active after auto-selection.
+var ActiveProfile string
+
+// find returns the profile called name, or nil if there is none.
+func (ps *profileSet) find(name string) *profile {
+	for _, p := range ps.List {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// matchPRF returns the profile whose PRF is within the fraction tol
+// of prf, or nil if there is none.
+func (ps *profileSet) matchPRF(prf, tol float64) *profile {
+	for _, p := range ps.List {
+		if p.PRF > 0 && math.Abs(prf-float64(p.PRF)) <= tol*float64(p.PRF) {
+			return p
+		}
+	}
+	return nil
+}
+
+// normalizeProfiles drops unknown keys from the [profiles] section
+// vals, returning the rest, and a warning for each key dropped.
+func normalizeProfiles(vals map[string]interface{}) (out map[string]interface{}, warnings []string) {
+	out = make(map[string]interface{})
+	var readOnly []string
+	for _, k := range sortedKeys(vals) {
+		p, ok := vals[k].(map[string]interface{})
+		if !ok {
+			if k == "active" || k == "autoselect" {
+				out[k] = vals[k]
+			} else {
+				warnings = append(warnings, fmt.Sprintf("ignoring unknown key profiles.%s", k))
+			}
+			continue
+		}
+		np := make(map[string]interface{})
+		for _, pk := range sortedKeys(p) {
+			switch dd, isMap := p[pk].(map[string]interface{}); {
+			case pk == "prf":
+				np[pk] = p[pk]
+			case pk == "digdar" && isMap:
+				ndd := make(map[string]interface{})
+				for _, rk := range sortedKeys(dd) {
+					name, known, settable := lookupKey("digdar", rk)
+					switch {
+					case !known:
+						warnings = append(warnings, fmt.Sprintf("ignoring unknown key profiles.%s.digdar.%s", k, rk))
+					case !settable:
+						readOnly = append(readOnly, name)
+					default:
+						ndd[rk] = dd[rk]
+					}
+				}
+				np[pk] = ndd
+			default:
+				warnings = append(warnings, fmt.Sprintf("ignoring unknown key profiles.%s.%s", k, pk))
+			}
+		}
+		out[k] = np
+	}
+	if len(readOnly) > 0 {
+		warnings = append(warnings, "ignoring read-only registers in profiles: "+strings.Join(readOnly, ", "))
+	}
+	return
+}
+
+// decodeProfiles decodes and validates the [profiles] section vals,
+// as returned by normalizeProfiles.
+func decodeProfiles(vals map[string]interface{}) (ps profileSet, errs []error) {
+	var err error
+	if ps.Active, err = cast.ToStringE(vals["active"]); err != nil {
+		errs = append(errs, errorf("profiles.Active", "invalid value %v; must be a profile name", vals["active"]))
+	}
+	ps.Active = strings.ToLower(ps.Active)
+	if x, ok := vals["autoselect"]; ok {
+		if ps.AutoSelect, err = cast.ToBoolE(x); err != nil {
+			errs = append(errs, errorf("profiles.AutoSelect", "invalid value %v; must be true or false", x))
+		}
+	}
+	for _, name := range sortedKeys(vals) {
+		m, ok := vals[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p := &profile{Name: name}
+		if x, ok := m["prf"]; ok {
+			if p.PRF, err = cast.ToUint16E(x); err != nil || p.PRF > buffer.MAX_PRF {
+				errs = append(errs, errorf("profiles."+name+".PRF", "invalid value %v; allowed range is 0...%d", x, buffer.MAX_PRF))
+			}
+		}
+		p.Digdar, _ = m["digdar"].(map[string]interface{})
+		var perrs []error
+		p.Regs, perrs = parseDigdar(p.Digdar, "profiles."+name+".digdar")
+		errs = append(errs, perrs...)
+		ps.List = append(ps.List, p)
+	}
+	sort.Slice(ps.List, func(i, j int) bool { return ps.List[i].Name < ps.List[j].Name })
+	return
+}
+
+// checkProfiles checks that the profiles in c are consistent with
+// each other and with the rest of c.
+func checkProfiles(c *configFile) (errs []error) {
+	ps := &c.Profiles
+	if ps.Active != "" && ps.find(ps.Active) == nil {
+		errs = append(errs, errorf("profiles.Active", "no profile named %q", ps.Active))
+	}
+	base := make(map[*RegField]bool, len(ps.Base))
+	for _, rc := range ps.Base {
+		base[rc.f] = true
+	}
+	for i, p := range ps.List {
+		section := "profiles." + p.Name + ".digdar"
+		for _, rc := range p.Regs {
+			if !base[rc.f] {
+				errs = append(errs, errorf(section+"."+rc.f.Name, "must also be given in [digdar], so it can be restored when switching to other profiles"))
+			}
+		}
+		errs = append(errs, checkDigdar(ps.regsFor(p.Name), section)...)
+		if !ps.AutoSelect {
+			continue
+		}
+		if p.PRF == 0 {
+			errs = append(errs, errorf("profiles."+p.Name+".PRF", "must be given when AutoSelect is true"))
+			continue
+		}
+		for _, q := range ps.List[i+1:] {
+			if q.PRF > 0 && ps.matchPRF(float64(q.PRF), c.Monitor.PRFTolerance) == p {
+				errs = append(errs, errorf("profiles."+q.Name+".PRF", "value %d is within monitor.PRFTolerance of profile %s's, so AutoSelect can't tell them apart", q.PRF, p.Name))
+			}
+		}
+	}
+	return
+}
+
+// regsFor returns the register values to use with the profile called
+// name: those in [digdar], overridden by those in the profile.
+func (ps *profileSet) regsFor(name string) []regChange {
+	p := ps.find(name)
+	if p == nil {
+		return ps.Base
+	}
+	vals := make(map[*RegField]uint64, len(ps.Base)+len(p.Regs))
+	for _, rc := range ps.Base {
+		vals[rc.f] = rc.v
+	}
+	for _, rc := range p.Regs {
+		vals[rc.f] = rc.v
+	}
+	// keep storage order
+	var regs []regChange
+	for i := range RegFields {
+		if v, ok := vals[&RegFields[i]]; ok {
+			regs = append(regs, regChange{&RegFields[i], v})
+		}
+	}
+	return regs
+}
+
+// expectedFor returns what the radar monitor should expect of radar
+// r with the profile called name from ps in use.
+func expectedFor(r *radar, ps *profileSet, name string) monitor.Expected {
+	e := r.expected()
+	if p := ps.find(name); p != nil && p.PRF > 0 {
+		e.PRF = float64(p.PRF)
+	}
+	return e
+}
@@ -1,9 +1,42 @@
 package main
 
+import (
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/monitor"
+)
+
 // Radar represents information about a specific radar
 type radar struct {
 	Model string // name of the radar make/model; used for display and possibly in output files
 	PRF uint16 // the approximate Pulse Repetition Frequency for the mode you want to digitize
 	ACPsPerRotation uint16 // how many ACPs in one rotation of the antenna?
 	Power uint16 // power radar transmits at, in watts.
+	HeadingOffset float64 // azimuth of the antenna when the ARP is detected, in degrees clockwise from the heading reference
+	RangeDelay float64 // ADC clocks between trigger detection and the pulse leaving the antenna
+	Pulse string // pulse length in use, for models in the catalogue (see radarmodels.go); selects the PRF
+	TrigPolarity string // "positive" or "negative" for the direction of trigger pulses; "" if unknown
+	VideoPolarity string // "positive" or "negative" for the direction of echoes in the video signal; "" if unknown
+	Beamwidth float64 // horizontal beamwidth of the antenna, in degrees; 0 if unknown
+	RPM float64 // nominal antenna rotation rate; 0 if unknown
+}
+
+// expected returns the values the health monitor should expect.
+func (r *radar) expected() monitor.Expected {
+	return monitor.Expected{PRF: float64(r.PRF), ACPsPerRotation: uint32(r.ACPsPerRotation)}
+}
+
+// archiveParams returns the parameters to record with archived sweeps
+// while profile is in use.
+func (r *radar) archiveParams(profile string) archive.Params {
+	return archive.Params{
+		Model:           r.Model,
+		Pulse:           r.Pulse,
+		Profile:         profile,
+		PRF:             r.PRF,
+		ACPsPerRotation: r.ACPsPerRotation,
+		Power:           r.Power,
+		HeadingOffset:   r.HeadingOffset,
+		Beamwidth:       r.Beamwidth,
+		RPM:             r.RPM,
+	}
 }
@@ -0,0 +1,201 @@
+package main
+
+// Catalogue of radar models.  Setting Model in [radar] to one of
+// these fills in the rest of the section from the catalogue; any
+// field given in the file overrides the catalogue's value:
+//
+//   [radar]
+//   Model = "Furuno FR-8252"
+//   Pulse = "long"          # PRF = 600 from the catalogue
+//   ACPsPerRotation = 900   # e.g. for a modified encoder
+//
+// Model names are matched ignoring case, spaces and punctuation, so
+// "furuno fr8252" is the same as "Furuno FR-8252".  Values are nominal
+// ones from the manufacturers' documentation; individual radars, and
+// different antennas, may differ, so check them with 'ogdar setup'.
+// Pulse lengths whose PRF is above buffer.MAX_PRF are left out, as
+// ogdar can't keep up with them; e.g. the FAR-2127's 3000 Hz short
+// pulse.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/fpga"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// pulseMode is a pulse length a radar can transmit.
+type pulseMode struct {
+	Name   string  // name used for Pulse in [radar]
+	Length float64 // pulse length, in microseconds
+	PRF    uint16  // pulse repetition frequency used with this pulse length, in Hz
+}
+
+// radarModel is an entry in the catalogue of radar models.
+type radarModel struct {
+	Name            string
+	Power           uint16      // transmitted power, in watts
+	ACPsPerRotation uint16      // ACPs in one rotation of the antenna
+	Pulses          []pulseMode // pulse lengths, shortest first; the first is the default
+	TrigPolarity    string      // direction of trigger pulses: "positive" or "negative"
+	VideoPolarity   string      // direction of echoes in the video signal: "positive" or "negative"
+	Beamwidth       float64     // horizontal beamwidth of the standard antenna, in degrees
+	RPM             float64     // nominal antenna rotation rate
+}
+
+// furunoPulses are the pulse lengths of Furuno's FR-series radars.
+var furunoPulses = []pulseMode{
+	{"short", 0.08, 2100},
+	{"medium", 0.3, 1200},
+	{"long", 0.8, 600},
+}
+
+// radarModels is the catalogue of radar models.
+var radarModels = []radarModel{
+	{Name: "Furuno FR-1955", Power: 12000, ACPsPerRotation: 450, Pulses: furunoPulses, TrigPolarity: "positive", VideoPolarity: "negative", Beamwidth: 1.8, RPM: 24},
+	{Name: "Furuno FR-1965", Power: 25000, ACPsPerRotation: 450, Pulses: furunoPulses, TrigPolarity: "positive", VideoPolarity: "negative", Beamwidth: 1.8, RPM: 24},
+	{Name: "Furuno FR-8252", Power: 25000, ACPsPerRotation: 450, Pulses: furunoPulses, TrigPolarity: "positive", VideoPolarity: "negative", Beamwidth: 1.23, RPM: 24},
+	{Name: "Furuno FAR-2127", Power: 25000, ACPsPerRotation: 2048, Pulses: []pulseMode{
+		{"medium", 0.3, 1500},
+		{"long", 1.2, 600},
+	}, TrigPolarity: "positive", VideoPolarity: "negative", Beamwidth: 1.0, RPM: 24},
+	{Name: "Bridgemaster E", Power: 25000, ACPsPerRotation: 4096, Pulses: []pulseMode{
+		{"short", 0.05, 1800},
+		{"medium", 0.25, 1800},
+		{"long", 0.75, 785},
+	}, TrigPolarity: "positive", VideoPolarity: "positive", Beamwidth: 1.0, RPM: 28},
+	{Name: "Koden MDC-2060", Power: 6000, ACPsPerRotation: 2048, Pulses: []pulseMode{
+		{"medium", 0.25, 1500},
+		{"long", 0.8, 750},
+	}, TrigPolarity: "positive", VideoPolarity: "positive", Beamwidth: 1.2, RPM: 24},
+}
+
+// modelKey returns name lower-cased, without spaces or punctuation,
+// for matching model names.
+func modelKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// findRadarModel returns the catalogue entry for the model called
+// name, or nil if there is none.
+func findRadarModel(name string) *radarModel {
+	key := modelKey(name)
+	if key == "" {
+		return nil
+	}
+	for i := range radarModels {
+		if modelKey(radarModels[i].Name) == key {
+			return &radarModels[i]
+		}
+	}
+	return nil
+}
+
+// findPulse returns the model's pulse mode called name, or the
+// default one if name is "".  It returns nil if there is none.
+func (m *radarModel) findPulse(name string) *pulseMode {
+	if name == "" {
+		return &m.Pulses[0]
+	}
+	for i := range m.Pulses {
+		if strings.EqualFold(m.Pulses[i].Name, name) {
+			return &m.Pulses[i]
+		}
+	}
+	return nil
+}
+
+// pulseNames returns the names of the model's pulse lengths, for
+// messages.
+func (m *radarModel) pulseNames() string {
+	names := make([]string, len(m.Pulses))
+	for i, p := range m.Pulses {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// applyTo sets the fields of r from the catalogue, using the PRF for
+// pulse length pulse, and returns the names of the fields set.
+func (m *radarModel) applyTo(r *radar, pulse string) (fields []string) {
+	r.Model = m.Name
+	r.Power, r.ACPsPerRotation = m.Power, m.ACPsPerRotation
+	r.TrigPolarity, r.VideoPolarity = m.TrigPolarity, m.VideoPolarity
+	r.Beamwidth, r.RPM = m.Beamwidth, m.RPM
+	fields = []string{"Power", "ACPsPerRotation", "TrigPolarity", "VideoPolarity", "Beamwidth", "RPM"}
+	if p := m.findPulse(pulse); p != nil {
+		r.Pulse, r.PRF = p.Name, p.PRF
+		fields = append(fields, "Pulse", "PRF")
+	}
+	return
+}
+
+// checkRadar checks the values in [radar] which depend on the
+// catalogue.
+func checkRadar(r *radar) (errs []error) {
+	for _, p := range []struct{ key, val string }{{"radar.TrigPolarity", r.TrigPolarity}, {"radar.VideoPolarity", r.VideoPolarity}} {
+		if p.val != "" && p.val != "positive" && p.val != "negative" {
+			errs = append(errs, errorf(p.key, "invalid value %q; must be \"positive\" or \"negative\"", p.val))
+		}
+	}
+	if r.Pulse == "" {
+		return
+	}
+	if m := findRadarModel(r.Model); m == nil {
+		errs = append(errs, errorf("radar.Pulse", "model %q is not in the catalogue (see 'ogdar radars'), so give PRF instead", r.Model))
+	} else if m.findPulse(r.Pulse) == nil {
+		errs = append(errs, errorf("radar.Pulse", "invalid value %q; %s has %s", r.Pulse, m.Name, m.pulseNames()))
+	}
+	return
+}
+
+// polarityWarnings returns warnings about [digdar] values in regs
+// which don't match the polarities in r.
+func polarityWarnings(r *radar, regs []regChange) (warnings []string) {
+	val := make(map[string]int64, len(regs))
+	for _, rc := range regs {
+		val[rc.f.Name] = rc.f.Int(rc.v)
+	}
+	if opt, ok := val["Options"]; ok {
+		negate := fpga.DigdarOption(opt)&fpga.DDOPT_NEGATE_VIDEO != 0
+		switch {
+		case r.VideoPolarity == "negative" && !negate:
+			warnings = append(warnings, fmt.Sprintf("radar.VideoPolarity is negative, but digdar.Options doesn't invert video; add %d to invert it", fpga.DDOPT_NEGATE_VIDEO))
+		case r.VideoPolarity == "positive" && negate:
+			warnings = append(warnings, fmt.Sprintf("radar.VideoPolarity is positive, but digdar.Options inverts video; subtract %d to stop this", fpga.DDOPT_NEGATE_VIDEO))
+		}
+	}
+	ex, exOK := val["TrigThreshExcite"]
+	rx, rxOK := val["TrigThreshRelax"]
+	known := r.TrigPolarity == "positive" || r.TrigPolarity == "negative"
+	if exOK && rxOK && known && (ex > rx) != (r.TrigPolarity == "positive") {
+		warnings = append(warnings, fmt.Sprintf("radar.TrigPolarity is %s, but digdar.TrigThreshExcite (%d) and TrigThreshRelax (%d) detect %s pulses", r.TrigPolarity, ex, rx, otherPolarity(r.TrigPolarity)))
+	}
+	return
+}
+
+// otherPolarity returns the polarity opposite to p.
+func otherPolarity(p string) string {
+	if p == "positive" {
+		return "negative"
+	}
+	return "positive"
+}
+
+// writeRadarModels writes a table of the catalogue to w.
+func writeRadarModels(w io.Writer) {
+	fmt.Fprintf(w, "%-16s %6s %5s %-8s %-8s %5s %4s  %s\n", "Model", "Power", "ACPs", "Trigger", "Video", "Beam", "RPM", "Pulses (us @ PRF)")
+	for _, m := range radarModels {
+		var pulses []string
+		for _, p := range m.Pulses {
+			pulses = append(pulses, fmt.Sprintf("%s %g @ %d", p.Name, p.Length, p.PRF))
+		}
+		fmt.Fprintf(w, "%-16s %6d %5d %-8s %-8s %5g %4g  %s\n", m.Name, m.Power, m.ACPsPerRotation, m.TrigPolarity, m.VideoPolarity, m.Beamwidth, m.RPM, strings.Join(pulses, "; "))
+	}
+}
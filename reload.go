@@ -0,0 +1,276 @@
+package main
+
+// Live reloading of the config file.  While the digitizer is running,
+// edits to ogdar.toml take effect as soon as the file is saved:
+// changed [digdar] values are written to the FPGA between acquisitions,
+// and changed values in the other sections are passed to the models
+// and outputs which use them.  If any value in the edited file is
+// invalid, none of its changes are applied.
+//
+// The reloader also switches between operating profiles, when Active
+// is changed in the config file, or when AutoSelect is on and the
+// measured PRF matches another profile's.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/asterix"
+	"github.com/jbrzusto/ogdar/azimuth"
+	. "github.com/jbrzusto/ogdar/buffer"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/monitor"
+	"github.com/jbrzusto/ogdar/navico"
+	"github.com/jbrzusto/ogdar/stream"
+	"github.com/jbrzusto/ogdar/timing"
+	"github.com/jbrzusto/ogdar/web"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SET_REGS_TIMEOUT is how long a reload or profile switch waits for
+// its register changes to be made before carrying on without them.
+const SET_REGS_TIMEOUT = 2 * time.Second
+
+// reloader applies changes in the config file and operating profile
+// to a running digitizer.
+type reloader struct {
+	mu    sync.Mutex // serializes reloads and profile switches
+	acq   *Acquirer
+	mon   *monitor.Monitor
+	azi   *azimuth.Model
+	est   *azimuth.ARPEstimator
+	clock *timing.Model
+	asm   *SweepAssembler
+	arch  *archive.Writer
+	srv   *stream.Server
+	snd   *asterix.Sender
+	nav   *navico.Sender
+	web   *web.Server
+}
+
+// logf prints a timestamped message about a config reload.
+func logf(format string, args ...interface{}) {
+	fmt.Printf("%s config: %s\n", time.Now().Format("2006-01-02 15:04:05"), fmt.Sprintf(format, args...))
+}
+
+// reload reads the config file at path and applies any changes.
+func (rl *reloader) reload(path string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c, warnings, err := readConfigFile(path, true)
+	for _, w := range warnings {
+		logf("%s: %s", path, w)
+	}
+	if err != nil {
+		logf("%v", err)
+		logf("%s: rejected; keeping previous values", path)
+		return
+	}
+	// keep an auto-selected profile unless Active was edited, or the
+	// profile was removed
+	active := ActiveProfile
+	if c.Profiles.Active != Profiles.Active || c.Profiles.find(active) == nil {
+		active = c.Profiles.Active
+	}
+	regs := digdarChanges(c.Profiles.regsFor(active))
+	diffs := regDiffs(regs)
+	if active != ActiveProfile {
+		diffs = append(diffs, fmt.Sprintf("profile: %s -> %s", profileName(ActiveProfile), profileName(active)))
+	}
+	if c.Profiles.AutoSelect != Profiles.AutoSelect {
+		diffs = append(diffs, fmt.Sprintf("profiles.AutoSelect: %v -> %v", Profiles.AutoSelect, c.Profiles.AutoSelect))
+	}
+	oldExp, newExp := expectedFor(&Radar, &Profiles, ActiveProfile), expectedFor(&c.Radar, &c.Profiles, active)
+	if oldExp.PRF != newExp.PRF {
+		diffs = append(diffs, fmt.Sprintf("expected PRF: %g -> %g", oldExp.PRF, newExp.PRF))
+	}
+	diffs = append(diffs, diffFields("radar", Radar, c.Radar)...)
+	diffs = append(diffs, diffFields("monitor", MonitorConfig, c.Monitor)...)
+	diffs = append(diffs, diffFields("arp", ARPConfig, c.ARP)...)
+	diffs = append(diffs, diffFields("time", TimeConfig, c.Time)...)
+	diffs = append(diffs, diffFields("archive", ArchiveConfig, c.Archive)...)
+	diffs = append(diffs, diffFields("stream", StreamConfig, c.Stream)...)
+	diffs = append(diffs, diffFields("asterix", AsterixConfig, c.Asterix)...)
+	diffs = append(diffs, diffFields("navico", NavicoConfig, c.Navico)...)
+	diffs = append(diffs, diffFields("web", WebConfig, c.Web)...)
+	for _, d := range diffs {
+		logf("%s", d)
+	}
+	if !rl.setRegs(regs, SET_REGS_TIMEOUT) {
+		logf("digdar changes are waiting for the acquirer, and will be made shortly")
+	}
+	oldDB, oldLayout, oldAddr, oldAsterix, oldNavico, oldWebAddr := ArchiveConfig.DB, ArchiveConfig.DBLayout, StreamConfig.Addr, AsterixConfig, NavicoConfig, WebConfig.Addr
+	Radar, MonitorConfig, TimeConfig, ArchiveConfig = c.Radar, c.Monitor, c.Time, c.Archive
+	StreamConfig, AsterixConfig, NavicoConfig, WebConfig = c.Stream, c.Asterix, c.Navico, c.Web
+	Profiles, ActiveProfile = c.Profiles, active
+	rl.mon.SetExpected(newExp)
+	rl.mon.SetConfig(MonitorConfig)
+	rl.azi.SetRadar(uint32(Radar.ACPsPerRotation), Radar.HeadingOffset)
+	rl.est.SetACPsPerRotation(uint32(Radar.ACPsPerRotation))
+	rl.clock.SetConfig(TimeConfig)
+	rl.asm.SetRangeDelay(Radar.RangeDelay)
+	rl.arch.SetConfig(ArchiveConfig)
+	rl.srv.SetConfig(StreamConfig)
+	rl.snd.SetConfig(AsterixConfig)
+	rl.nav.SetConfig(NavicoConfig)
+	rl.web.SetConfig(WebConfig)
+	rl.setOutputParams()
+	if c.ARP != ARPConfig {
+		logf("changes to [arp] take effect when ogdar is restarted")
+	}
+	if c.Archive.DB != oldDB || c.Archive.DBLayout != oldLayout {
+		logf("changes to archive.DB and DBLayout take effect when ogdar is restarted")
+	}
+	if c.Stream.Addr != oldAddr {
+		logf("changes to stream.Addr take effect when ogdar is restarted")
+	}
+	if a := c.Asterix; a.Addr != oldAsterix.Addr || a.Interface != oldAsterix.Interface || a.TTL != oldAsterix.TTL {
+		logf("changes to asterix.Addr, Interface and TTL take effect when ogdar is restarted")
+	}
+	if n := c.Navico; n.Addr != oldNavico.Addr || n.ReportAddr != oldNavico.ReportAddr || n.Interface != oldNavico.Interface || n.TTL != oldNavico.TTL {
+		logf("changes to navico.Addr, ReportAddr, Interface and TTL take effect when ogdar is restarted")
+	}
+	if c.Web.Addr != oldWebAddr {
+		logf("changes to web.Addr take effect when ogdar is restarted")
+	}
+}
+
+// selectProfile switches to the profile called name, giving why in
+// the log.
+func (rl *reloader) selectProfile(name, why string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if name != "" && Profiles.find(name) == nil {
+		return fmt.Errorf("no profile named %q", name)
+	}
+	if name == ActiveProfile {
+		return nil
+	}
+	regs := digdarChanges(Profiles.regsFor(name))
+	logf("profile: %s -> %s (%s)", profileName(ActiveProfile), profileName(name), why)
+	for _, d := range regDiffs(regs) {
+		logf("%s", d)
+	}
+	if !rl.setRegs(regs, SET_REGS_TIMEOUT) {
+		logf("digdar changes are waiting for the acquirer, and will be made shortly")
+	}
+	ActiveProfile = name
+	rl.mon.SetExpected(expectedFor(&Radar, &Profiles, name))
+	rl.setOutputParams()
+	return nil
+}
+
+// setOutputParams tells the archive writer and network outputs about
+// the current radar, profile and digitizer settings.
+func (rl *reloader) setOutputParams() {
+	p := Radar.archiveParams(ActiveProfile)
+	r := RangeParams{TrigDelay: Regs.TrigDelay, RangeDelay: Radar.RangeDelay}
+	rl.arch.SetParams(p)
+	rl.srv.SetParams(FAST_ADC_CLOCK, r, p)
+	rl.snd.SetRanging(FAST_ADC_CLOCK, r)
+	rl.nav.SetRanging(r)
+	rl.web.SetRanging(r)
+}
+
+// autoSelect switches to the profile whose PRF matches the measured
+// prf, if AutoSelect is on and there is one.
+func (rl *reloader) autoSelect(prf float64) {
+	rl.mu.Lock()
+	p := Profiles.matchPRF(prf, MonitorConfig.PRFTolerance)
+	switchTo := Profiles.AutoSelect && prf > 0 && p != nil && p.Name != ActiveProfile
+	rl.mu.Unlock()
+	if !switchTo {
+		return
+	}
+	if err := rl.selectProfile(p.Name, fmt.Sprintf("measured PRF %.0f Hz", prf)); err != nil {
+		logf("%v", err)
+	}
+}
+
+// setRegs writes regs to the FPGA between acquisitions, waiting at
+// most timeout for this to happen, since rl.mu is held meanwhile.  It
+// returns false if the change is still pending, e.g. because the
+// acquirer is busy with a scope capture; the outputs are then told
+// about it once it has been made.  rl.mu must be held.
+func (rl *reloader) setRegs(regs []regChange, timeout time.Duration) bool {
+	if len(regs) == 0 {
+		return true
+	}
+	done := rl.acq.SetParams(func() {
+		for _, rc := range regs {
+			rc.f.Set(rc.v)
+		}
+	})
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		go func() {
+			<-done
+			rl.mu.Lock()
+			rl.setOutputParams()
+			rl.mu.Unlock()
+		}()
+		return false
+	}
+}
+
+// setReg sets the register f to v between acquisitions, as asked for
+// by from, waiting at most timeout for this to happen.  It returns
+// false if the change is still pending; see setRegs.  v is checked as
+// a value in the config file would be, along with the current values
+// of the other registers, and an error returned if it isn't allowed.
+func (rl *reloader) setReg(f *RegField, v uint64, timeout time.Duration, from string) (bool, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if err := checkReg(f, v); err != nil {
+		return false, err
+	}
+	fmt.Printf("%s %s: digdar.%s: %s -> %s\n", time.Now().Format("2006-01-02 15:04:05"), from, f.Name, f.Format(f.Get()), f.Format(v))
+	if !rl.setRegs([]regChange{{f, v}}, timeout) {
+		return false, nil
+	}
+	rl.setOutputParams()
+	return true, nil
+}
+
+// regDiffs describes the change each of regs makes to the FPGA.
+func regDiffs(regs []regChange) (diffs []string) {
+	for _, rc := range regs {
+		diffs = append(diffs, fmt.Sprintf("digdar.%s: %s -> %s", rc.f.Name, rc.f.Format(rc.f.Get()), rc.f.Format(rc.v)))
+	}
+	return
+}
+
+// profileName returns name, or "(none)" if it is empty.
+func profileName(name string) string {
+	if name == "" {
+		return "(none)"
+	}
+	return name
+}
+
+// digdarChanges returns those of regs whose values differ from the
+// FPGA's.
+func digdarChanges(regs []regChange) (changes []regChange) {
+	for _, rc := range regs {
+		if !rc.f.Same(rc.v, rc.f.Get()) {
+			changes = append(changes, rc)
+		}
+	}
+	return
+}
+
+// diffFields returns a description of each field whose value differs
+// between the structs a and b, which must be of the same type.
+func diffFields(section string, a, b interface{}) (diffs []string) {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		x, y := va.Field(i).Interface(), vb.Field(i).Interface()
+		if !reflect.DeepEqual(x, y) {
+			diffs = append(diffs, fmt.Sprintf("%s.%s: %v -> %v", section, va.Type().Field(i).Name, x, y))
+		}
+	}
+	return
+}
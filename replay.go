@@ -0,0 +1,122 @@
+package main
+
+// The replay command, which runs archived sweeps through the
+// scanline and sweep pipeline in place of the FPGA.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/azimuth"
+	. "github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/replay"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// cmdReplay replays archived sweep files, printing a summary of each
+// sweep as it is reassembled.
+func cmdReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 1, "replay this many times faster than recorded; 0 means as fast as possible")
+	loop := fs.Bool("loop", false, "replay the files over and over, until interrupted")
+	quiet := fs.Bool("q", false, "don't print a line for each sweep")
+	serve := fs.String("stream", "", "serve the replay over TCP on `ADDR` (default: [stream] Addr from the config file, if any)")
+	cat240 := fs.String("asterix", "", "send the replay as ASTERIX CAT240 video to UDP `ADDR` (default: [asterix] Addr from the config file, if any)")
+	spokes := fs.String("navico", "", "send the replay as Navico BR24 spokes to UDP `ADDR` (default: [navico] Addr from the config file, if any)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *speed < 0 {
+		return errors.New("usage: ogdar replay [-speed X] [-loop] [-q] [-stream ADDR] [-asterix ADDR] [-navico ADDR] FILE|DIR...")
+	}
+	// network outputs are configured as for live data, if there is a
+	// config file; other sections are ignored
+	if path, err := findConfigFile(); err == nil {
+		c, _, err := readConfigFile(path, true)
+		if err != nil {
+			return err
+		}
+		StreamConfig, AsterixConfig, NavicoConfig = c.Stream, c.Asterix, c.Navico
+	} else if err != errConfigNotFound {
+		return err
+	}
+	if *serve != "" {
+		StreamConfig.Addr = *serve
+	}
+	if *cat240 != "" {
+		AsterixConfig.Addr = *cat240
+	}
+	if *spokes != "" {
+		NavicoConfig.Addr = *spokes
+	}
+	paths, err := replay.Files(fs.Args())
+	if err != nil {
+		return err
+	}
+	scanlines := &ScanlineBuff{SampleBuff: new(SampleBuff)}
+	src := replay.New(scanlines, paths, *speed)
+	src.SetLoop(*loop)
+	// ranging comes from each file, not from the config
+	var ranging RangeParams
+	asm := NewSweepAssembler(func() uint32 { return ranging.TrigDelay }, 0)
+	now := func(*Scanline) time.Time { return src.Now() }
+	asm.SetClock(now)
+	stop := make(chan struct{})
+	srv := startStream(StreamConfig, src, asm, stop)
+	azi := azimuth.New(0, 0)
+	snd := startAsterix(AsterixConfig, src, azi, now, stop)
+	nav := startNavico(NavicoConfig, src, azi, stop)
+	src.OnFile(func(path string, h *archive.Header, sw *Sweep) {
+		asm.Flush()
+		ranging = h.Ranging
+		asm.SetRangeDelay(h.Ranging.RangeDelay)
+		srv.SetParams(h.ClockRate, h.Ranging, h.Params)
+		snd.SetRanging(h.ClockRate, h.Ranging)
+		nav.SetRanging(h.Ranging)
+		anchorReplay(azi, h, sw)
+	})
+	src.AddHook(asm.Add)
+	sweeps := 0
+	asm.OnSweep(func(sw *Sweep) {
+		sweeps++
+		if *quiet {
+			return
+		}
+		first, last := sw.Times()
+		fmt.Printf("ARP %d: %s, %.3f s, %d scanlines\n", sw.ARP, first.UTC().Format(time.RFC3339Nano), last.Sub(first).Seconds(), sw.NumLines())
+	})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		close(stop)
+	}()
+	fmt.Printf("Replaying %d sweep files at speed %g\n", len(paths), *speed)
+	err = src.Run(stop)
+	asm.Flush()
+	replayed, dropped := src.Stats()
+	fmt.Printf("Replayed %d sweeps, %d scanlines (%d dropped)\n", sweeps, replayed, dropped)
+	return err
+}
+
+// anchorReplay sets up azi to give azimuths for the scanlines of sw,
+// a replayed sweep with header h.  Each sweep begins at an ARP, so the
+// anchor is taken to be its first scanline's ACP count, and the ACP
+// period the average over the sweep; azimuths are within an ACP of
+// those the live model would have given.
+func anchorReplay(azi *azimuth.Model, h *archive.Header, sw *Sweep) {
+	azi.SetRadar(uint32(h.ACPsPerRotation), h.HeadingOffset)
+	n := sw.NumLines()
+	if n == 0 {
+		return
+	}
+	first, last := sw.Line(0), sw.Line(n-1)
+	if acps := last.ACPCount - first.ACPCount; acps > 0 && last.TrigClock > first.TrigClock {
+		azi.SetACPPeriod(float64(last.TrigClock-first.TrigClock) / float64(acps))
+	}
+	azi.SetAnchor(azimuth.Anchor{ARPCount: h.ARP, ACP: first.ACPCount})
+}
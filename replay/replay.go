@@ -0,0 +1,243 @@
+/*
+Package replay feeds sweeps recorded by the archive package back
+through ogdar's pipeline, as if they were being acquired, so that
+consumers of scanlines and sweeps can be developed and tested against
+real recordings without a radar or a Red Pitaya.
+
+A Source plays sweep files in order, copying each scanline into a
+buffer.ScanlineBuff and calling its hooks, as buffer.Acquirer does.
+Each scanline's original time is interpolated between the times of
+its file's first and last scanlines using the ADC clock, and is
+available from Now while the hooks run.  At speed 1 scanlines are
+emitted with their original spacing; at speed 10, ten times as fast;
+and at speed 0, as fast as the hooks take them.  Gaps between files
+longer than MAX_GAP (e.g. because only one sweep in several was
+archived) are shortened to MAX_GAP.
+*/
+package replay
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/buffer"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MAX_GAP is the longest pause between the end of one sweep file and
+// the start of the next, in recorded time.
+const MAX_GAP = time.Second
+
+// MIN_SLEEP is the smallest lead over the recorded timing for which a
+// Source sleeps; smaller leads are carried over to later scanlines.
+const MIN_SLEEP = time.Millisecond
+
+// Source replays sweep files into a ScanlineBuff.
+type Source struct {
+	replayed  uint64 // scanlines replayed; first for 64-bit alignment of atomic access on ARM
+	dropped   uint64 // scanlines not replayed for lack of buffer space
+	slb       *buffer.ScanlineBuff
+	paths     []string
+	speed     float64
+	mu        sync.Mutex
+	loop      bool
+	hooks     []func(*buffer.Scanline)
+	fileHooks []func(path string, h *archive.Header, sw *buffer.Sweep)
+	now       time.Time // recorded time of the scanline being replayed
+}
+
+// New returns a Source which replays the sweep files at paths, in
+// order, into slb at the given speed.  Call Run to start it.
+func New(slb *buffer.ScanlineBuff, paths []string, speed float64) *Source {
+	return &Source{slb: slb, paths: paths, speed: speed}
+}
+
+// Files returns the sweep files named by args: each argument is a
+// file, or a directory whose sweep files are taken in order of name,
+// which for files written by archive.Writer is order of time.
+func Files(args []string) (paths []string, err error) {
+	for _, a := range args {
+		fi, err := os.Stat(a)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, a)
+			continue
+		}
+		names, err := filepath.Glob(filepath.Join(a, "*"+archive.FILE_SUFFIX))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+		paths = append(paths, names...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no sweep files in %v", args)
+	}
+	return
+}
+
+// SetLoop sets whether the files are replayed over and over.  On each
+// pass, times are shifted so that they keep increasing; counts in the
+// scanline headers repeat.
+func (s *Source) SetLoop(loop bool) {
+	s.mu.Lock()
+	s.loop = loop
+	s.mu.Unlock()
+}
+
+// AddHook arranges for f to be called with each replayed scanline.  As
+// with buffer.Acquirer, f is called from the replay goroutine, so it
+// must be quick, and the scanline is only valid until overwritten in
+// the ring buffer.
+func (s *Source) AddHook(f func(*buffer.Scanline)) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, f)
+	s.mu.Unlock()
+}
+
+// OnFile arranges for f to be called with the path, header and sweep
+// of each file before its first scanline is replayed, from the replay
+// goroutine.
+func (s *Source) OnFile(f func(path string, h *archive.Header, sw *buffer.Sweep)) {
+	s.mu.Lock()
+	s.fileHooks = append(s.fileHooks, f)
+	s.mu.Unlock()
+}
+
+// Now returns the recorded time of the scanline being replayed, for
+// use as the clock given to buffer.SweepAssembler.SetClock.
+func (s *Source) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Stats returns the number of scanlines replayed, and the number
+// dropped for lack of buffer space.
+func (s *Source) Stats() (replayed, dropped uint64) {
+	return atomic.LoadUint64(&s.replayed), atomic.LoadUint64(&s.dropped)
+}
+
+// Run replays the files until they are done, or stop is closed.  It
+// returns an error if a file can't be read.
+func (s *Source) Run(stop <-chan struct{}) error {
+	p := pacer{speed: s.speed, wall: time.Now()}
+	var shift time.Duration // added to recorded times on later passes
+	for {
+		var first, last time.Time
+		for _, path := range s.paths {
+			h, sw, err := archive.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if first.IsZero() {
+				first = h.First
+			}
+			last = h.Last
+			s.mu.Lock()
+			fileHooks, hooks := s.fileHooks, s.hooks
+			s.mu.Unlock()
+			for _, f := range fileHooks {
+				f(path, h, sw)
+			}
+			times := lineTimes(h, sw)
+			for i := 0; i < sw.NumLines(); i++ {
+				t := times(i).Add(shift)
+				if !p.wait(t, stop) {
+					return nil
+				}
+				l := sw.Line(i)
+				sl := s.slb.Store(l.ScanlineHdr, l.Data())
+				if sl == nil {
+					atomic.AddUint64(&s.dropped, 1)
+					continue
+				}
+				atomic.AddUint64(&s.replayed, 1)
+				s.mu.Lock()
+				s.now = t
+				s.mu.Unlock()
+				for _, f := range hooks {
+					f(sl)
+				}
+			}
+		}
+		s.mu.Lock()
+		loop := s.loop
+		s.mu.Unlock()
+		if !loop {
+			return nil
+		}
+		shift += last.Sub(first) + p.lastGap
+	}
+}
+
+// lineTimes returns a function giving the recorded time of the i'th
+// scanline of sw, interpolated between the times of the first and last
+// scanlines in h using the ADC clock.
+func lineTimes(h *archive.Header, sw *buffer.Sweep) func(i int) time.Time {
+	n := sw.NumLines()
+	if n < 2 {
+		return func(int) time.Time { return h.First }
+	}
+	c0, c1 := sw.Line(0).TrigClock, sw.Line(n-1).TrigClock
+	span := h.Last.Sub(h.First)
+	return func(i int) time.Time {
+		if c1 <= c0 {
+			return h.First
+		}
+		f := float64(sw.Line(i).TrigClock-c0) / float64(c1-c0)
+		return h.First.Add(time.Duration(f * float64(span)))
+	}
+}
+
+// pacer keeps replayed scanlines to their recorded spacing, scaled by
+// speed.
+type pacer struct {
+	speed   float64       // recorded seconds per wall-clock second; 0 means don't wait
+	wall    time.Time     // wall-clock time corresponding to rec
+	rec     time.Time     // recorded time of the previous scanline; zero before the first
+	lastGap time.Duration // spacing assumed between the last scanline of a pass and the first of the next
+}
+
+// wait sleeps until it is time to replay a scanline recorded at t,
+// returning false if stop is closed first.
+func (p *pacer) wait(t time.Time, stop <-chan struct{}) bool {
+	if p.rec.IsZero() {
+		p.rec = t
+	}
+	gap := t.Sub(p.rec)
+	if gap > MAX_GAP {
+		gap = MAX_GAP
+	}
+	if gap > 0 {
+		p.lastGap = gap
+	}
+	if p.speed > 0 && gap > 0 {
+		p.wall = p.wall.Add(time.Duration(float64(gap) / p.speed))
+		if now := time.Now(); now.Sub(p.wall) > MAX_GAP {
+			// the hooks can't keep up; don't try to catch up in a burst
+			p.wall = now
+		}
+	}
+	p.rec = t
+	if d := time.Until(p.wall); p.speed > 0 && d >= MIN_SLEEP {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(d):
+		}
+		return true
+	}
+	select {
+	case <-stop:
+		return false
+	default:
+		return true
+	}
+}
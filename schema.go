@@ -0,0 +1,169 @@
+package main
+
+// Config file schema: the sections and keys ogdar understands, and
+// aliases for the keys used by the C version of digdar in its
+// digdar.toml, so that old files can still be read.
+//
+// Viper lower-cases all keys, and decoding into structs ignores keys
+// it doesn't recognize, so without this a misspelled or renamed key
+// (e.g. digdar's DecimRate for ogdar's DecRate) is silently lost.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/asterix"
+	"github.com/jbrzusto/ogdar/azimuth"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/monitor"
+	"github.com/jbrzusto/ogdar/navico"
+	"github.com/jbrzusto/ogdar/stream"
+	"github.com/jbrzusto/ogdar/timing"
+	"github.com/jbrzusto/ogdar/web"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configSections maps the name of each config file section other
+// than [digdar] and [profiles] to the type of struct it is decoded
+// into.  Keys in [digdar] are the names of FPGA registers; for
+// [profiles], see profile.go.
+var configSections = map[string]reflect.Type{
+	"radar":   reflect.TypeOf(radar{}),
+	"monitor": reflect.TypeOf(monitor.Config{}),
+	"arp":     reflect.TypeOf(azimuth.EstimatorConfig{}),
+	"time":    reflect.TypeOf(timing.Config{}),
+	"archive": reflect.TypeOf(archive.Config{}),
+	"stream":  reflect.TypeOf(stream.Config{}),
+	"asterix": reflect.TypeOf(asterix.Config{}),
+	"navico":  reflect.TypeOf(navico.Config{}),
+	"web":     reflect.TypeOf(web.Config{}),
+}
+
+// configKey names a key in a section of the config file.
+type configKey struct {
+	Section string
+	Key     string
+}
+
+func (k configKey) String() string {
+	return k.Section + "." + k.Key
+}
+
+// legacyKeys maps keys used by digdar (lower-cased, as from viper) to
+// their ogdar equivalents.
+var legacyKeys = map[configKey]configKey{
+	{"digdar", "decimrate"}: {"digdar", "DecRate"},
+	{"digdar", "acpperarp"}: {"radar", "ACPsPerRotation"}, // in ogdar, ACPPerARP is the measured count, and read-only
+}
+
+// lookupKey returns the properly-capitalized name of key in section,
+// and whether it is known and can be set from the config file.
+func lookupKey(section, key string) (name string, known, settable bool) {
+	if section == "digdar" {
+		f, ok := FindRegField(key)
+		if !ok {
+			return key, false, false
+		}
+		return f.Name, true, f.Writable()
+	}
+	t, ok := configSections[section]
+	if !ok {
+		return key, false, false
+	}
+	if f, ok := t.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, key) }); ok {
+		return f.Name, true, true
+	}
+	return key, false, false
+}
+
+// sortedKeys returns the keys of m in sorted order, so that warnings
+// come out in a repeatable order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalizeSettings translates legacy keys in settings (as returned
+// by viper's AllSettings) to their ogdar equivalents, and drops
+// unknown sections and keys, and read-only registers.  It returns the
+// resulting settings, and a warning for each key translated or
+// dropped.
+//
+// Legacy keys are only translated in digdar files, which are those
+// whose [digdar] section has no DecRate.  This stops the ACPPerARP
+// register in files written by 'ogdar regdump' being mistaken for
+// digdar's ACPPerARP.
+func normalizeSettings(settings map[string]interface{}) (out map[string]interface{}, warnings []string) {
+	out = make(map[string]interface{})
+	section := func(s string) map[string]interface{} {
+		m, ok := out[s].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			out[s] = m
+		}
+		return m
+	}
+	var legacy []configKey
+	var readOnly []string
+	dd, _ := settings["digdar"].(map[string]interface{})
+	_, isOgdar := dd["decrate"]
+	for _, s := range sortedKeys(settings) {
+		vals, ok := settings[s].(map[string]interface{})
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("ignoring %s: not in any section", s))
+			continue
+		}
+		if s == "profiles" {
+			var w []string
+			out[s], w = normalizeProfiles(vals)
+			warnings = append(warnings, w...)
+			continue
+		}
+		if _, ok := configSections[s]; !ok && s != "digdar" {
+			warnings = append(warnings, fmt.Sprintf("ignoring unknown section [%s]", s))
+			continue
+		}
+		for _, k := range sortedKeys(vals) {
+			key := configKey{s, k}
+			if _, ok := legacyKeys[key]; ok && !isOgdar {
+				legacy = append(legacy, key)
+				continue
+			}
+			name, known, settable := lookupKey(s, k)
+			switch {
+			case !known:
+				warnings = append(warnings, fmt.Sprintf("ignoring unknown key %s", key))
+			case !settable:
+				readOnly = append(readOnly, name)
+			default:
+				section(s)[k] = vals[k]
+			}
+		}
+	}
+	if len(readOnly) > 0 {
+		warnings = append(warnings, "ignoring read-only registers "+strings.Join(readOnly, ", "))
+	}
+	// translate legacy keys after the others, so that ogdar keys take precedence
+	for _, key := range legacy {
+		to := legacyKeys[key]
+		lk := strings.ToLower(to.Key)
+		if _, dup := section(to.Section)[lk]; dup {
+			warnings = append(warnings, fmt.Sprintf("ignoring digdar key %s: file also has %s", key, to))
+			continue
+		}
+		section(to.Section)[lk] = settings[key.Section].(map[string]interface{})[key.Key]
+		warnings = append(warnings, fmt.Sprintf("using digdar key %s as %s", key, to))
+	}
+	return
+}
+
+// regChange is a value to be written to an FPGA register.
+type regChange struct {
+	f *RegField
+	v uint64
+}
@@ -0,0 +1,204 @@
+package main
+
+// The 'setup' command: an interactive wizard which measures the
+// radar's signals and writes a complete ogdar.toml for it.
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/calib"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stdin is shared by all prompts, so that buffered input isn't lost
+// between them.
+var stdin = bufio.NewReader(os.Stdin)
+
+// ask prompts the user for a line of input, returning def if the
+// user enters nothing.
+func ask(prompt, def string) string {
+	fmt.Printf("%s [%s]: ", prompt, def)
+	ans, _ := stdin.ReadString('\n')
+	if ans = strings.TrimSpace(ans); ans == "" {
+		return def
+	}
+	return ans
+}
+
+// askNumber prompts the user for a number in the range min...max,
+// repeating until a valid one is entered.
+func askNumber(prompt string, def, min, max float64) float64 {
+	for {
+		x, err := strconv.ParseFloat(ask(prompt, strconv.FormatFloat(def, 'f', -1, 64)), 64)
+		if err == nil && x >= min && x <= max {
+			return x
+		}
+		fmt.Printf("Please enter a number from %g to %g\n", min, max)
+	}
+}
+
+// confirm asks the user a yes/no question, returning true only if the
+// answer begins with 'y' or 'Y'.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	ans, _ := stdin.ReadString('\n')
+	return len(ans) > 0 && (ans[0] == 'y' || ans[0] == 'Y')
+}
+
+// measureACPPerARP records the value of ACPPerARP after each of the
+// next n ARPs, failing if any ARP takes longer than timeout to arrive.
+func measureACPPerARP(n int, timeout time.Duration) ([]uint32, error) {
+	counts := make([]uint32, 0, n)
+	last := Regs.ARPCount
+	deadline := time.Now().Add(timeout)
+	for len(counts) < n {
+		time.Sleep(10 * time.Millisecond)
+		if a := Regs.ARPCount; a != last {
+			counts = append(counts, Regs.ACPPerARP)
+			fmt.Printf("   rotation %d: %d ACPs\n", len(counts), Regs.ACPPerARP)
+			last = a
+			deadline = time.Now().Add(timeout)
+		} else if time.Now().After(deadline) {
+			return counts, fmt.Errorf("no ARP detected in %v", timeout)
+		}
+	}
+	return counts, nil
+}
+
+// chooseSampling returns the smallest decimation rate, and the
+// corresponding (even) number of samples, which cover maxRange metres
+// without exceeding the scanline size ogdar can buffer.
+func chooseSampling(maxRange float64) (decRate, numSamp uint32) {
+	for decRate = 1; decRate < 65536; decRate++ {
+		n := math.Ceil(maxRange / (float64(decRate) * RANGE_PER_CLOCK))
+		if n <= buffer.MAX_SCANLINE_SAMPLES {
+			numSamp = uint32(n)
+			break
+		}
+	}
+	numSamp += numSamp % 2
+	if numSamp < 2 {
+		numSamp = 2
+	}
+	return
+}
+
+// decimOptions returns the best value of the decimation bits of the
+// Options register for decimation rate decRate: sum if possible,
+// otherwise average if possible, otherwise plain decimation.
+func decimOptions(decRate uint32) uint32 {
+	switch {
+	case CanSum(decRate):
+		return uint32(DDOPT_AVERAGING | DDOPT_USE_SUM)
+	case CanAverage(decRate):
+		return uint32(DDOPT_AVERAGING)
+	}
+	return 0
+}
+
+// cmdSetup walks the user through measuring the radar's signals,
+// setting the FPGA registers accordingly, and writing a config file.
+func cmdSetup(args []string) error {
+	fs := flag.NewFlagSet("setup", flag.ContinueOnError)
+	out := fs.String("o", "ogdar.toml", "config file to write")
+	rotations := fs.Int("rotations", 5, "number of antenna rotations over which to count ACPs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// start from the existing config, if any, so its values are offered as defaults
+	if err := loadConfig(); err != nil {
+		if err != errConfigNotFound {
+			fmt.Println(err)
+		}
+		setDefaultConfig()
+		Radar.Model = ""
+	}
+	fmt.Println("ogdar radar setup.  Press Enter to accept the [default] value for any question.\n\nStep 1: the radar")
+	old := Radar.Model
+	Radar.Model = ask("Radar make and model (see 'ogdar radars' for those in the catalogue)", Radar.Model)
+	if m := findRadarModel(Radar.Model); m != nil && modelKey(Radar.Model) != modelKey(old) {
+		fmt.Printf("%s is in the catalogue; its values are offered as defaults\n", m.Name)
+		m.applyTo(&Radar, "")
+	}
+	Radar.Power = uint16(askNumber("Transmitted power, in watts", float64(Radar.Power), 0, math.MaxUint16))
+	Radar.ACPsPerRotation = uint16(askNumber("Nominal ACPs per rotation (e.g. 450 for Furuno FR series, 4096 for Bridgemaster E)", float64(Radar.ACPsPerRotation), 1, math.MaxUint16))
+
+	fmt.Println("\nStep 2: trigger, ACP and ARP signals.  Make sure the radar is transmitting and the antenna is turning.")
+	r, err := calib.Calibrate(int(Radar.ACPsPerRotation), 30)
+	if err != nil {
+		return err
+	}
+	r.WriteSummary(os.Stdout)
+	if r.Trig.Err != nil {
+		return errors.New("no trigger pulses found; check the trigger connection")
+	}
+	if confirm("Use the recommended pulse detector settings?") {
+		r.Apply()
+	}
+	SelectTrig(TRG_TRIG)
+	time.Sleep(time.Second)
+	prf := r.PRF
+	if dt := Regs.TrigClock - Regs.TrigPrevClock; dt > 0 && dt < FAST_ADC_CLOCK {
+		prf = FAST_ADC_CLOCK / float64(dt)
+		fmt.Printf("Trigger detector reports PRF of %.0f Hz\n", prf)
+	}
+	Radar.PRF = uint16(askNumber("PRF, in Hz", math.Round(prf), 1, math.MaxUint16))
+
+	fmt.Printf("\nStep 3: counting ACPs over %d rotations\n", *rotations)
+	counts, err := measureACPPerARP(*rotations, 10*time.Second)
+	if err != nil {
+		fmt.Printf("%v; check ARP settings\n", err)
+	}
+	if len(counts) > 0 {
+		sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+		med := counts[len(counts)/2]
+		fmt.Printf("ACPs per rotation: median %d, range %d...%d\n", med, counts[0], counts[len(counts)-1])
+		if med != uint32(Radar.ACPsPerRotation) {
+			fmt.Printf("WARNING: this differs from the nominal value of %d\n", Radar.ACPsPerRotation)
+		}
+		Radar.ACPsPerRotation = uint16(askNumber("ACPs per rotation", float64(med), 1, math.MaxUint16))
+	}
+
+	fmt.Println("\nStep 4: range")
+	maxRange := askNumber("Maximum range to digitize, in metres", math.Round(float64(Regs.DecRate*Regs.NumSamp)*RANGE_PER_CLOCK), 1, 65536*buffer.MAX_SCANLINE_SAMPLES*RANGE_PER_CLOCK)
+	Regs.DecRate, Regs.NumSamp = chooseSampling(maxRange)
+	if Radar.VideoPolarity != "" {
+		fmt.Printf("Video polarity for this radar is %s\n", Radar.VideoPolarity)
+	}
+	negate := confirm("Invert video (needed e.g. for Furuno radars, where echoes are negative)?")
+	Regs.Options = decimOptions(Regs.DecRate)
+	if negate {
+		Regs.Options |= uint32(DDOPT_NEGATE_VIDEO)
+	}
+	fmt.Printf("Using DecRate = %d, NumSamp = %d (%.1f m per sample, %.0f m maximum range), Options = %d\n",
+		Regs.DecRate, Regs.NumSamp, float64(Regs.DecRate)*RANGE_PER_CLOCK, float64(Regs.DecRate*Regs.NumSamp)*RANGE_PER_CLOCK, Regs.Options)
+
+	fmt.Println("\nStep 5: trigger delay")
+	delay := float64(Regs.TrigDelay)
+	if d, err := calib.MeasureTrigDelay(); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Main bang found %d ADC clocks (%.1f m) after trigger\n", d, float64(d)*RANGE_PER_CLOCK)
+		delay = float64(d)
+	}
+	Regs.TrigDelay = uint32(askNumber("Trigger delay, in ADC clocks (8 ns)", delay, 0, math.MaxUint32))
+	Radar.RangeDelay = askNumber("Delay from trigger to pulse leaving the antenna (range zero), in ADC clocks", delay, 0, math.MaxUint32)
+
+	if _, err := os.Stat(*out); err == nil && !confirm(fmt.Sprintf("\n%s exists; overwrite it?", *out)) {
+		return errors.New("config not written")
+	}
+	if err := writeConfig(*out, "Written by 'ogdar setup'", currentConfig(), fpgaValue); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", *out)
+	return nil
+}
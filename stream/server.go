@@ -0,0 +1,322 @@
+package stream
+
+// The server and its clients.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/buffer"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CLIENT_QUEUE_LEN is the most frames which can wait to be sent to a
+// client, however small they are.
+const CLIENT_QUEUE_LEN = 4096
+
+// SWEEP_QUEUE_LEN is the number of completed sweeps which can wait to
+// be encoded; further sweeps are dropped until there is room.
+const SWEEP_QUEUE_LEN = 2
+
+// Server streams scanlines and sweeps to TCP clients.  It is safe for
+// concurrent use.
+type Server struct {
+	mu      sync.Mutex
+	cfg     Config
+	params  []byte // FRAME_PARAMS for the current settings; nil until SetParams is called
+	clients map[*client]bool
+	sweeps  chan *buffer.Sweep
+	sweepP  archive.Params // radar parameters recorded with sweeps
+}
+
+// client is a connected client.
+type client struct {
+	queued  int64  // bytes of frames in queue; first for 64-bit alignment of atomic access on ARM
+	dropped uint64 // frames dropped since the last FRAME_DROPPED
+	addr    string
+	conn    net.Conn
+	queue   chan []byte
+	done    chan struct{} // closed when the client is removed
+	// guarded by Server.mu
+	sub  Subscription
+	seen uint32    // scanlines since the last one sent, for SUB_EVERY
+	next time.Time // earliest time to send another scanline, for SUB_INTERVAL
+}
+
+// ClientStats describes a connected client.
+type ClientStats struct {
+	Addr    string       // remote address
+	Sub     Subscription // what it receives
+	Queued  int64        // bytes waiting to be sent
+	Dropped uint64       // frames dropped and not yet reported to it
+}
+
+// New returns a Server.  Call Run to start it.
+func New(cfg Config) *Server {
+	return &Server{cfg: cfg, clients: make(map[*client]bool), sweeps: make(chan *buffer.Sweep, SWEEP_QUEUE_LEN)}
+}
+
+// SetConfig changes the server's configuration.  A change to Addr
+// takes effect when Run is next called.
+func (s *Server) SetConfig(cfg Config) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+}
+
+// SetParams sets the settings sent to clients for interpreting
+// scanlines, and recorded with sweeps: the ADC clock rate in Hz, the
+// digitizer settings needed for ranges, and the radar's parameters.
+// Connected clients are sent the new settings if they have changed.
+func (s *Server) SetParams(clockRate uint32, r buffer.RangeParams, p archive.Params) {
+	f := paramsFrame(clockRate, r, p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepP = p
+	if string(f) == string(s.params) {
+		return
+	}
+	s.params = f
+	for c := range s.clients {
+		c.send(f, 0)
+	}
+}
+
+// Clients returns a description of each connected client.
+func (s *Server) Clients() (cs []ClientStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		cs = append(cs, ClientStats{c.addr, c.sub, atomic.LoadInt64(&c.queued), atomic.LoadUint64(&c.dropped)})
+	}
+	return
+}
+
+// AddScanline sends l to the clients which want it.  It does not
+// block, so it can be an Acquirer hook.
+func (s *Server) AddScanline(l *buffer.Scanline) {
+	now := time.Now()
+	s.mu.Lock()
+	var to []*client
+	for c := range s.clients {
+		if c.wants(now) {
+			to = append(to, c)
+		}
+	}
+	limit := int64(s.cfg.MaxQueue) << 20
+	s.mu.Unlock()
+	if len(to) == 0 {
+		return
+	}
+	// copy the samples before checking they are still valid, in case
+	// they are overwritten while being copied
+	f := scanlineFrame(l)
+	if !l.Valid() {
+		return
+	}
+	for _, c := range to {
+		c.send(f, limit)
+	}
+}
+
+// wants reports whether c is to be sent a scanline arriving at now,
+// and updates its subscription state if so.  Server.mu must be held.
+func (c *client) wants(now time.Time) bool {
+	switch c.sub.Mode {
+	case SUB_ALL:
+		return true
+	case SUB_EVERY:
+		if c.seen++; c.seen >= c.sub.N {
+			c.seen = 0
+			return true
+		}
+	case SUB_INTERVAL:
+		if !now.Before(c.next) {
+			c.next = now.Add(c.sub.Interval)
+			return true
+		}
+	}
+	return false
+}
+
+// AddSweep queues the completed sweep sw to be sent to clients which
+// subscribe to sweeps.  It does not block, so it can be a
+// SweepAssembler handler.
+func (s *Server) AddSweep(sw *buffer.Sweep) {
+	select {
+	case s.sweeps <- sw:
+	default:
+	}
+}
+
+// Run accepts clients on the configured address, and sends them
+// sweeps, until stop is closed.  It returns an error if it can't
+// listen.
+func (s *Server) Run(stop <-chan struct{}) error {
+	s.mu.Lock()
+	addr := s.cfg.Addr
+	s.mu.Unlock()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-stop
+		ln.Close()
+		s.mu.Lock()
+		for c := range s.clients {
+			c.conn.Close()
+		}
+		s.mu.Unlock()
+	}()
+	go s.sendSweeps(stop)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.add(conn)
+	}
+}
+
+// sendSweeps encodes queued sweeps and sends them to the clients which
+// want them, until stop is closed.
+func (s *Server) sendSweeps(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case sw := <-s.sweeps:
+			s.mu.Lock()
+			var to []*client
+			for c := range s.clients {
+				if c.sub.Mode == SUB_SWEEPS {
+					to = append(to, c)
+				}
+			}
+			p, limit := s.sweepP, int64(s.cfg.MaxQueue)<<20
+			s.mu.Unlock()
+			if len(to) == 0 {
+				continue
+			}
+			b, _, err := archive.EncodeSweep(sw, p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "stream: unable to encode sweep: %v\n", err)
+				continue
+			}
+			f := frame(FRAME_SWEEP, b)
+			for _, c := range to {
+				c.send(f, limit)
+			}
+		}
+	}
+}
+
+// add starts serving a newly connected client, unless there are
+// already too many.
+func (s *Server) add(conn net.Conn) {
+	c := &client{addr: conn.RemoteAddr().String(), conn: conn, queue: make(chan []byte, CLIENT_QUEUE_LEN), done: make(chan struct{})}
+	s.mu.Lock()
+	if len(s.clients) >= s.cfg.MaxClients {
+		s.mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write(frame(FRAME_ERROR, []byte(fmt.Sprintf("too many clients (%d)", s.cfg.MaxClients))))
+		conn.Close()
+		return
+	}
+	s.clients[c] = true
+	c.send(helloFrame(), 0)
+	if s.params != nil {
+		c.send(s.params, 0)
+	}
+	s.mu.Unlock()
+	go c.write()
+	go s.read(c)
+}
+
+// remove disconnects c.
+func (s *Server) remove(c *client) {
+	s.mu.Lock()
+	if s.clients[c] {
+		delete(s.clients, c)
+		close(c.done)
+	}
+	s.mu.Unlock()
+	c.conn.Close()
+}
+
+// read handles frames from c until it disconnects.
+func (s *Server) read(c *client) {
+	defer s.remove(c)
+	for {
+		typ, p, err := ReadFrame(c.conn, MAX_CLIENT_FRAME)
+		if err != nil {
+			return
+		}
+		if typ != FRAME_SUBSCRIBE {
+			c.send(frame(FRAME_ERROR, []byte(fmt.Sprintf("unexpected frame type %d", typ))), 0)
+			continue
+		}
+		sub, err := parseSubscribe(p)
+		if err != nil {
+			c.send(frame(FRAME_ERROR, []byte(err.Error())), 0)
+			continue
+		}
+		s.mu.Lock()
+		c.sub, c.seen, c.next = sub, 0, time.Time{}
+		s.mu.Unlock()
+	}
+}
+
+// send queues the frame f for c.  If limit > 0 and the queue already
+// holds limit bytes, or if it is full, f is dropped instead.  Frames
+// sent with limit 0 are small control frames, which are only dropped
+// if the queue is full.
+func (c *client) send(f []byte, limit int64) {
+	if limit > 0 && atomic.LoadInt64(&c.queued)+int64(len(f)) > limit {
+		atomic.AddUint64(&c.dropped, 1)
+		return
+	}
+	select {
+	case c.queue <- f:
+		atomic.AddInt64(&c.queued, int64(len(f)))
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// write sends c's queued frames until it is removed, or a write fails
+// or takes longer than WRITE_TIMEOUT.
+func (c *client) write() {
+	defer c.conn.Close()
+	for {
+		select {
+		case <-c.done:
+			return
+		case f := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			if n := atomic.SwapUint64(&c.dropped, 0); n > 0 {
+				if _, err := c.conn.Write(droppedFrame(n)); err != nil {
+					return
+				}
+			}
+			_, err := c.conn.Write(f)
+			atomic.AddInt64(&c.queued, -int64(len(f)))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
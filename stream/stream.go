@@ -0,0 +1,252 @@
+/*
+Package stream serves live scanlines and sweeps to clients over TCP.
+
+# Protocol
+
+All values are little-endian.  Each message, in either direction, is
+a frame: an 8-byte header followed by a payload:
+
+	offset  size  contents
+	     0     4  length n of the payload, in bytes
+	     4     2  frame type (FRAME_*)
+	     6     2  reserved (0)
+	     8     n  payload
+
+On connection, the server sends a FRAME_HELLO, then a FRAME_PARAMS
+once the radar's parameters are known.  It sends nothing else until
+the client sends a FRAME_SUBSCRIBE, which it can do again at any time
+to change what it receives.
+
+FRAME_HELLO (server): 8-byte magic number MAGIC, then 2-byte protocol
+version PROTOCOL_VERSION, 2-byte scanline header version
+(buffer.SCANLINE_HDR_VERSION), 2-byte sweep file format version
+(archive.FORMAT_VERSION), and 2 reserved bytes.
+
+FRAME_PARAMS (server): settings needed to interpret scanlines, sent
+again whenever they change:
+
+	offset  size  contents
+	     0     4  ADC clock rate, in Hz
+	     4     4  TrigDelay register, in ADC clocks
+	     8     8  range delay, in ADC clocks (double)
+	    16     2  nominal PRF, in Hz
+	    18     2  nominal ACPs per rotation
+	    20     2  transmitted power, in watts
+	    22     2  reserved (0)
+	    24     8  heading offset, in degrees (double)
+	    32     8  horizontal beamwidth, in degrees (double)
+	    40     8  nominal rotation rate, in RPM (double)
+
+followed by the radar model, pulse length and operating profile, each
+a 2-byte length and that many bytes of UTF-8.
+
+FRAME_SCANLINE (server): one scanline, as a record of a sweep file
+(see package archive): the 40-byte scanline header, a 4-byte sample
+count n, 4 reserved bytes, and n 2-byte samples.
+
+FRAME_SWEEP (server): one complete sweep, as the contents of a sweep
+file.
+
+FRAME_DROPPED (server): an 8-byte count of frames not sent to this
+client since the previous FRAME_DROPPED because it was not reading
+them fast enough.  It precedes the next frame sent.
+
+FRAME_ERROR (server): a UTF-8 message describing a bad frame from the
+client, which was ignored.
+
+FRAME_SUBSCRIBE (client): a 2-byte subscription mode (SUB_*), 2
+reserved bytes, and a 4-byte argument: N for SUB_EVERY, or the
+interval in milliseconds for SUB_INTERVAL.
+
+# Slow clients
+
+Frames for each client are queued, and written by a goroutine of its
+own, so acquisition never waits for a client.  When a client's queue
+holds more than Config.MaxQueue megabytes, frames for it are dropped
+(and counted in a FRAME_DROPPED) until it catches up.  A client which
+reads nothing for WRITE_TIMEOUT is disconnected.
+*/
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jbrzusto/ogdar/archive"
+	"github.com/jbrzusto/ogdar/buffer"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	MAGIC            = "OGDARSTR" // start of the FRAME_HELLO payload
+	PROTOCOL_VERSION = 1          // version of the protocol served by this package
+	FRAME_HDR_SIZE   = 8          // bytes in a frame header
+	MAX_CLIENT_FRAME = 64         // longest payload accepted from a client, in bytes
+	WRITE_TIMEOUT    = 30 * time.Second
+)
+
+// Frame types.
+const (
+	FRAME_HELLO     = 1
+	FRAME_PARAMS    = 2
+	FRAME_SCANLINE  = 3
+	FRAME_SWEEP     = 4
+	FRAME_DROPPED   = 5
+	FRAME_ERROR     = 6
+	FRAME_SUBSCRIBE = 16
+)
+
+// Mode says what a client receives.
+type Mode uint16
+
+// Subscription modes.
+const (
+	SUB_NONE     Mode = iota // nothing
+	SUB_ALL                  // every scanline
+	SUB_EVERY                // every Nth scanline
+	SUB_INTERVAL             // at most one scanline per interval
+	SUB_SWEEPS               // complete sweeps only
+)
+
+// Subscription is what a client asks to receive.
+type Subscription struct {
+	Mode     Mode
+	N        uint32        // for SUB_EVERY
+	Interval time.Duration // for SUB_INTERVAL
+}
+
+// Config holds parameters for a Server.  It is read from the [stream]
+// section of ogdar.toml.
+type Config struct {
+	Addr       string // TCP address to listen on, e.g. ":12345"; "" means don't serve
+	MaxClients int    // connections beyond this many are refused
+	MaxQueue   int    // megabytes of frames which can wait to be sent to a client before more are dropped
+}
+
+// DefaultConfig is used for any values not given in ogdar.toml.
+var DefaultConfig = Config{
+	Addr:       "",
+	MaxClients: 8,
+	MaxQueue:   64,
+}
+
+// appendFrameHdr appends the header of a frame of type typ with an
+// n-byte payload to b.
+func appendFrameHdr(b []byte, typ uint16, n int) []byte {
+	var h [FRAME_HDR_SIZE]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(n))
+	binary.LittleEndian.PutUint16(h[4:], typ)
+	return append(b, h[:]...)
+}
+
+// frame returns a frame of type typ holding payload.
+func frame(typ uint16, payload []byte) []byte {
+	return append(appendFrameHdr(make([]byte, 0, FRAME_HDR_SIZE+len(payload)), typ, len(payload)), payload...)
+}
+
+// helloFrame returns the FRAME_HELLO sent to each new client.
+func helloFrame() []byte {
+	p := make([]byte, 16)
+	copy(p, MAGIC)
+	binary.LittleEndian.PutUint16(p[8:], PROTOCOL_VERSION)
+	binary.LittleEndian.PutUint16(p[10:], buffer.SCANLINE_HDR_VERSION)
+	binary.LittleEndian.PutUint16(p[12:], archive.FORMAT_VERSION)
+	return frame(FRAME_HELLO, p)
+}
+
+// paramsFrame returns a FRAME_PARAMS for the given settings.
+func paramsFrame(clockRate uint32, r buffer.RangeParams, p archive.Params) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 48, 48+6+len(p.Model)+len(p.Pulse)+len(p.Profile))
+	le.PutUint32(b[0:], clockRate)
+	le.PutUint32(b[4:], r.TrigDelay)
+	le.PutUint64(b[8:], math.Float64bits(r.RangeDelay))
+	le.PutUint16(b[16:], p.PRF)
+	le.PutUint16(b[18:], p.ACPsPerRotation)
+	le.PutUint16(b[20:], p.Power)
+	le.PutUint64(b[24:], math.Float64bits(p.HeadingOffset))
+	le.PutUint64(b[32:], math.Float64bits(p.Beamwidth))
+	le.PutUint64(b[40:], math.Float64bits(p.RPM))
+	for _, s := range []string{p.Model, p.Pulse, p.Profile} {
+		if len(s) > math.MaxUint16 {
+			s = s[:math.MaxUint16]
+		}
+		b = append(b, byte(len(s)), byte(len(s)>>8))
+		b = append(b, s...)
+	}
+	return frame(FRAME_PARAMS, b)
+}
+
+// scanlineFrame returns a FRAME_SCANLINE holding l.
+func scanlineFrame(l *buffer.Scanline) []byte {
+	b := make([]byte, FRAME_HDR_SIZE, FRAME_HDR_SIZE+archive.LINE_HDR_SIZE+2*l.NumSamples())
+	b = archive.AppendRecord(b, l)
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b)-FRAME_HDR_SIZE))
+	binary.LittleEndian.PutUint16(b[4:], FRAME_SCANLINE)
+	return b
+}
+
+// droppedFrame returns a FRAME_DROPPED for n frames.
+func droppedFrame(n uint64) []byte {
+	var p [8]byte
+	binary.LittleEndian.PutUint64(p[:], n)
+	return frame(FRAME_DROPPED, p[:])
+}
+
+// SubscribeFrame returns the FRAME_SUBSCRIBE a client sends to ask
+// for sub.
+func SubscribeFrame(sub Subscription) []byte {
+	p := make([]byte, 8)
+	binary.LittleEndian.PutUint16(p[0:], uint16(sub.Mode))
+	switch sub.Mode {
+	case SUB_EVERY:
+		binary.LittleEndian.PutUint32(p[4:], sub.N)
+	case SUB_INTERVAL:
+		binary.LittleEndian.PutUint32(p[4:], uint32(sub.Interval/time.Millisecond))
+	}
+	return frame(FRAME_SUBSCRIBE, p)
+}
+
+// parseSubscribe decodes the payload of a FRAME_SUBSCRIBE.
+func parseSubscribe(p []byte) (sub Subscription, err error) {
+	if len(p) < 8 {
+		return sub, fmt.Errorf("subscribe payload has %d bytes; need 8", len(p))
+	}
+	sub.Mode = Mode(binary.LittleEndian.Uint16(p[0:]))
+	arg := binary.LittleEndian.Uint32(p[4:])
+	switch sub.Mode {
+	case SUB_NONE, SUB_ALL, SUB_SWEEPS:
+	case SUB_EVERY:
+		if arg == 0 {
+			return sub, errors.New("SUB_EVERY needs N >= 1")
+		}
+		sub.N = arg
+	case SUB_INTERVAL:
+		if arg == 0 {
+			return sub, errors.New("SUB_INTERVAL needs an interval >= 1 ms")
+		}
+		sub.Interval = time.Duration(arg) * time.Millisecond
+	default:
+		return sub, fmt.Errorf("unknown subscription mode %d", sub.Mode)
+	}
+	return
+}
+
+// ReadFrame reads a frame from r, returning its type and payload.
+// Payloads longer than max bytes are an error, unless max is 0.
+func ReadFrame(r io.Reader, max int) (typ uint16, payload []byte, err error) {
+	var h [FRAME_HDR_SIZE]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	n := binary.LittleEndian.Uint32(h[0:])
+	typ = binary.LittleEndian.Uint16(h[4:])
+	if max > 0 && n > uint32(max) {
+		return typ, nil, fmt.Errorf("frame of type %d has %d bytes; limit is %d", typ, n, max)
+	}
+	payload = make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	return
+}
@@ -0,0 +1,22 @@
+package timing
+
+import (
+	"math"
+	"syscall"
+)
+
+// ntpError returns the kernel's estimate of the system clock's error,
+// in seconds, or 0 if not available.  It returns +Inf if the kernel
+// says the clock is not synchronised, as then the estimate is
+// meaningless.
+func ntpError() float64 {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return 0
+	}
+	if state == 5 { // 5 is TIME_ERROR: clock not synchronised
+		return math.Inf(1)
+	}
+	return float64(tx.Esterror) * 1e-6
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package timing
+
+// ntpError returns 0: the kernel's estimate of the system clock's
+// error is only available on linux.
+func ntpError() float64 {
+	return 0
+}
@@ -0,0 +1,218 @@
+/*
+Package timing converts ADC clock counts to wall-clock (UTC) time.
+
+The FPGA counts ADC clock ticks since reset in the 64-bit Clocks
+register, and records the count at each trigger.  The ADC oscillator
+runs at nominally 125 MHz, but its true rate differs from this by
+some parts per million, and drifts with temperature.  The system
+clock is assumed to be disciplined by NTP or chrony.
+
+We periodically read Clocks together with the system time, and fit
+a straight line to recent pairs by least squares.  The line's slope
+gives the oscillator's true rate (and hence its drift relative to
+nominal), and any clock count can then be converted to UTC.  The
+error estimate combines scatter about the line, uncertainty in the
+fitted slope (which matters when converting counts far from the
+fitted pairs), and the kernel's own estimate of the system clock
+error.
+*/
+package timing
+
+import (
+	"github.com/jbrzusto/ogdar/fpga"
+	"math"
+	"sync"
+	"time"
+)
+
+// Config holds parameters for the time model.  It is read from the
+// [time] section of ogdar.toml.
+type Config struct {
+	Interval time.Duration // how often to pair Clocks with system time
+	Window   int           // number of recent pairs used in the fit
+}
+
+// DefaultConfig is used for any values not given in ogdar.toml.
+var DefaultConfig = Config{
+	Interval: 10 * time.Second,
+	Window:   60,
+}
+
+// Pair is a reading of the ADC clock count and the system time.
+type Pair struct {
+	Clock       uint64        // ADC clock count
+	Time        time.Time     // system time at which Clock was read
+	Uncertainty time.Duration // half the time taken to read Clock
+}
+
+// Model fits system time to ADC clock counts.  It is safe for
+// concurrent use.
+type Model struct {
+	mu    sync.RWMutex
+	cfg   Config
+	pairs []Pair // recent pairs, oldest first
+	// fit: t = t0 + (clock - clk0) * spc, in seconds
+	clk0     uint64    // clock count at reference pair
+	t0       time.Time // time of reference pair
+	spc      float64   // seconds per clock
+	resid    float64   // standard deviation of residuals, seconds
+	slopeErr float64   // standard error of spc
+	meanX    float64   // mean clock count of fitted pairs, relative to clk0
+	ntpErr   float64   // kernel's estimated system clock error, seconds
+	valid    bool
+}
+
+// New returns a time model; call Run to start it.
+func New(cfg Config) *Model {
+	return &Model{cfg: cfg, spc: fpga.FAST_ADC_SAMPLE_PERIOD}
+}
+
+// SetConfig changes the model's parameters.
+func (m *Model) SetConfig(cfg Config) {
+	m.mu.Lock()
+	m.cfg = cfg
+	m.mu.Unlock()
+}
+
+// ReadClocks returns the 64-bit Clocks register.  The FPGA bus is 32
+// bits wide, so the high half is read before and after the low half,
+// and the read repeated if it changed in between.
+func ReadClocks() uint64 {
+	lo, _ := fpga.GetRegPtrByName("Clocks_lo")
+	hi, _ := fpga.GetRegPtrByName("Clocks_hi")
+	for {
+		h := *hi
+		l := *lo
+		if *hi == h {
+			return uint64(h)<<32 | uint64(l)
+		}
+	}
+}
+
+// Read pairs the current value of the Clocks register with the system
+// time.  fpga.Init() must have been called.
+func Read() Pair {
+	t1 := time.Now()
+	c := ReadClocks()
+	t2 := time.Now()
+	d := t2.Sub(t1) / 2
+	return Pair{Clock: c, Time: t1.Add(d), Uncertainty: d}
+}
+
+// Run pairs Clocks with system time every Interval until stop is closed.
+func (m *Model) Run(stop <-chan struct{}) {
+	for {
+		m.Add(Read())
+		m.mu.RLock()
+		d := m.cfg.Interval
+		m.mu.RUnlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+// Add records a pair and refits the model.  A pair whose clock count
+// is lower than the previous one means the FPGA was reset, so earlier
+// pairs are discarded.
+func (m *Model) Add(p Pair) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := len(m.pairs); n > 0 && p.Clock <= m.pairs[n-1].Clock {
+		m.pairs = m.pairs[:0]
+	}
+	m.pairs = append(m.pairs, p)
+	if len(m.pairs) > m.cfg.Window {
+		m.pairs = m.pairs[len(m.pairs)-m.cfg.Window:]
+	}
+	m.ntpErr = ntpError()
+	m.fit()
+}
+
+// fit does a least-squares fit of time to clock count.  m.mu must be held.
+func (m *Model) fit() {
+	ref := m.pairs[len(m.pairs)-1]
+	m.clk0, m.t0 = ref.Clock, ref.Time
+	n := float64(len(m.pairs))
+	if n < 2 {
+		// a single pair: assume the nominal rate
+		m.spc = fpga.FAST_ADC_SAMPLE_PERIOD
+		m.resid = ref.Uncertainty.Seconds()
+		m.slopeErr = m.spc * 100e-6 // typical crystal tolerance
+		m.meanX = 0
+		m.valid = true
+		return
+	}
+	var sx, sy float64
+	x := make([]float64, len(m.pairs))
+	y := make([]float64, len(m.pairs))
+	for i, p := range m.pairs {
+		x[i] = -float64(m.clk0 - p.Clock)
+		y[i] = p.Time.Sub(m.t0).Seconds()
+		sx += x[i]
+		sy += y[i]
+	}
+	mx, my := sx/n, sy/n
+	var sxx, sxy float64
+	for i := range x {
+		sxx += (x[i] - mx) * (x[i] - mx)
+		sxy += (x[i] - mx) * (y[i] - my)
+	}
+	if sxx == 0 {
+		return
+	}
+	m.spc = sxy / sxx
+	// shift the line so that it passes through (mx, my), then
+	// re-express relative to the reference pair
+	icpt := my - m.spc*mx
+	m.t0 = m.t0.Add(time.Duration(icpt * 1e9))
+	var ss float64
+	for i := range x {
+		r := y[i] - icpt - m.spc*x[i]
+		ss += r * r
+	}
+	if n > 2 {
+		m.resid = math.Sqrt(ss / (n - 2))
+	} else {
+		m.resid = ref.Uncertainty.Seconds()
+	}
+	m.slopeErr = m.resid / math.Sqrt(sxx)
+	m.meanX = mx
+	m.valid = true
+}
+
+// Valid returns true once the model can convert clock counts to times.
+func (m *Model) Valid() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.valid
+}
+
+// Drift returns the oscillator's rate error relative to nominal, in
+// parts per million; positive means the oscillator runs fast.
+func (m *Model) Drift() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return (fpga.FAST_ADC_SAMPLE_PERIOD/m.spc - 1) * 1e6
+}
+
+// Time returns the UTC time corresponding to the ADC clock count c,
+// and an estimate of its error.  The error is the largest Duration if
+// the system clock is not synchronised.  The third return value is
+// false if the model has no data yet.
+func (m *Model) Time(c uint64) (t time.Time, err time.Duration, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.valid {
+		return
+	}
+	x := float64(int64(c - m.clk0))
+	t = m.t0.Add(time.Duration(x * m.spc * 1e9)).UTC()
+	e := math.Sqrt(m.resid*m.resid + math.Pow((x-m.meanX)*m.slopeErr, 2) + m.ntpErr*m.ntpErr)
+	if e*1e9 >= math.MaxInt64 {
+		return t, math.MaxInt64, true
+	}
+	return t, time.Duration(e * 1e9), true
+}
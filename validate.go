@@ -0,0 +1,267 @@
+package main
+
+// Validation of config files.  Every value is checked, and every
+// problem reported with its key and allowed values, so that a config
+// file can be fixed in one pass; a file with any problem is not used.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/calib"
+	"github.com/jbrzusto/ogdar/capturedb"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configError is a problem with one value in a config file.
+type configError struct {
+	Key string // section.Key, or just section if the problem isn't with one key
+	Msg string
+}
+
+func (e *configError) Error() string {
+	return e.Key + ": " + e.Msg
+}
+
+// errorf returns a configError for key.
+func errorf(key, format string, args ...interface{}) error {
+	return &configError{key, fmt.Sprintf(format, args...)}
+}
+
+// configErrors lists all the problems found in a config file.
+type configErrors struct {
+	Path string
+	Errs []error
+}
+
+func (e *configErrors) Error() string {
+	if len(e.Errs) == 1 {
+		return fmt.Sprintf("%s: %v", e.Path, e.Errs[0])
+	}
+	s := fmt.Sprintf("%s: %d problems:", e.Path, len(e.Errs))
+	for _, err := range e.Errs {
+		s += "\n  " + err.Error()
+	}
+	return s
+}
+
+// regLimits gives the allowed range of registers which can't hold
+// every value that fits in them.  Other registers are limited only by
+// their size and signedness (see RegField.Range).
+var regLimits = map[string][2]int64{
+	"DecRate":     {1, 65536},
+	"NumSamp":     {2, SAMPLES_PER_BUFF},
+	"TrigSource":  {int64(TRG_NONE), int64(TRG_ARP)},
+	"Options":     {0, int64(DDOPT_AVERAGING | DDOPT_USE_SUM | DDOPT_NEGATE_VIDEO | DDOPT_COUNT_MODE)},
+	"TrigLatency": {0, calib.MaxTrigLatency},
+	"ACPLatency":  {0, calib.MaxACPLatency},
+	"ARPLatency":  {0, calib.MaxARPLatency},
+}
+
+// regRange returns the allowed range of values for register f.
+func regRange(f *RegField) (min, max int64) {
+	if l, ok := regLimits[f.Name]; ok {
+		return l[0], l[1]
+	}
+	return f.Range()
+}
+
+// parseDigdar parses and range-checks the values of rw registers in
+// the section vals (named section, for error messages), returning them
+// in storage order, along with an error for each invalid value.
+func parseDigdar(vals map[string]interface{}, section string) (regs []regChange, errs []error) {
+	for i := range RegFields {
+		f := &RegFields[i]
+		x, ok := vals[strings.ToLower(f.Name)]
+		if !ok || !f.Writable() {
+			continue
+		}
+		key := section + "." + f.Name
+		min, max := regRange(f)
+		v, err := f.Parse(fmt.Sprint(x))
+		if err != nil {
+			errs = append(errs, errorf(key, "invalid value %v; allowed range is %d...%d", x, min, max))
+			continue
+		}
+		if n := f.Int(v); n < min || n > max {
+			errs = append(errs, errorf(key, "value %d out of range %d...%d", n, min, max))
+			continue
+		}
+		regs = append(regs, regChange{f, v})
+	}
+	return
+}
+
+// checkDigdar checks combinations of the register values regs from
+// section.  Combinations involving registers not in regs are not
+// checked.
+func checkDigdar(regs []regChange, section string) (errs []error) {
+	val := make(map[string]int64, len(regs))
+	for _, rc := range regs {
+		val[rc.f.Name] = rc.f.Int(rc.v)
+	}
+	has := func(names ...string) bool {
+		for _, n := range names {
+			if _, ok := val[n]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if has("NumSamp") && val["NumSamp"]%2 != 0 {
+		errs = append(errs, errorf(section+".NumSamp", "value %d must be even", val["NumSamp"]))
+	}
+	if has("Options") {
+		opt := DigdarOption(val["Options"])
+		avg, sum := opt&DDOPT_AVERAGING != 0, opt&DDOPT_USE_SUM != 0
+		decim := uint32(val["DecRate"])
+		switch {
+		case sum && !avg:
+			errs = append(errs, errorf(section+".Options", "value %d sums samples without averaging them; add %d to sum samples", opt, DDOPT_AVERAGING))
+		case !has("DecRate"):
+		case sum && !CanSum(decim):
+			errs = append(errs, errorf(section+".Options", "value %d sums samples, which needs DecRate 1...4, not %d", opt, decim))
+		case avg && !sum && !CanAverage(decim):
+			errs = append(errs, errorf(section+".Options", "value %d averages samples, which needs DecRate 1, 2, 4, 8, 64, 1024, 8192 or 65536, not %d", opt, decim))
+		}
+	}
+	for _, ch := range []string{"Trig", "ACP", "ARP"} {
+		ex, rx := ch+"ThreshExcite", ch+"ThreshRelax"
+		if has(ex, rx) && val[ex] == val[rx] {
+			errs = append(errs, errorf(section+"."+ex, "value %d must differ from %s, or pulses are never detected", val[ex], rx))
+		}
+	}
+	return
+}
+
+// checkReg returns an error if the rw register f can't be set to v:
+// if v is out of f's allowed range, or doesn't go with the current
+// values of the other registers.  Problems the current values already
+// have, e.g. thresholds not yet set from a config file, are not
+// reported.
+func checkReg(f *RegField, v uint64) error {
+	min, max := regRange(f)
+	if n := f.Int(v); n < min || n > max {
+		return errorf("digdar."+f.Name, "value %d out of range %d...%d", n, min, max)
+	}
+	var regs []regChange
+	for i := range RegFields {
+		if g := &RegFields[i]; g.Writable() {
+			regs = append(regs, regChange{g, g.Get()})
+		}
+	}
+	had := make(map[string]bool)
+	for _, err := range checkDigdar(regs, "digdar") {
+		had[err.Error()] = true
+	}
+	for i := range regs {
+		if regs[i].f == f {
+			regs[i].v = v
+		}
+	}
+	for _, err := range checkDigdar(regs, "digdar") {
+		if !had[err.Error()] {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConfig checks the values in c, other than those in [digdar].
+// Only sections with values given in the file or by environment
+// variables are checked; the others keep their current values, which
+// for [radar] are unset until a config file has been loaded, so that
+// e.g. a file written by regdump can be read on its own.
+func checkConfig(c *configFile) (errs []error) {
+	given := make(map[string]bool)
+	for k := range c.Sources {
+		given[strings.SplitN(k, ".", 2)[0]] = true
+	}
+	add := func(bad bool, key, format string, args ...interface{}) {
+		if bad && given[strings.SplitN(key, ".", 2)[0]] {
+			errs = append(errs, errorf(key, format, args...))
+		}
+	}
+	r := &c.Radar
+	add(r.PRF > buffer.MAX_PRF, "radar.PRF", "value %d out of range 0...%d (0 means unknown)", r.PRF, buffer.MAX_PRF)
+	add(r.ACPsPerRotation == 0, "radar.ACPsPerRotation", "value must be at least 1")
+	add(r.HeadingOffset < -360 || r.HeadingOffset > 360, "radar.HeadingOffset", "value %g out of range -360...360", r.HeadingOffset)
+	add(r.RangeDelay < 0, "radar.RangeDelay", "value %g must not be negative", r.RangeDelay)
+
+	m := &c.Monitor
+	add(m.Interval <= 0, "monitor.Interval", "value %v must be positive", m.Interval)
+	add(m.PRFTolerance < 0 || m.PRFTolerance > 1, "monitor.PRFTolerance", "value %g out of range 0...1", m.PRFTolerance)
+	add(m.MinRPM < 0, "monitor.MinRPM", "value %g must not be negative", m.MinRPM)
+	add(m.MaxRPM < 0, "monitor.MaxRPM", "value %g must not be negative", m.MaxRPM)
+	add(m.MinRPM > 0 && m.MaxRPM > 0 && m.MinRPM > m.MaxRPM, "monitor.MinRPM", "value %g is larger than MaxRPM (%g)", m.MinRPM, m.MaxRPM)
+	add(m.ARPTimeout <= 0, "monitor.ARPTimeout", "value %v must be positive", m.ARPTimeout)
+
+	a := &c.ARP
+	add(a.Window < 1, "arp.Window", "value %d must be at least 1", a.Window)
+	add(a.MinARPs < 1 || a.MinARPs > a.Window, "arp.MinARPs", "value %d out of range 1...%d (Window)", a.MinARPs, a.Window)
+	add(a.Tolerance <= 0, "arp.Tolerance", "value %g must be positive", a.Tolerance)
+	add(a.SaveEvery < 1, "arp.SaveEvery", "value %d must be at least 1", a.SaveEvery)
+
+	t := &c.Time
+	add(t.Interval <= 0, "time.Interval", "value %v must be positive", t.Interval)
+	add(t.Window < 2, "time.Window", "value %d must be at least 2", t.Window)
+
+	ar := &c.Archive
+	add(ar.Every < 1, "archive.Every", "value %d must be at least 1", ar.Every)
+	if ar.Dir != "" {
+		fi, err := os.Stat(ar.Dir)
+		add(err != nil, "archive.Dir", "%v", err)
+		add(err == nil && !fi.IsDir(), "archive.Dir", "%s is not a directory", ar.Dir)
+	}
+	if ar.DB != "" {
+		fi, err := os.Stat(filepath.Dir(ar.DB))
+		add(err != nil, "archive.DB", "%v", err)
+		add(err == nil && !fi.IsDir(), "archive.DB", "%s is not a directory", filepath.Dir(ar.DB))
+	}
+	add(ar.DBLayout != capturedb.LAYOUT_OGDAR && ar.DBLayout != capturedb.LAYOUT_DIGDAR, "archive.DBLayout", "value %q must be %q or %q", ar.DBLayout, capturedb.LAYOUT_OGDAR, capturedb.LAYOUT_DIGDAR)
+
+	st := &c.Stream
+	if st.Addr != "" {
+		_, _, err := net.SplitHostPort(st.Addr)
+		add(err != nil, "stream.Addr", "%v", err)
+	}
+	add(st.MaxClients < 1, "stream.MaxClients", "value %d must be at least 1", st.MaxClients)
+	add(st.MaxQueue < 1, "stream.MaxQueue", "value %d must be at least 1", st.MaxQueue)
+
+	ax := &c.Asterix
+	if ax.Addr != "" {
+		_, err := net.ResolveUDPAddr("udp4", ax.Addr)
+		add(err != nil, "asterix.Addr", "%v", err)
+	}
+	if ax.Interface != "" {
+		_, err := net.InterfaceByName(ax.Interface)
+		add(err != nil, "asterix.Interface", "%s: %v", ax.Interface, err)
+	}
+	add(ax.TTL < 0 || ax.TTL > 255, "asterix.TTL", "value %d out of range 0...255", ax.TTL)
+	add(ax.SAC < 0 || ax.SAC > 255, "asterix.SAC", "value %d out of range 0...255", ax.SAC)
+	add(ax.SIC < 0 || ax.SIC > 255, "asterix.SIC", "value %d out of range 0...255", ax.SIC)
+	add(ax.Bits != 8 && ax.Bits != 16, "asterix.Bits", "value %d must be 8 or 16", ax.Bits)
+
+	nv := &c.Navico
+	for _, k := range []struct{ key, addr string }{{"navico.Addr", nv.Addr}, {"navico.ReportAddr", nv.ReportAddr}} {
+		if k.addr != "" {
+			_, err := net.ResolveUDPAddr("udp4", k.addr)
+			add(err != nil, k.key, "%v", err)
+		}
+	}
+	if nv.Interface != "" {
+		_, err := net.InterfaceByName(nv.Interface)
+		add(err != nil, "navico.Interface", "%s: %v", nv.Interface, err)
+	}
+	add(nv.TTL < 0 || nv.TTL > 255, "navico.TTL", "value %d out of range 0...255", nv.TTL)
+	add(nv.Range < 0, "navico.Range", "value %g must not be negative", nv.Range)
+
+	if wb := &c.Web; wb.Addr != "" {
+		_, _, err := net.SplitHostPort(wb.Addr)
+		add(err != nil, "web.Addr", "%v", err)
+	}
+	return
+}
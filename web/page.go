@@ -0,0 +1,149 @@
+package web
+
+// The page served at /.  It is kept in the binary, so ogdar can be
+// copied to a redpitaya as a single file.
+
+const indexPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ogdar</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+td.num { text-align: right; font-family: monospace; }
+td.desc { font-size: small; max-width: 40em; }
+input { width: 8em; font-family: monospace; }
+.warn { color: #b00; font-weight: bold; }
+.ok { color: #070; font-weight: bold; }
+#msg { min-height: 1.2em; }
+</style>
+</head>
+<body>
+<h1>ogdar</h1>
+<p><a href="/scope">Scope</a> | <a href="/ppi">PPI</a></p>
+
+<h2>Status</h2>
+<table>
+<tr><th>Config file</th><td id="config"></td></tr>
+<tr><th>Radar</th><td id="radar"></td></tr>
+<tr><th>Profile</th><td id="profile"></td></tr>
+<tr><th>State</th><td id="state"></td></tr>
+<tr><th>PRF</th><td id="prf"></td></tr>
+<tr><th>RPM</th><td id="rpm"></td></tr>
+<tr><th>ACPs per rotation</th><td id="acps"></td></tr>
+<tr><th>Scanlines</th><td id="scanlines"></td></tr>
+</table>
+
+<h2>FPGA registers</h2>
+<p id="msg"></p>
+<table>
+<thead><tr><th>Name</th><th>Mode</th><th>Value</th><th>New value</th><th>Description</th></tr></thead>
+<tbody id="regs"></tbody>
+</table>
+
+<script>
+"use strict";
+
+function text(id, s, cls) {
+	var e = document.getElementById(id);
+	e.textContent = s;
+	e.className = cls || "";
+}
+
+function showStatus(s) {
+	if (s.config_found) {
+		text("config", s.config_path);
+	} else {
+		text("config", "not found; using (likely bogus) defaults", "warn");
+	}
+	text("radar", s.radar);
+	text("profile", s.profile || "(none)");
+	var state = s.state;
+	if (s.problems && s.problems.length > 0) {
+		state += ": " + s.problems.join("; ");
+	}
+	text("state", state, s.state == "OK" ? "ok" : "warn");
+	text("prf", s.prf.toFixed(0) + " Hz (expected " + (s.expected_prf ? s.expected_prf.toFixed(0) + " Hz" : "unknown") + ")");
+	text("rpm", s.rpm.toFixed(1));
+	text("acps", s.acps_per_rotation + " (expected " + s.expected_acps + ")");
+	text("scanlines", s.captured + " captured, " + s.dropped + " dropped");
+}
+
+var rows = {};
+
+function addRow(r) {
+	var tr = document.createElement("tr");
+	var cells = [];
+	for (var i = 0; i < 5; i++) {
+		cells.push(document.createElement("td"));
+		tr.appendChild(cells[i]);
+	}
+	cells[0].textContent = r.name;
+	cells[1].textContent = r.mode;
+	cells[2].className = "num";
+	cells[4].textContent = r.desc;
+	cells[4].className = "desc";
+	if (r.writable) {
+		var input = document.createElement("input");
+		input.title = r.min + "..." + r.max;
+		input.addEventListener("keydown", function(ev) {
+			if (ev.key == "Enter") {
+				setReg(r.name, input);
+			}
+		});
+		var button = document.createElement("button");
+		button.textContent = "Set";
+		button.addEventListener("click", function() { setReg(r.name, input); });
+		cells[3].appendChild(input);
+		cells[3].appendChild(button);
+	}
+	document.getElementById("regs").appendChild(tr);
+	rows[r.name] = cells[2];
+}
+
+function showRegs(regs) {
+	for (var i = 0; i < regs.length; i++) {
+		if (!rows[regs[i].name]) {
+			addRow(regs[i]);
+		}
+		rows[regs[i].name].textContent = regs[i].value;
+	}
+}
+
+function setReg(name, input) {
+	var body = new URLSearchParams();
+	body.set("value", input.value);
+	fetch("/api/regs/" + name, {method: "POST", body: body, headers: {"X-Requested-With": "ogdar"}}).then(function(resp) {
+		if (!resp.ok) {
+			return resp.text().then(function(t) { text("msg", t, "warn"); });
+		}
+		return resp.json().then(function(r) {
+			rows[r.name].textContent = r.value;
+			input.value = "";
+			if (resp.status == 202) {
+				text("msg", name + " will be set at the next trigger");
+			} else {
+				text("msg", name + " set to " + r.value);
+			}
+		});
+	}).catch(function(err) { text("msg", String(err), "warn"); });
+}
+
+function poll(url, show, ms) {
+	function get() {
+		fetch(url).then(function(resp) { return resp.json(); }).then(show).catch(function() {}).then(function() {
+			setTimeout(get, ms);
+		});
+	}
+	get();
+}
+
+poll("/api/status", showStatus, 1000);
+poll("/api/regs", showRegs, 2000);
+</script>
+</body>
+</html>
+`
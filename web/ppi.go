@@ -0,0 +1,270 @@
+package web
+
+// The PPI page, a plan position indicator drawn from scanlines
+// streamed over a WebSocket.
+//
+// Scanlines are reduced to PPI_SPOKES spokes of PPI_CELLS cells, out
+// to the range asked for by the page, and sent as the antenna turns.
+// When a page connects or changes its range, it is first sent the most
+// recent completed sweep, reduced the same way, so that it shows a
+// whole picture straight away rather than after a rotation.  Gain,
+// contrast, range rings and the heading line are drawn by the page.
+//
+// The page sends its settings as a JSON ppiSettings, and is sent a
+// JSON ppiInfo whenever the range covered by the spokes changes.
+// Spokes are sent in binary messages, each holding spokes first,
+// first+1, ..., first+n-1 (mod PPI_SPOKES):
+//
+//	uint16     first, little-endian
+//	uint16     n, little-endian
+//	n * cells  bytes; the cells of each spoke, nearest first
+//
+// Spoke i is centred on azimuth i * 360 / PPI_SPOKES degrees clockwise
+// from the heading reference.  A cell holds the strongest sample in its
+// interval of range, scaled to 0...255.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/jbrzusto/ogdar/azimuth"
+	"github.com/jbrzusto/ogdar/buffer"
+	"net/http"
+	"time"
+)
+
+const (
+	PPI_SPOKES      = 1024            // spokes per rotation
+	PPI_CELLS       = 512             // cells per spoke
+	PPI_MAX_FILL    = PPI_SPOKES / 64 // most spokes to fill in when scanlines skip some
+	PPI_QUEUE_LEN   = 8192            // scanlines which can wait to be drawn for a page; further ones are dropped
+	PPI_MAX_CLIENTS = 4               // most pages which can show the PPI at once, since each costs CPU time
+)
+
+// ppiSettings is what a PPI page asks for.
+type ppiSettings struct {
+	Range float64 `json:"range"` // metres covered by the spokes; 0 means the digitizer's full range
+}
+
+// ppiInfo tells a PPI page how to draw spokes.
+type ppiInfo struct {
+	Spokes int     `json:"spokes"` // spokes per rotation
+	Cells  int     `json:"cells"`  // cells per spoke
+	Range  float64 `json:"range"`  // metres covered by the spokes
+}
+
+// ppiClient is a page showing the PPI.
+type ppiClient struct {
+	lines chan buffer.Scanline // copies of scanlines to draw
+	conn  *websocket.Conn
+	want  float64         // range asked for by the page; 0 means the digitizer's full range
+	rng   float64         // range of the spokes last sent; 0 if none
+	spoke int             // spoke being assembled; -1 if none
+	cells [PPI_CELLS]byte // cells of the spoke being assembled
+}
+
+// SetRanging sets the digitizer settings used to compute the ranges of
+// samples.
+func (s *Server) SetRanging(r buffer.RangeParams) {
+	s.mu.Lock()
+	s.ranging = r
+	s.mu.Unlock()
+}
+
+// AddScanline queues l to be drawn by each page showing the PPI.  It
+// does not block, so it can be an Acquirer hook.
+func (s *Server) AddScanline(l *buffer.Scanline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.ppis {
+		select {
+		case c.lines <- *l:
+		default:
+		}
+	}
+}
+
+// AddSweep keeps the completed sweep sw, for starting the PPI on
+// pages.  It does not block, so it can be a SweepAssembler handler.
+func (s *Server) AddSweep(sw *buffer.Sweep) {
+	s.mu.Lock()
+	s.sweep = sw
+	s.mu.Unlock()
+}
+
+// servePPI serves the PPI page.
+func (s *Server) servePPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, ppiPage)
+}
+
+// servePPIWS streams spokes to a PPI page until it goes away.
+func (s *Server) servePPIWS(w http.ResponseWriter, r *http.Request) {
+	c := &ppiClient{lines: make(chan buffer.Scanline, PPI_QUEUE_LEN), spoke: -1}
+	s.mu.Lock()
+	full := len(s.ppis) >= PPI_MAX_CLIENTS
+	if !full {
+		s.ppis[c] = true
+	}
+	s.mu.Unlock()
+	if full {
+		http.Error(w, fmt.Sprintf("the PPI is already being shown on %d pages, the most allowed", PPI_MAX_CLIENTS), http.StatusServiceUnavailable)
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.ppis, c)
+		s.mu.Unlock()
+	}()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has replied to the client
+	}
+	defer conn.Close()
+	c.conn = conn
+	msgs, gone := readMessages(conn)
+	started := false // true once the page has sent its settings
+	for {
+		select {
+		case <-gone:
+			return
+		case m := <-msgs:
+			var ps ppiSettings
+			if json.Unmarshal(m, &ps) != nil || ps.Range < 0 {
+				continue // not from the page; ignore it
+			}
+			started, c.want, c.spoke = true, ps.Range, -1
+			s.mu.Lock()
+			sw := s.sweep
+			s.mu.Unlock()
+			if err := c.sendSweep(sw, s.azi); err != nil {
+				return
+			}
+		case l := <-c.lines:
+			if !started {
+				continue
+			}
+			s.mu.Lock()
+			r := s.ranging
+			s.mu.Unlock()
+			if err := c.add(&l, r, s.azi); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// add adds l, digitized with settings r, to the spoke for its azimuth,
+// sending the previous spoke if l starts a new one.
+func (c *ppiClient) add(l *buffer.Scanline, r buffer.RangeParams, azi *azimuth.Model) error {
+	if !azi.Valid() || l.NumSamples() == 0 {
+		return nil
+	}
+	rng := c.want
+	if rng == 0 {
+		rng = l.MaxRange(r)
+	}
+	if rng <= 0 {
+		return nil
+	}
+	var cells [PPI_CELLS]byte
+	l.Reduce(cells[:], r, rng, 8)
+	// reducing copies the samples; check that they weren't overwritten
+	// while it did
+	if !l.Valid() {
+		return nil
+	}
+	if err := c.setRange(rng); err != nil {
+		return err
+	}
+	spoke := spokeOf(azi, l)
+	if spoke == c.spoke {
+		maxCells(&c.cells, &cells)
+		return nil
+	}
+	if c.spoke >= 0 {
+		n := 1
+		if gap := (spoke - c.spoke + PPI_SPOKES) % PPI_SPOKES; gap <= PPI_MAX_FILL {
+			n = gap
+		}
+		spokes := make([][PPI_CELLS]byte, n)
+		for i := range spokes {
+			spokes[i] = c.cells
+		}
+		if err := c.send(c.spoke, spokes); err != nil {
+			return err
+		}
+	}
+	c.spoke, c.cells = spoke, cells
+	return nil
+}
+
+// sendSweep sends every spoke of the sweep sw, if there is one.
+func (c *ppiClient) sendSweep(sw *buffer.Sweep, azi *azimuth.Model) error {
+	if sw == nil || !azi.Valid() {
+		return nil
+	}
+	rng := c.want
+	if rng == 0 {
+		rng = sw.MaxRange()
+	}
+	if rng <= 0 {
+		return nil
+	}
+	spokes := make([][PPI_CELLS]byte, PPI_SPOKES)
+	var cells [PPI_CELLS]byte
+	for i := 0; i < sw.NumLines(); i++ {
+		l := sw.Line(i)
+		if l.NumSamples() == 0 {
+			continue
+		}
+		l.Reduce(cells[:], sw.Ranging, rng, 8)
+		if !l.Valid() {
+			continue // the rest of the sweep has likely been overwritten too, but the page can show what's left
+		}
+		maxCells(&spokes[spokeOf(azi, l)], &cells)
+	}
+	if err := c.setRange(rng); err != nil {
+		return err
+	}
+	return c.send(0, spokes)
+}
+
+// setRange tells the page that spokes now cover rng metres, if that
+// is news to it.
+func (c *ppiClient) setRange(rng float64) error {
+	if rng == c.rng {
+		return nil
+	}
+	c.rng = rng
+	c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+	return c.conn.WriteJSON(ppiInfo{Spokes: PPI_SPOKES, Cells: PPI_CELLS, Range: rng})
+}
+
+// send sends spokes first, first+1, ... (mod PPI_SPOKES) to the page.
+func (c *ppiClient) send(first int, spokes [][PPI_CELLS]byte) error {
+	b := make([]byte, 4, 4+len(spokes)*PPI_CELLS)
+	binary.LittleEndian.PutUint16(b[0:], uint16(first))
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(spokes)))
+	for i := range spokes {
+		b = append(b, spokes[i][:]...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+	return c.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// spokeOf returns the spoke nearest the azimuth of l.
+func spokeOf(azi *azimuth.Model, l *buffer.Scanline) int {
+	return int(azi.Azimuth(&l.ScanlineHdr)*PPI_SPOKES/360+0.5) % PPI_SPOKES
+}
+
+// maxCells sets each cell of c to the larger of it and the
+// corresponding cell of d.
+func maxCells(c, d *[PPI_CELLS]byte) {
+	for i, v := range d {
+		if v > c[i] {
+			c[i] = v
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package web
+
+// The page served at /ppi.
+
+const ppiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ogdar PPI</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+canvas { display: block; margin-top: 0.5em; background: #000; }
+fieldset { display: inline-block; vertical-align: top; }
+input[type=range] { width: 12em; vertical-align: middle; }
+.warn { color: #b00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>ogdar PPI</h1>
+<p><a href="/">Status and registers</a> | <a href="/scope">Scope</a></p>
+
+<fieldset>
+<legend>Display</legend>
+Range
+<select id="range">
+<option value="0">full (all samples)</option>
+<option value="0.125">0.125 NM</option>
+<option value="0.25">0.25 NM</option>
+<option value="0.5">0.5 NM</option>
+<option value="0.75">0.75 NM</option>
+<option value="1.5">1.5 NM</option>
+<option value="3">3 NM</option>
+<option value="6">6 NM</option>
+<option value="12">12 NM</option>
+<option value="24">24 NM</option>
+</select>
+<br>
+Gain <input id="gain" type="range" min="0" max="100" value="70">
+<br>
+Contrast <input id="contrast" type="range" min="0" max="100" value="30">
+<br>
+<label><input id="rings" type="checkbox" checked> Range rings</label>
+<label><input id="heading" type="checkbox" checked> Heading line</label>
+</fieldset>
+
+<p id="msg"></p>
+<canvas id="ppi" width="800" height="800"></canvas>
+
+<script>
+"use strict";
+
+var NM = 1852; // metres per nautical mile
+var spokes = 0, cells = 0, range = 0;
+var data = null;    // cells of each spoke, spoke after spoke
+var lookup = null;  // for each pixel, its index in data, or -1 if outside the display
+var palette = new Uint32Array(256);
+var lastSpoke = -1; // most recently drawn spoke, for the sweep line
+var received = 0;
+var dirty = false;
+var ws = null;
+
+var cv = document.getElementById("ppi");
+var g = cv.getContext("2d");
+var img = g.createImageData(cv.width, cv.height);
+var pixels = new Uint32Array(img.data.buffer);
+var radius = Math.min(cv.width, cv.height) / 2;
+
+function text(id, s, cls) {
+	var e = document.getElementById(id);
+	e.textContent = s;
+	e.className = cls || "";
+}
+
+// rgba returns a pixel value for img, whichever the byte order.
+var littleEndian = new Uint8Array(new Uint32Array([1]).buffer)[0] == 1;
+function rgba(r, g, b) {
+	if (littleEndian) {
+		return (255 << 24 | b << 16 | g << 8 | r) >>> 0;
+	}
+	return (r << 24 | g << 16 | b << 8 | 255) >>> 0;
+}
+
+// makePalette maps cell values to colours.  Gain sets the weakest
+// echo shown; contrast sets how quickly stronger echoes brighten.
+function makePalette() {
+	var gain = document.getElementById("gain").value / 100;
+	var contrast = document.getElementById("contrast").value / 100;
+	var floor = 255 * (1 - gain);
+	var span = Math.max(1, (255 - floor) * (1 - 0.95 * contrast));
+	for (var v = 0; v < 256; v++) {
+		var level = Math.max(0, Math.min(1, (v - floor) / span));
+		palette[v] = rgba(Math.round(255 * level), Math.round(220 * level), Math.round(40 * level));
+	}
+	dirty = true;
+}
+
+// makeLookup works out which cell of which spoke each pixel shows.
+function makeLookup() {
+	lookup = new Int32Array(cv.width * cv.height);
+	var cx = cv.width / 2, cy = cv.height / 2;
+	for (var y = 0; y < cv.height; y++) {
+		for (var x = 0; x < cv.width; x++) {
+			var dx = x + 0.5 - cx, dy = cy - (y + 0.5);
+			var r = Math.sqrt(dx * dx + dy * dy);
+			var p = y * cv.width + x;
+			if (r >= radius) {
+				lookup[p] = -1;
+				continue;
+			}
+			var az = Math.atan2(dx, dy) / (2 * Math.PI);
+			if (az < 0) {
+				az += 1;
+			}
+			var s = Math.round(az * spokes) % spokes;
+			lookup[p] = s * cells + Math.floor(r / radius * cells);
+		}
+	}
+}
+
+// niceStep returns a range ring spacing giving a few rings out to rng.
+function niceStep(rng) {
+	var x = rng / 4;
+	var p = Math.pow(10, Math.floor(Math.log10(x)));
+	var m = x / p;
+	return p * (m < 1.5 ? 1 : m < 3.5 ? 2 : m < 7.5 ? 5 : 10);
+}
+
+function draw() {
+	requestAnimationFrame(draw);
+	if (!dirty || !data) {
+		return;
+	}
+	dirty = false;
+	var bg = rgba(0, 0, 0);
+	for (var p = 0; p < pixels.length; p++) {
+		var i = lookup[p];
+		pixels[p] = i < 0 ? bg : palette[data[i]];
+	}
+	g.putImageData(img, 0, 0);
+	var cx = cv.width / 2, cy = cv.height / 2;
+	if (lastSpoke >= 0) {
+		var a = lastSpoke / spokes * 2 * Math.PI;
+		g.strokeStyle = "rgba(120, 255, 120, 0.8)";
+		g.beginPath();
+		g.moveTo(cx, cy);
+		g.lineTo(cx + radius * Math.sin(a), cy - radius * Math.cos(a));
+		g.stroke();
+	}
+	if (document.getElementById("heading").checked) {
+		g.strokeStyle = "#fff";
+		g.beginPath();
+		g.moveTo(cx, cy);
+		g.lineTo(cx, cy - radius);
+		g.stroke();
+	}
+	if (document.getElementById("rings").checked && range > 0) {
+		var nm = range / NM;
+		var step = niceStep(nm);
+		g.strokeStyle = "rgba(0, 200, 255, 0.6)";
+		g.fillStyle = "rgb(0, 200, 255)";
+		for (var k = 1; k * step <= nm * 1.0001; k++) {
+			var r = k * step / nm * radius;
+			g.beginPath();
+			g.arc(cx, cy, r, 0, 2 * Math.PI);
+			g.stroke();
+			g.fillText(+(k * step).toPrecision(3) + " NM", cx + 3, cy - r + 12);
+		}
+	}
+}
+
+function settings() {
+	return JSON.stringify({range: parseFloat(document.getElementById("range").value) * NM});
+}
+
+function setInfo(info) {
+	if (info.spokes != spokes || info.cells != cells) {
+		spokes = info.spokes;
+		cells = info.cells;
+		data = new Uint8Array(spokes * cells);
+		makeLookup();
+	}
+	range = info.range;
+	dirty = true;
+}
+
+function addSpokes(buf) {
+	if (!data) {
+		return;
+	}
+	var dv = new DataView(buf);
+	var first = dv.getUint16(0, true), n = dv.getUint16(2, true);
+	var c = new Uint8Array(buf, 4);
+	for (var i = 0; i < n; i++) {
+		data.set(c.subarray(i * cells, (i + 1) * cells), ((first + i) % spokes) * cells);
+	}
+	if (n < spokes) {
+		// not a whole sweep; the antenna is here
+		lastSpoke = (first + n - 1) % spokes;
+	}
+	received += n;
+	dirty = true;
+}
+
+function connect() {
+	var proto = location.protocol == "https:" ? "wss:" : "ws:";
+	ws = new WebSocket(proto + "//" + location.host + "/ppi/ws");
+	ws.binaryType = "arraybuffer";
+	ws.onopen = function() {
+		ws.send(settings());
+	};
+	ws.onmessage = function(ev) {
+		if (typeof ev.data == "string") {
+			setInfo(JSON.parse(ev.data));
+		} else {
+			addSpokes(ev.data);
+		}
+	};
+	ws.onclose = function() {
+		text("msg", "disconnected; reconnecting", "warn");
+		setTimeout(connect, 2000);
+	};
+}
+
+setInterval(function() {
+	if (ws && ws.readyState != WebSocket.OPEN) {
+		return;
+	}
+	if (received == 0) {
+		text("msg", "waiting for scanlines with known azimuths", "warn");
+	} else {
+		text("msg", "range " + +(range / NM).toPrecision(3) + " NM (" + Math.round(range) + " m)");
+	}
+}, 1000);
+
+document.getElementById("range").addEventListener("change", function() {
+	if (data) {
+		data.fill(0);
+	}
+	lastSpoke = -1;
+	if (ws && ws.readyState == WebSocket.OPEN) {
+		ws.send(settings());
+	}
+});
+document.getElementById("gain").addEventListener("input", makePalette);
+document.getElementById("contrast").addEventListener("input", makePalette);
+document.getElementById("rings").addEventListener("change", function() { dirty = true; });
+document.getElementById("heading").addEventListener("change", function() { dirty = true; });
+makePalette();
+connect();
+requestAnimationFrame(draw);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,175 @@
+package web
+
+// The oscilloscope page, which shows raw captures of the video,
+// trigger, ACP and ARP channels, streamed over a WebSocket.
+//
+// The page sends its settings as a JSON scopeSettings whenever they
+// change.  While Run is true, the server captures the four channels
+// with the FPGA triggered by Source, sends the capture as a JSON
+// scopeFrame, and repeats, at most once per SCOPE_INTERVAL.  A capture
+// stops normal acquisition until it is triggered, or until
+// SCOPE_TIMEOUT has passed; that is short, since triggers and ACPs
+// come many times a second, but a capture triggered by the ARP may
+// have to wait SCOPE_ARP_TIMEOUT, most of a rotation, so while one is
+// being shown few scanlines are acquired.  Thresholds are changed
+// through /api/regs/, like other registers.
+//
+// Because captures hold up acquisition, only one page at a time can
+// show the scope, and none can when Config.ReadOnly is true.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/jbrzusto/ogdar/fpga"
+	"net/http"
+	"time"
+)
+
+const (
+	SCOPE_INTERVAL      = 200 * time.Millisecond // shortest time between captures sent to a page
+	SCOPE_TIMEOUT       = 100 * time.Millisecond // longest wait for a capture to be triggered
+	SCOPE_ARP_TIMEOUT   = 3 * time.Second        // longest wait for a capture to be triggered by the ARP; a rotation at 20 RPM
+	SCOPE_DEFAULT_SAMPS = 2048                   // samples per channel until the page asks for another number
+	WS_WRITE_TIMEOUT    = 10 * time.Second       // longest time to send a message to a page
+)
+
+// scopeSettings is what a scope page asks for.
+type scopeSettings struct {
+	Source string `json:"source"` // trigger source: "immediate", "trig", "acp" or "arp"
+	N      int    `json:"n"`      // samples per channel; 0 means the current value of NumSamp
+	Run    bool   `json:"run"`    // false pauses captures
+}
+
+// scopeFrame is a capture sent to a scope page, or an error.
+type scopeFrame struct {
+	*fpga.ScopeCapture
+	Thresholds map[string][2]int64 `json:"thresholds,omitempty"` // excite and relax thresholds of the "trig", "acp" and "arp" channels
+	Error      string              `json:"error,omitempty"`      // why there is no capture
+}
+
+// thresholdRegs names the registers holding each channel's excite and
+// relax thresholds.
+var thresholdRegs = map[string][2]string{
+	"trig": {"TrigThreshExcite", "TrigThreshRelax"},
+	"acp":  {"ACPThreshExcite", "ACPThreshRelax"},
+	"arp":  {"ARPThreshExcite", "ARPThreshRelax"},
+}
+
+// thresholds returns the current excite and relax thresholds of each
+// channel in thresholdRegs.
+func thresholds() map[string][2]int64 {
+	th := make(map[string][2]int64, len(thresholdRegs))
+	for ch, names := range thresholdRegs {
+		var v [2]int64
+		for i, name := range names {
+			if f, ok := fpga.FindRegField(name); ok {
+				v[i] = f.Int(f.Get())
+			}
+		}
+		th[ch] = v
+	}
+	return th
+}
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 64 * 1024}
+
+// readMessages reads messages from conn in a new goroutine, keeping
+// only the most recent one waiting in msgs, since a page's latest
+// settings replace any earlier ones.  gone is closed once conn can't
+// be read, e.g. because the page has gone away.
+func readMessages(conn *websocket.Conn) (msgs <-chan []byte, gone <-chan struct{}) {
+	m := make(chan []byte, 1)
+	g := make(chan struct{})
+	go func() {
+		defer close(g)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case <-m:
+			default:
+			}
+			m <- msg
+		}
+	}()
+	return m, g
+}
+
+// serveScope serves the scope page.
+func (s *Server) serveScope(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, scopePage)
+}
+
+// serveScopeWS streams captures to a scope page until it goes away.
+func (s *Server) serveScopeWS(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly() {
+		http.Error(w, "the scope can't be used: [web] ReadOnly is true", http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	busy := s.scoping
+	s.scoping = true
+	s.mu.Unlock()
+	if busy {
+		http.Error(w, "the scope is already in use by another page", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		s.scoping = false
+		s.mu.Unlock()
+	}()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has replied to the client
+	}
+	defer conn.Close()
+	msgs, gone := readMessages(conn)
+	cur := scopeSettings{Source: "trig", N: SCOPE_DEFAULT_SAMPS}
+	var next <-chan time.Time
+	for {
+		select {
+		case <-gone:
+			return
+		case m := <-msgs:
+			var ss scopeSettings
+			if json.Unmarshal(m, &ss) != nil {
+				continue // not from the page; ignore it
+			}
+			cur = ss
+		case <-next:
+		}
+		next = nil
+		if !cur.Run {
+			continue
+		}
+		f := s.capture(cur)
+		conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+		if err := conn.WriteJSON(f); err != nil {
+			return
+		}
+		next = time.After(SCOPE_INTERVAL)
+	}
+}
+
+// capture makes a capture with settings ss.
+func (s *Server) capture(ss scopeSettings) (f scopeFrame) {
+	t, err := fpga.ParseTrigType(ss.Source)
+	if err == nil {
+		timeout := SCOPE_TIMEOUT
+		if t == fpga.TRG_ARP {
+			timeout = SCOPE_ARP_TIMEOUT
+		}
+		f.ScopeCapture, err = s.b.Scope(t, ss.N, timeout)
+	}
+	if err != nil {
+		f.Error = err.Error()
+		return
+	}
+	f.Thresholds = thresholds()
+	return
+}
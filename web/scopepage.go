@@ -0,0 +1,250 @@
+package web
+
+// The page served at /scope.
+
+const scopePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ogdar scope</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+canvas { border: 1px solid #ccc; display: block; margin-top: 0.5em; }
+input.num { width: 6em; font-family: monospace; }
+fieldset { display: inline-block; vertical-align: top; }
+.warn { color: #b00; font-weight: bold; }
+.excite { color: #d00; }
+.relax { color: #00c; }
+</style>
+</head>
+<body>
+<h1>ogdar scope</h1>
+<p><a href="/">Status and registers</a> | <a href="/ppi">PPI</a></p>
+
+<fieldset>
+<legend>Capture</legend>
+Trigger on
+<select id="source">
+<option value="immediate">immediate (TRG_IMMEDIATE)</option>
+<option value="trig" selected>trigger pulse (TRG_TRIG)</option>
+<option value="acp">ACP pulse (TRG_ACP)</option>
+<option value="arp">ARP pulse (TRG_ARP)</option>
+</select>
+<br>
+Samples <input id="n" class="num" value="2048">
+<button id="run">Pause</button>
+<label><input id="auto" type="checkbox"> Autoscale</label>
+</fieldset>
+
+<fieldset>
+<legend>Thresholds (raw ADC values)</legend>
+<table id="thresholds"></table>
+</fieldset>
+
+<p id="msg"></p>
+<canvas id="plot" width="1000" height="640"></canvas>
+
+<script>
+"use strict";
+
+var channels = [
+	{key: "vid", name: "video", bits: 14, fast: true},
+	{key: "trig", name: "trigger", bits: 14, fast: true},
+	{key: "acp", name: "ACP", bits: 12, fast: false},
+	{key: "arp", name: "ARP", bits: 12, fast: false}
+];
+var regs = {
+	trig: ["TrigThreshExcite", "TrigThreshRelax"],
+	acp: ["ACPThreshExcite", "ACPThreshRelax"],
+	arp: ["ARPThreshExcite", "ARPThreshRelax"]
+};
+var running = true;
+var last = null;
+var ws = null;
+
+function text(id, s, cls) {
+	var e = document.getElementById(id);
+	e.textContent = s;
+	e.className = cls || "";
+}
+
+function settings() {
+	return JSON.stringify({
+		source: document.getElementById("source").value,
+		n: parseInt(document.getElementById("n").value, 10) || 0,
+		run: running
+	});
+}
+
+function send() {
+	if (ws && ws.readyState == WebSocket.OPEN) {
+		ws.send(settings());
+	}
+}
+
+function connect() {
+	var proto = location.protocol == "https:" ? "wss:" : "ws:";
+	ws = new WebSocket(proto + "//" + location.host + "/scope/ws");
+	ws.onopen = send;
+	ws.onmessage = function(ev) {
+		var f = JSON.parse(ev.data);
+		if (f.error) {
+			text("msg", f.error, "warn");
+			return;
+		}
+		last = f;
+		var d = new Date(f.time);
+		text("msg", "captured at " + d.toLocaleTimeString() + ": " + f.vid.length + " samples");
+		draw(f);
+	};
+	ws.onclose = function() {
+		text("msg", "disconnected, or refused because another page is using the scope or [web] ReadOnly is true; retrying", "warn");
+		setTimeout(connect, 2000);
+	};
+}
+
+function fmtTime(t) {
+	if (t >= 1e-3) {
+		return (t * 1e3).toPrecision(3) + " ms";
+	}
+	return (t * 1e6).toPrecision(3) + " µs";
+}
+
+function draw(f) {
+	var cv = document.getElementById("plot");
+	var g = cv.getContext("2d");
+	var w = cv.width, h = cv.height / channels.length;
+	g.clearRect(0, 0, cv.width, cv.height);
+	var auto = document.getElementById("auto").checked;
+	for (var c = 0; c < channels.length; c++) {
+		var ch = channels[c];
+		var data = f[ch.key];
+		var th = f.thresholds ? f.thresholds[ch.key] : null;
+		var lo = -(1 << (ch.bits - 1)), hi = (1 << (ch.bits - 1)) - 1;
+		if (auto) {
+			lo = hi = data[0];
+			for (var i = 1; i < data.length; i++) {
+				lo = Math.min(lo, data[i]);
+				hi = Math.max(hi, data[i]);
+			}
+			if (th) {
+				lo = Math.min(lo, th[0], th[1]);
+				hi = Math.max(hi, th[0], th[1]);
+			}
+			if (hi == lo) {
+				hi = lo + 1;
+			}
+		}
+		var top = c * h;
+		var y = function(v) {
+			return top + h - 2 - (v - lo) / (hi - lo) * (h - 4);
+		};
+		g.strokeStyle = "#ccc";
+		g.strokeRect(0, top, w, h);
+		// one vertical line per column, spanning the samples in it
+		g.strokeStyle = "#000";
+		g.beginPath();
+		var n = data.length;
+		for (var x = 0; x < w; x++) {
+			var i0 = Math.floor(x * n / w), i1 = Math.max(i0 + 1, Math.floor((x + 1) * n / w));
+			var mn = data[i0], mx = data[i0];
+			for (var j = i0 + 1; j < i1 && j < n; j++) {
+				mn = Math.min(mn, data[j]);
+				mx = Math.max(mx, data[j]);
+			}
+			g.moveTo(x + 0.5, y(mx));
+			g.lineTo(x + 0.5, y(mn) + 1);
+		}
+		g.stroke();
+		if (th) {
+			var colours = ["#d00", "#00c"];
+			for (var k = 0; k < 2; k++) {
+				g.strokeStyle = colours[k];
+				g.beginPath();
+				g.moveTo(0, y(th[k]));
+				g.lineTo(w, y(th[k]));
+				g.stroke();
+			}
+		}
+		var period = ch.fast ? f.fast_period : f.slow_period;
+		g.fillStyle = "#000";
+		g.fillText(ch.name + ": " + lo + "..." + hi + ", " + fmtTime(n * period) + " across", 4, top + 12);
+	}
+}
+
+function setReg(name, input) {
+	var body = new URLSearchParams();
+	body.set("value", input.value);
+	fetch("/api/regs/" + name, {method: "POST", body: body, headers: {"X-Requested-With": "ogdar"}}).then(function(resp) {
+		return resp.text().then(function(t) {
+			if (!resp.ok) {
+				text("msg", t, "warn");
+			} else {
+				text("msg", name + " set to " + JSON.parse(t).value);
+			}
+		});
+	}).catch(function(err) { text("msg", String(err), "warn"); });
+}
+
+function thresholdRow(ch, label) {
+	var tr = document.createElement("tr");
+	var td = document.createElement("td");
+	td.textContent = label;
+	tr.appendChild(td);
+	regs[ch].forEach(function(name, k) {
+		var td = document.createElement("td");
+		var span = document.createElement("span");
+		span.textContent = k == 0 ? "excite " : "relax ";
+		span.className = k == 0 ? "excite" : "relax";
+		var input = document.createElement("input");
+		input.className = "num";
+		input.id = name;
+		input.addEventListener("keydown", function(ev) {
+			if (ev.key == "Enter") {
+				setReg(name, input);
+			}
+		});
+		var button = document.createElement("button");
+		button.textContent = "Set";
+		button.addEventListener("click", function() { setReg(name, input); });
+		td.appendChild(span);
+		td.appendChild(input);
+		td.appendChild(button);
+		tr.appendChild(td);
+	});
+	document.getElementById("thresholds").appendChild(tr);
+}
+
+thresholdRow("trig", "trigger");
+thresholdRow("acp", "ACP");
+thresholdRow("arp", "ARP");
+
+// fill in the current thresholds, which are then the operator's to change
+fetch("/api/regs").then(function(resp) { return resp.json(); }).then(function(rs) {
+	rs.forEach(function(r) {
+		var input = document.getElementById(r.name);
+		if (input) {
+			input.value = r.value;
+			input.disabled = !r.writable;
+		}
+	});
+});
+
+document.getElementById("source").addEventListener("change", send);
+document.getElementById("n").addEventListener("change", send);
+document.getElementById("auto").addEventListener("change", function() {
+	if (last) {
+		draw(last);
+	}
+});
+document.getElementById("run").addEventListener("click", function() {
+	running = !running;
+	this.textContent = running ? "Pause" : "Run";
+	send();
+});
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,273 @@
+/*
+Package web serves ogdar's web interface: a page showing the
+digitizer's status and every FPGA register, from which the read-write
+registers can be changed, an oscilloscope page (/scope) showing the
+raw video, trigger, ACP and ARP channels, and a plan position
+indicator (/ppi) drawn from the digitized video.
+
+# API
+
+The page gets everything it shows from these, which scripts can also
+use:
+
+	GET  /api/status      Status, as JSON
+	GET  /api/regs        a Register for each FPGA register, as JSON
+	POST /api/regs/NAME   set register NAME to the form value "value";
+	                      responds with its Register, as JSON.  The
+	                      request must have an X-Requested-With header
+	GET  /scope/ws        WebSocket streaming scope captures; see scope.go
+	GET  /ppi/ws          WebSocket streaming PPI spokes; see ppi.go
+
+Registers are set between acquisitions, as when the config file is
+reloaded, and values are checked as they would be there; see
+Backend.SetReg.  Changes are not saved to ogdar.toml,
+so they last until the register is next set from the config file.
+When Config.ReadOnly is true, registers can't be set.
+
+There is no authentication, so by default the interface is served only
+on the loopback address, and is read-only.  Requests to set registers
+need the X-Requested-With header so that other web sites a browser has
+open can't send them: a page can't add headers to a request to another
+site without that site's permission, which this server never gives.
+The WebSockets likewise refuse pages from other sites.
+*/
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jbrzusto/ogdar/azimuth"
+	"github.com/jbrzusto/ogdar/buffer"
+	"github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/monitor"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SET_TIMEOUT is how long a request to set a register waits for the
+// change to be made.
+const SET_TIMEOUT = 2 * time.Second
+
+// Config holds parameters for the web interface.  It is read from the
+// [web] section of ogdar.toml.
+type Config struct {
+	Addr     string // TCP address to listen on, e.g. ":8080" for all interfaces; "" means don't serve
+	ReadOnly bool   // if true, registers can be viewed but not changed
+}
+
+// DefaultConfig is used for any values not given in ogdar.toml.
+var DefaultConfig = Config{
+	Addr:     "127.0.0.1:8080",
+	ReadOnly: true,
+}
+
+// Status is what the page shows about the digitizer.
+type Status struct {
+	ConfigPath      string    `json:"config_path"`       // config file in use; "" if none was found
+	ConfigFound     bool      `json:"config_found"`      // false if ogdar is using its (likely bogus) defaults
+	Radar           string    `json:"radar"`             // radar model
+	Profile         string    `json:"profile"`           // active operating profile; "" if none
+	ExpectedPRF     float64   `json:"expected_prf"`      // from the config file, Hz; 0 if unknown
+	ExpectedACPs    uint32    `json:"expected_acps"`     // ACPs per rotation, from the config file
+	State           string    `json:"state"`             // radar health; see monitor.State
+	Time            time.Time `json:"time"`              // when PRF, RPM and ACPsPerRotation were measured
+	PRF             float64   `json:"prf"`               // measured pulse repetition frequency, Hz; 0 if unknown
+	RPM             float64   `json:"rpm"`               // measured antenna rotation rate; 0 if unknown
+	ACPsPerRotation uint32    `json:"acps_per_rotation"` // ACPs between the two most recent ARPs; 0 if unknown
+	Problems        []string  `json:"problems"`          // deviations from expected values
+	Captured        uint64    `json:"captured"`          // scanlines captured
+	Dropped         uint64    `json:"dropped"`           // scanlines dropped for lack of buffer space
+}
+
+// SetMonitor fills in the measurements in s from ms.
+func (s *Status) SetMonitor(ms monitor.Status) {
+	s.State, s.Time, s.PRF, s.RPM, s.ACPsPerRotation, s.Problems = ms.State.String(), ms.Time, ms.PRF, ms.RPM, ms.ACPsPerRotation, ms.Problems
+}
+
+// Register describes an FPGA register and its current value.
+type Register struct {
+	Name     string `json:"name"`
+	Mode     string `json:"mode"`     // "rw", "r" or "p"; see fpga.RegField
+	Desc     string `json:"desc"`     // description, from the field's desc tag
+	Value    string `json:"value"`    // current value, as in ogdar.toml; "" if not readable
+	Min      int64  `json:"min"`      // smallest value which can be set
+	Max      int64  `json:"max"`      // largest value which can be set
+	Writable bool   `json:"writable"` // true if the register can be set from the page
+}
+
+// Backend is the running digitizer, as seen by the web interface.
+type Backend interface {
+	// Status returns the digitizer's current status.
+	Status() Status
+	// SetReg sets the register f to v between acquisitions, waiting
+	// at most timeout for this to happen, and logs the change as
+	// asked for by from.  It returns false if the change is still
+	// pending, e.g. because there are no triggers; it is then made at
+	// the next acquisition.  If v is not an allowed value for f, given
+	// the other registers' values, it returns an error and f is not
+	// set.
+	SetReg(f *fpga.RegField, v uint64, timeout time.Duration, from string) (bool, error)
+	// Scope captures the four raw channels between acquisitions, as
+	// by fpga.Scope.
+	Scope(t fpga.TrigType, n int, timeout time.Duration) (*fpga.ScopeCapture, error)
+}
+
+// Server is the web interface.  It is safe for concurrent use.
+type Server struct {
+	mu      sync.Mutex
+	cfg     Config
+	b       Backend
+	azi     *azimuth.Model
+	mux     *http.ServeMux
+	ranging buffer.RangeParams  // digitizer settings, for the ranges of scanlines
+	sweep   *buffer.Sweep       // most recent completed sweep; nil if none
+	ppis    map[*ppiClient]bool // pages showing the PPI
+	scoping bool                // true while a page is showing the scope
+}
+
+// New returns a Server for b, which takes the azimuth of each scanline
+// from azi.  Call Run to start it.
+func New(cfg Config, b Backend, azi *azimuth.Model) *Server {
+	s := &Server{cfg: cfg, b: b, azi: azi, mux: http.NewServeMux(), ppis: make(map[*ppiClient]bool)}
+	s.mux.HandleFunc("/", s.serveIndex)
+	s.mux.HandleFunc("/api/status", s.serveStatus)
+	s.mux.HandleFunc("/api/regs", s.serveRegs)
+	s.mux.HandleFunc("/api/regs/", s.serveSetReg)
+	s.mux.HandleFunc("/scope", s.serveScope)
+	s.mux.HandleFunc("/scope/ws", s.serveScopeWS)
+	s.mux.HandleFunc("/ppi", s.servePPI)
+	s.mux.HandleFunc("/ppi/ws", s.servePPIWS)
+	return s
+}
+
+// SetConfig changes the server's configuration.  A change to Addr
+// takes effect when Run is next called.
+func (s *Server) SetConfig(cfg Config) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+}
+
+// Handle registers h for URLs starting with pattern, so that other
+// parts of ogdar can add pages.  It must be called before Run.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// Run serves the web interface on the configured address until stop
+// is closed.  It returns an error if it can't listen.
+func (s *Server) Run(stop <-chan struct{}) error {
+	s.mu.Lock()
+	addr := s.cfg.Addr
+	s.mu.Unlock()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{Handler: s.mux}
+	go func() {
+		<-stop
+		hs.Close()
+	}()
+	if err := hs.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// readOnly returns true if registers can't be set.
+func (s *Server) readOnly() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg.ReadOnly
+}
+
+// serveIndex serves the page.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, indexPage)
+}
+
+// serveStatus serves the digitizer's status.
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.b.Status())
+}
+
+// serveRegs serves a description of every register.
+func (s *Server) serveRegs(w http.ResponseWriter, r *http.Request) {
+	ro := s.readOnly()
+	regs := make([]Register, len(fpga.RegFields))
+	for i := range fpga.RegFields {
+		regs[i] = register(&fpga.RegFields[i], ro)
+	}
+	writeJSON(w, http.StatusOK, regs)
+}
+
+// serveSetReg sets the register named by the last element of the URL.
+func (s *Server) serveSetReg(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to set a register", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.readOnly() {
+		http.Error(w, "registers can't be set: [web] ReadOnly is true", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Requested-With") == "" {
+		http.Error(w, "requests to set registers need an X-Requested-With header", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/regs/")
+	f, ok := fpga.FindRegField(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no register named %q", name), http.StatusNotFound)
+		return
+	}
+	if !f.Writable() {
+		http.Error(w, fmt.Sprintf("register %s can't be set; its mode is %q", f.Name, f.Mode), http.StatusForbidden)
+		return
+	}
+	v, err := f.Parse(r.FormValue("value"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	done, err := s.b.SetReg(f, v, SET_TIMEOUT, r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := http.StatusOK
+	if !done {
+		// the new value will be shown once it has been set
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, register(f, false))
+}
+
+// register returns a Register describing f; it is not writable if ro
+// is true.
+func register(f *fpga.RegField, ro bool) Register {
+	min, max := f.Range()
+	reg := Register{Name: f.Name, Mode: f.Mode, Desc: f.Desc, Min: min, Max: max, Writable: f.Writable() && !ro}
+	if f.Readable() {
+		reg.Value = f.Format(f.Get())
+	}
+	return reg
+}
+
+// writeJSON writes v to w as JSON, with HTTP status code status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,67 @@
+package main
+
+// The web interface's view of the running digitizer.
+
+import (
+	"fmt"
+	"github.com/jbrzusto/ogdar/azimuth"
+	. "github.com/jbrzusto/ogdar/buffer"
+	. "github.com/jbrzusto/ogdar/fpga"
+	"github.com/jbrzusto/ogdar/web"
+	"time"
+)
+
+// WebConfig holds parameters for the web interface.
+var WebConfig = web.DefaultConfig
+
+// webBackend is the running digitizer, for the web interface.
+type webBackend struct {
+	rl   *reloader
+	path string // config file in use; "" if none was found
+}
+
+// Status returns the digitizer's status for the web interface.
+func (b *webBackend) Status() (s web.Status) {
+	b.rl.mu.Lock()
+	s.Radar, s.Profile = Radar.Model, ActiveProfile
+	exp := expectedFor(&Radar, &Profiles, ActiveProfile)
+	b.rl.mu.Unlock()
+	s.ConfigPath, s.ConfigFound = b.path, configFound
+	s.ExpectedPRF, s.ExpectedACPs = exp.PRF, exp.ACPsPerRotation
+	s.SetMonitor(b.rl.mon.Status())
+	s.Captured, s.Dropped = b.rl.acq.Stats()
+	return
+}
+
+// SetReg sets a register as asked for through the web interface.
+func (b *webBackend) SetReg(f *RegField, v uint64, timeout time.Duration, from string) (bool, error) {
+	return b.rl.setReg(f, v, timeout, "web interface at "+from)
+}
+
+// Scope captures the four raw channels between acquisitions, for the
+// web interface's scope page.
+func (b *webBackend) Scope(t TrigType, n int, timeout time.Duration) (sc *ScopeCapture, err error) {
+	<-b.rl.acq.SetParams(func() { sc, err = Scope(t, n, timeout) })
+	return
+}
+
+// startWeb starts serving the web interface for b, if cfg.Addr is
+// set, until stop is closed.  Its PPI is drawn from scanlines from src
+// and sweeps from asm, with azimuths from azi.  The server is returned
+// even if it is not started, so that its settings can be updated on
+// reload.
+func startWeb(cfg web.Config, b web.Backend, src scanlineSource, asm *SweepAssembler, azi *azimuth.Model, stop <-chan struct{}) *web.Server {
+	srv := web.New(cfg, b, azi)
+	if cfg.Addr == "" {
+		return srv
+	}
+	src.AddHook(srv.AddScanline)
+	asm.OnSweep(srv.AddSweep)
+	go func() {
+		if err := srv.Run(stop); err != nil {
+			fmt.Printf("Unable to serve web interface: %v\n", err)
+		}
+	}()
+	fmt.Printf("Serving web interface on %s\n", cfg.Addr)
+	return srv
+}